@@ -0,0 +1,260 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v5.27.0
+// source: clusterpb/cluster.proto
+
+package clusterpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Cluster_Increment_FullMethodName      = "/requestcounter.cluster.Cluster/Increment"
+	Cluster_Get_FullMethodName            = "/requestcounter.cluster.Cluster/Get"
+	Cluster_BatchIncrement_FullMethodName = "/requestcounter.cluster.Cluster/BatchIncrement"
+	Cluster_Watch_FullMethodName          = "/requestcounter.cluster.Cluster/Watch"
+)
+
+// ClusterClient is the client API for Cluster service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ClusterClient interface {
+	// Increment adds delta to the count and returns the new count.
+	Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*Count, error)
+	// Get returns the current count without changing it.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Count, error)
+	// BatchIncrement applies increments in order and returns
+	// the new count after each one.
+	BatchIncrement(ctx context.Context, in *BatchIncrementRequest, opts ...grpc.CallOption) (*BatchIncrementResponse, error)
+	// Watch streams the count, first its current value and then
+	// every time it changes, at most once per min_interval_ms.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Cluster_WatchClient, error)
+}
+
+type clusterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewClusterClient(cc grpc.ClientConnInterface) ClusterClient {
+	return &clusterClient{cc}
+}
+
+func (c *clusterClient) Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*Count, error) {
+	out := new(Count)
+	err := c.cc.Invoke(ctx, Cluster_Increment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clusterClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Count, error) {
+	out := new(Count)
+	err := c.cc.Invoke(ctx, Cluster_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clusterClient) BatchIncrement(ctx context.Context, in *BatchIncrementRequest, opts ...grpc.CallOption) (*BatchIncrementResponse, error) {
+	out := new(BatchIncrementResponse)
+	err := c.cc.Invoke(ctx, Cluster_BatchIncrement_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clusterClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Cluster_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cluster_ServiceDesc.Streams[0], Cluster_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &clusterWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Cluster_WatchClient interface {
+	Recv() (*Count, error)
+	grpc.ClientStream
+}
+
+type clusterWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *clusterWatchClient) Recv() (*Count, error) {
+	m := new(Count)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ClusterServer is the server API for Cluster service.
+// All implementations must embed UnimplementedClusterServer
+// for forward compatibility
+type ClusterServer interface {
+	// Increment adds delta to the count and returns the new count.
+	Increment(context.Context, *IncrementRequest) (*Count, error)
+	// Get returns the current count without changing it.
+	Get(context.Context, *GetRequest) (*Count, error)
+	// BatchIncrement applies increments in order and returns
+	// the new count after each one.
+	BatchIncrement(context.Context, *BatchIncrementRequest) (*BatchIncrementResponse, error)
+	// Watch streams the count, first its current value and then
+	// every time it changes, at most once per min_interval_ms.
+	Watch(*WatchRequest, Cluster_WatchServer) error
+	mustEmbedUnimplementedClusterServer()
+}
+
+// UnimplementedClusterServer must be embedded to have forward compatible implementations.
+type UnimplementedClusterServer struct {
+}
+
+func (UnimplementedClusterServer) Increment(context.Context, *IncrementRequest) (*Count, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Increment not implemented")
+}
+func (UnimplementedClusterServer) Get(context.Context, *GetRequest) (*Count, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedClusterServer) BatchIncrement(context.Context, *BatchIncrementRequest) (*BatchIncrementResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchIncrement not implemented")
+}
+func (UnimplementedClusterServer) Watch(*WatchRequest, Cluster_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedClusterServer) mustEmbedUnimplementedClusterServer() {}
+
+// UnsafeClusterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ClusterServer will
+// result in compilation errors.
+type UnsafeClusterServer interface {
+	mustEmbedUnimplementedClusterServer()
+}
+
+func RegisterClusterServer(s grpc.ServiceRegistrar, srv ClusterServer) {
+	s.RegisterService(&Cluster_ServiceDesc, srv)
+}
+
+func _Cluster_Increment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IncrementRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClusterServer).Increment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cluster_Increment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClusterServer).Increment(ctx, req.(*IncrementRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cluster_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClusterServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cluster_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClusterServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cluster_BatchIncrement_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchIncrementRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClusterServer).BatchIncrement(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cluster_BatchIncrement_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClusterServer).BatchIncrement(ctx, req.(*BatchIncrementRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cluster_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ClusterServer).Watch(m, &clusterWatchServer{stream})
+}
+
+type Cluster_WatchServer interface {
+	Send(*Count) error
+	grpc.ServerStream
+}
+
+type clusterWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *clusterWatchServer) Send(m *Count) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Cluster_ServiceDesc is the grpc.ServiceDesc for Cluster service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Cluster_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "requestcounter.cluster.Cluster",
+	HandlerType: (*ClusterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Increment",
+			Handler:    _Cluster_Increment_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Cluster_Get_Handler,
+		},
+		{
+			MethodName: "BatchIncrement",
+			Handler:    _Cluster_BatchIncrement_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Cluster_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "clusterpb/cluster.proto",
+}
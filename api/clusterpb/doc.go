@@ -0,0 +1,5 @@
+// Package clusterpb is the gRPC API of the Cluster service.
+package clusterpb
+
+// buf is pinned, as is the protoc version it reports to the plugins.
+//go:generate sh -c "cd .. && go run github.com/bufbuild/buf/cmd/buf@v1.47.2 generate"
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/admin"
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxAdminBody      = 64 * 1024
+	defaultAuditLimit = 100
+	maxAuditLimit     = 10000
+)
+
+// adminAPI manages counters, persistence, rules, quotas and tenants on the admin listener:
+//
+//	GET    /admin/counters                list counters and their values
+//	GET    /admin/counters/{name}         get a counter
+//	PUT    /admin/counters/{name}         set a counter, {"value": n}
+//	DELETE /admin/counters/{name}         delete a counter
+//	POST   /admin/counters/{name}/reset   reset a counter to zero
+//	POST   /admin/counters/{name}/rename  rename a counter, {"to": "new name"}
+//	POST   /admin/snapshot                persist the db now
+//	GET    /admin/status                  persistence status
+//	GET    /admin/audit                   query the audit log, see auditLog
+//	GET    /admin/audit/verify            verify the audit log hash chain
+//	       /admin/rules/...               rules API, see rules.Engine, if RULES_FILE is set
+//	       /admin/quotas/...              quotas API, see quota.Manager
+//	       /admin/tenants/...             tenants API, see tenant.Registry
+//
+// A "/" in a counter name must be escaped as %2F. The counters endpoints
+// manage the counters of a tenant's namespace with the "tenant" query
+// parameter, and the audit log is filtered by it.
+// Changes to counters are recorded in the db's audit log.
+type adminAPI struct {
+	s *Server
+}
+
+type counterValue struct {
+	Counter string `json:"counter"`
+	Value   uint64 `json:"value"`
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/admin")
+
+	switch {
+	case path == "/rules" || strings.HasPrefix(path, "/rules/"):
+		if a.s.rules == nil {
+			requestid.Error(w, r, "rules are disabled, set RULES_FILE", http.StatusNotFound)
+			return
+		}
+		http.StripPrefix("/admin/rules", a.s.rules).ServeHTTP(w, r)
+
+	case path == "/quotas" || strings.HasPrefix(path, "/quotas/"):
+		http.StripPrefix("/admin/quotas", a.s.quotas).ServeHTTP(w, r)
+
+	case path == "/tenants" || strings.HasPrefix(path, "/tenants/"):
+		http.StripPrefix("/admin/tenants", a.s.tenants).ServeHTTP(w, r)
+
+	case path == "/counters" || path == "/counters/":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		store, err := a.counters(r)
+		if err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names := store.Names()
+		counters := make([]counterValue, 0, len(names))
+		for _, name := range names {
+			if v, ok := store.Get(name); ok {
+				counters = append(counters, counterValue{name, v})
+			}
+		}
+		admin.WriteJSON(w, http.StatusOK, counters)
+
+	case strings.HasPrefix(path, "/counters/"):
+		a.counter(w, r, strings.TrimPrefix(path, "/counters/"))
+
+	case path == "/audit":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		a.auditLog(w, r)
+
+	case path == "/audit/verify":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		st := a.s.db.VerifyAudit()
+		status := http.StatusOK
+		if !st.OK {
+			logging.Ctx(r.Context()).Error("audit log verification failed", logging.F("seq", st.BadSeq), logging.F("reason", st.Error))
+			status = http.StatusConflict
+		}
+		admin.WriteJSON(w, status, st)
+
+	case path == "/snapshot":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		if err := a.s.db.Snapshot(); err != nil {
+			logging.Ctx(r.Context()).Error("snapshot failed", logging.Err(err))
+			requestid.Error(w, r, "snapshot failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, a.s.db.Stats())
+
+	case path == "/status":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		var pending int
+		if a.s.rules != nil {
+			pending = a.s.rules.Pending()
+		}
+		admin.WriteJSON(w, http.StatusOK, struct {
+			DB              db.Stats `json:"db"`
+			WebhooksPending int      `json:"webhooks_pending"`
+		}{a.s.db.Stats(), pending})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// counterStore is the counters of the db or of a namespace of it.
+type counterStore interface {
+	counterGetter
+	Names() []string
+	Set(ctx context.Context, name string, v uint64) error
+	Reset(ctx context.Context, name string) error
+	Delete(ctx context.Context, name string) bool
+	Rename(ctx context.Context, from, to string) error
+}
+
+// counters returns the counters of the namespace of the tenant
+// in the "tenant" query parameter, or those of the db without one.
+// The tenant need not exist, to manage the counters of one removed.
+func (a *adminAPI) counters(r *http.Request) (counterStore, error) {
+	id := r.URL.Query().Get("tenant")
+	if id == "" {
+		return a.s.db, nil
+	}
+	return a.s.db.Namespace(id)
+}
+
+// counter serves /admin/counters/{name} and its actions.
+func (a *adminAPI) counter(w http.ResponseWriter, r *http.Request, path string) {
+	escaped, action, _ := strings.Cut(path, "/")
+	name, err := url.PathUnescape(escaped)
+	if err != nil || name == "" || strings.Contains(action, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	store, err := a.counters(r)
+	if err != nil {
+		requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// recorded in the audit log as made by the authenticated admin.
+	ctx := db.WithWho(r.Context(), admin.Who(r.Context()))
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+
+	case action == "" && r.Method == http.MethodPut:
+		var body struct {
+			Value *uint64 `json:"value"`
+		}
+		if err := decodeJSON(r, &body); err != nil || body.Value == nil {
+			requestid.Error(w, r, `expected {"value": n}`, http.StatusBadRequest)
+			return
+		}
+		err = store.Set(ctx, name, *body.Value)
+
+	case action == "" && r.Method == http.MethodDelete:
+		if !store.Delete(ctx, name) {
+			err = db.ErrNotFound
+		}
+
+	case action == "reset" && r.Method == http.MethodPost:
+		err = store.Reset(ctx, name)
+
+	case action == "rename" && r.Method == http.MethodPost:
+		var body struct {
+			To string `json:"to"`
+		}
+		if err := decodeJSON(r, &body); err != nil || body.To == "" {
+			requestid.Error(w, r, `expected {"to": "new name"}`, http.StatusBadRequest)
+			return
+		}
+		if err = store.Rename(ctx, name, body.To); err == nil {
+			name = body.To
+		}
+
+	case action == "" || action == "reset" || action == "rename":
+		methodNotAllowed(w, r)
+		return
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch err {
+	case nil:
+	case db.ErrNotFound:
+		requestid.Error(w, r, err.Error(), http.StatusNotFound)
+		return
+	case db.ErrExists:
+		requestid.Error(w, r, err.Error(), http.StatusConflict)
+		return
+	default:
+		requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	v, ok := store.Get(name)
+	if !ok {
+		requestid.Error(w, r, db.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, counterValue{name, v})
+}
+
+// auditLog serves the audit log entries matching the tenant, counter, who,
+// since and until (RFC 3339) query parameters, the last limit (default 100) of them.
+func (a *adminAPI) auditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := db.AuditQuery{
+		Namespace: q.Get("tenant"),
+		Counter:   q.Get("counter"),
+		Who:       q.Get("who"),
+		Limit:     defaultAuditLimit,
+	}
+
+	var err error
+	parseTime := func(key string, t *time.Time) {
+		if v := q.Get(key); v != "" && err == nil {
+			*t, err = time.Parse(time.RFC3339, v)
+		}
+	}
+	parseTime("since", &query.Since)
+	parseTime("until", &query.Until)
+	if v := q.Get("limit"); v != "" && err == nil {
+		query.Limit, err = strconv.Atoi(v)
+		if err == nil && (query.Limit <= 0 || query.Limit > maxAuditLimit) {
+			err = errors.New("limit must be between 1 and " + strconv.Itoa(maxAuditLimit))
+		}
+	}
+	if err != nil {
+		requestid.Error(w, r, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := a.s.db.QueryAudit(query)
+	if err != nil {
+		logging.Ctx(r.Context()).Error("unable to query audit log", logging.Err(err))
+		requestid.Error(w, r, "unable to query audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []db.AuditEntry{}
+	}
+	admin.WriteJSON(w, http.StatusOK, entries)
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxAdminBody))
+	dec.DisallowUnknownFields()
+	return errors.WithStack(dec.Decode(v))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	requestid.Error(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
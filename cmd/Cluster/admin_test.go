@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/RoanBrand/RequestCounter/internal/admin"
+	"github.com/RoanBrand/RequestCounter/internal/db"
+)
+
+func TestAdminAPI(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+	os.Remove("test.test.audit")
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+	defer os.Remove("test.test.audit")
+
+	s := Server{db: db.NewDB("test.test")}
+	defer s.db.Close()
+	if err := s.db.EnableAudit(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := admin.NewServer(admin.Config{Tokens: map[string]string{"alice": "secret"}}, &adminAPI{s: &s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, body, token string, expected int) string {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, path, expected, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	do(http.MethodGet, "/admin/counters", "", "", http.StatusUnauthorized)
+	do(http.MethodGet, "/admin/counters", "", "wrong", http.StatusUnauthorized)
+	do(http.MethodGet, "/debug/vars", "", "", http.StatusUnauthorized)
+
+	do(http.MethodPut, "/admin/counters/a%2Fb", `{"value": 5}`, "secret", http.StatusOK)
+	if v, _ := s.db.Get("a/b"); v != 5 {
+		t.Fatalf("expected a/b to be set to 5, got %d", v)
+	}
+	do(http.MethodPut, "/admin/counters/x", `{"val": 5}`, "secret", http.StatusBadRequest)
+
+	do(http.MethodPost, "/admin/counters/a%2Fb/rename", `{"to": "c"}`, "secret", http.StatusOK)
+	do(http.MethodPost, "/admin/counters/a%2Fb/rename", `{"to": "c"}`, "secret", http.StatusNotFound)
+	do(http.MethodPost, "/admin/counters/c/reset", "", "secret", http.StatusOK)
+	if body := do(http.MethodGet, "/admin/counters/c", "", "secret", http.StatusOK); !strings.Contains(body, `"value":0`) {
+		t.Fatalf("expected c to be reset, got %s", body)
+	}
+
+	do(http.MethodDelete, "/admin/counters/c", "", "secret", http.StatusNoContent)
+	do(http.MethodGet, "/admin/counters/c", "", "secret", http.StatusNotFound)
+	do(http.MethodPost, "/admin/snapshot", "", "secret", http.StatusOK)
+
+	var counters []counterValue
+	if err := json.Unmarshal([]byte(do(http.MethodGet, "/admin/counters", "", "secret", http.StatusOK)), &counters); err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 1 || counters[0].Counter != db.DefaultCounter {
+		t.Fatalf("expected only the default counter, got %v", counters)
+	}
+
+	var entries []db.AuditEntry
+	if err := json.Unmarshal([]byte(do(http.MethodGet, "/admin/audit?who=alice", "", "secret", http.StatusOK)), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+	for _, e := range entries {
+		if e.RequestID == "" {
+			t.Fatalf("expected request id to be recorded, got %+v", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	if strings.Join(actions, ",") != "set,rename,reset,delete" {
+		t.Fatalf("unexpected audit log actions %v", actions)
+	}
+
+	do(http.MethodGet, "/admin/audit?since=yesterday", "", "secret", http.StatusBadRequest)
+	if body := do(http.MethodGet, "/admin/audit/verify", "", "secret", http.StatusOK); !strings.Contains(body, `"entries":4`) {
+		t.Fatalf("expected audit log of 4 entries to verify, got %s", body)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/admin"
+	"github.com/RoanBrand/RequestCounter/internal/certs"
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
+	"github.com/pkg/errors"
+)
+
+// defaultShutdownTimeout is the time Close waits for in-flight requests, if not configured.
+const defaultShutdownTimeout = time.Second * 5
+
+var settings = []config.Setting{
+	{Name: "LISTEN_ADDR", Usage: "address of the http listener"},
+	{Name: "GRPC_ADDR", Usage: "address of the gRPC listener, disabled if not set"},
+	{Name: "TCP_ADDR", Usage: "address of the binary TCP listener, disabled if not set"},
+	{Name: "RESP_ADDR", Usage: "address of the RESP (Redis protocol) listener, disabled if not set"},
+	{Name: "STATSD_ADDR", Usage: "UDP address of the StatsD listener, disabled if not set"},
+	{Name: "DB_FILE", Usage: "file to persist counters to"},
+	{Name: "RULES_FILE", Usage: "file of alerting rules, disabled if not set"},
+	{Name: "QUOTAS_FILE", Usage: "file of quotas, disabled if not set"},
+	{Name: "TENANTS_FILE", Usage: "file of tenants, disabled if not set"},
+	{Name: "TLS_CERT", Usage: "certificate file to serve over TLS"},
+	{Name: "TLS_KEY", Usage: "key file of TLS_CERT"},
+	{Name: "TLS_CLIENT_CA", Usage: "CA file of client certificates to require"},
+	{Name: "CLIENT_COUNTERS", Usage: "comma separated counters StatsD and unauthenticated RESP clients may create, or prefixes ending in *; others must exist"},
+	{Name: "CLIENT_MAX_COUNTERS", Kind: config.Int, Default: "10000", Usage: "named counters beyond which StatsD and unauthenticated RESP clients can't create more"},
+	{Name: "SIGNING_KEYS", Usage: "comma separated id:secret keys requests must be signed with", Secret: true},
+	{Name: "SIGNING_MAX_SKEW", Kind: config.Duration, Default: "1m", Usage: "maximum age of signed requests"},
+	{Name: "WATCH_MAX_RATE", Kind: config.Float, Default: "10", Usage: "maximum updates per second sent to watchers", Reloadable: true},
+	{Name: "SHUTDOWN_TIMEOUT", Kind: config.Duration, Default: "5s", Usage: "time to finish in-flight requests when stopping"},
+}
+
+// allSettings are the settings of the command and the packages it configures.
+var allSettings = [][]config.Setting{settings, admin.Settings, logging.Settings, tracing.Settings, config.Settings}
+
+// serverConfig is the config of a Server, see Init.
+type serverConfig struct {
+	ListenAddr string
+	// listeners of other protocols, disabled if not set.
+	GRPCAddr, TCPAddr, RESPAddr, StatsDAddr string
+
+	DBFile string
+	// files of rules, quotas and tenants, disabled if not set.
+	RulesFile, QuotasFile, TenantsFile string
+
+	// ClientCounters limits the counters StatsD and RESP clients can change.
+	ClientCounters clientCounters
+
+	Admin   admin.Config
+	TLS     *certs.Server     // nil to serve without TLS
+	Signing *signing.Verifier // nil to not require signed requests
+
+	WatchInterval   time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// serverConfigFrom checks settings and returns the config of the server.
+// All problems found are returned together as config.Errors.
+func serverConfigFrom(get config.Getter) (serverConfig, error) {
+	c := serverConfig{
+		ListenAddr:  get("LISTEN_ADDR"),
+		GRPCAddr:    get("GRPC_ADDR"),
+		TCPAddr:     get("TCP_ADDR"),
+		RESPAddr:    get("RESP_ADDR"),
+		StatsDAddr:  get("STATSD_ADDR"),
+		DBFile:      get("DB_FILE"),
+		RulesFile:   get("RULES_FILE"),
+		QuotasFile:  get("QUOTAS_FILE"),
+		TenantsFile: get("TENANTS_FILE"),
+	}
+
+	var errs config.Errors
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// kinds are checked by config.Load, so only ranges are left to check.
+	if c.ShutdownTimeout, _ = time.ParseDuration(get("SHUTDOWN_TIMEOUT")); c.ShutdownTimeout <= 0 {
+		check(errors.Errorf("SHUTDOWN_TIMEOUT: invalid timeout %q", get("SHUTDOWN_TIMEOUT")))
+	}
+
+	maxCounters, _ := strconv.Atoi(get("CLIENT_MAX_COUNTERS"))
+	if maxCounters < 0 {
+		check(errors.Errorf("CLIENT_MAX_COUNTERS: invalid number %q", get("CLIENT_MAX_COUNTERS")))
+	}
+	c.ClientCounters = parseClientCounters(get("CLIENT_COUNTERS"), maxCounters)
+
+	var err error
+	c.WatchInterval, err = watchInterval(get)
+	check(err)
+
+	c.Admin, err = admin.ConfigFrom(get)
+	check(err)
+
+	_, err = tracing.ConfigFrom("cluster", get)
+	check(err)
+
+	if certFile := get("TLS_CERT"); certFile != "" {
+		c.TLS, err = certs.LoadServer(certFile, get("TLS_KEY"), get("TLS_CLIENT_CA"))
+		check(errors.WithMessage(err, "TLS_CERT"))
+	}
+
+	if v := get("SIGNING_KEYS"); v != "" {
+		keys, err := signing.ParseKeys(v)
+		check(errors.WithMessage(err, "SIGNING_KEYS"))
+
+		maxSkew, _ := time.ParseDuration(get("SIGNING_MAX_SKEW"))
+		if maxSkew <= 0 {
+			check(errors.Errorf("SIGNING_MAX_SKEW: invalid duration %q", get("SIGNING_MAX_SKEW")))
+		}
+		if err == nil && maxSkew > 0 {
+			c.Signing = signing.NewVerifier(keys, maxSkew)
+		}
+	}
+
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// watchInterval returns the minimum time between updates to watchers of WATCH_MAX_RATE.
+func watchInterval(get config.Getter) (time.Duration, error) {
+	v := get("WATCH_MAX_RATE")
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate <= 0 {
+		return 0, errors.Errorf("WATCH_MAX_RATE: invalid rate %q", v)
+	}
+	return time.Duration(float64(time.Second) / rate), nil
+}
+
+// applyConfig puts the reloadable settings of next that differ from prev into effect.
+func (s *Server) applyConfig(prev, next *config.Config) error {
+	changed := func(names ...string) bool {
+		for _, name := range names {
+			if prev.Get(name) != next.Get(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if changed("LOG_LEVEL", "LOG_FORMAT", "ACCESS_LOG_SAMPLE_RATIO") {
+		if err := logging.SetupFrom("cluster", next.Get); err != nil {
+			return err
+		}
+	}
+
+	if changed("WATCH_MAX_RATE") {
+		interval, err := watchInterval(next.Get)
+		if err != nil {
+			return err
+		}
+		s.setWatchInterval(interval)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+)
+
+func TestServerConfigFrom(t *testing.T) {
+	settings := map[string]string{
+		"LISTEN_ADDR":      ":8000",
+		"SHUTDOWN_TIMEOUT": "5s",
+		"WATCH_MAX_RATE":   "10",
+		"SIGNING_KEYS":     "k1:secret",
+		"SIGNING_MAX_SKEW": "1m",
+	}
+	get := func(name string) string { return settings[name] }
+
+	c, err := serverConfigFrom(get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != ":8000" || c.Signing == nil {
+		t.Fatalf("unexpected config %+v", c)
+	}
+
+	settings["SHUTDOWN_TIMEOUT"] = "0s"
+	settings["WATCH_MAX_RATE"] = "0"
+	settings["SIGNING_KEYS"] = "k1"
+	settings["SIGNING_MAX_SKEW"] = "-1m"
+	settings["ADMIN_TLS_CERT"] = "admin.crt"
+
+	_, err = serverConfigFrom(get)
+	errs, ok := err.(config.Errors)
+	if !ok || len(errs) != 5 {
+		t.Fatalf("expected all 5 problems reported, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/pkg/errors"
+)
+
+// maxClientCounterName is the longest counter name clients that are not
+// authenticated can use.
+const maxClientCounterName = 255
+
+// clientCounters limits the named counters that StatsD and unauthenticated
+// RESP clients can change, as anyone who reaches their listeners can.
+type clientCounters struct {
+	// allow are the names of counters they may create, or prefixes of them
+	// ending in "*". Other counters must already exist.
+	allow []string
+	// max is the number of named counters beyond which they can't create more.
+	max int
+}
+
+// parseClientCounters parses a comma separated list of allowed names or prefixes.
+func parseClientCounters(v string, max int) clientCounters {
+	c := clientCounters{max: max}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			c.allow = append(c.allow, name)
+		}
+	}
+	return c
+}
+
+func (c *clientCounters) allows(name string) bool {
+	for _, a := range c.allow {
+		if prefix := strings.TrimSuffix(a, "*"); prefix != a {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == a {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClientCounter returns why a client that is not authenticated
+// may not add to the counter called name, nil if it may.
+// Counters of quota windows are reserved for quotas.
+func (s *Server) checkClientCounter(name string) error {
+	if len(name) > maxClientCounterName {
+		return errors.New("counter name too long")
+	}
+	if quota.IsWindowCounter(name) {
+		return errors.New("counter of a quota window")
+	}
+	if _, ok := s.db.Get(name); ok {
+		return nil
+	}
+
+	if !s.clientCounters.allows(name) {
+		return errors.New("counter does not exist")
+	}
+	if s.db.Len() >= s.clientCounters.max {
+		return errors.New("too many counters")
+	}
+	return nil
+}
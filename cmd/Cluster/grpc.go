@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/api/clusterpb"
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcServer implements the gRPC API of cluster.
+type grpcServer struct {
+	clusterpb.UnimplementedClusterServer
+	s *Server
+}
+
+func newGRPCServer(s *Server) *grpc.Server {
+	unary := []grpc.UnaryServerInterceptor{requestIDUnary, traceUnary}
+	var stream []grpc.StreamServerInterceptor
+	if s.signing != nil {
+		unary = append(unary, s.signatureUnary)
+		stream = append(stream, s.signatureStream)
+	}
+
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...)}
+	if s.tls != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tls.Config(tls.RequireAndVerifyClientCert))))
+	}
+
+	g := grpc.NewServer(opts...)
+	clusterpb.RegisterClusterServer(g, &grpcServer{s: s})
+	return g
+}
+
+// requestIDUnary adds the request id of the call's x-request-id
+// metadata, or a new one, to its context.
+func requestIDUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestid.Header); len(v) > 0 {
+			id = v[0]
+		}
+	}
+	if !requestid.Valid(id) {
+		id = requestid.New()
+	}
+
+	return handler(requestid.NewContext(ctx, id), req)
+}
+
+// traceUnary serves unary calls in a server span, continuing
+// the trace of the call's traceparent metadata.
+func traceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(tracing.TraceparentHeader); len(v) > 0 {
+			if sc, ok := tracing.ParseTraceparent(v[0]); ok {
+				ctx = tracing.ContextWithRemote(ctx, sc)
+			}
+		}
+	}
+
+	ctx, span := tracing.Start(ctx, info.FullMethod, tracing.KindServer)
+	defer span.End()
+	if span != nil {
+		ctx = logging.ContextWith(ctx, logging.F("trace_id", span.SpanContext().TraceID.String()))
+	}
+
+	resp, err := handler(ctx, req)
+	span.SetError(err)
+	return resp, err
+}
+
+// signatureUnary only serves calls signed by one of the signing keys.
+func (s *Server) signatureUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.verifyCall(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// signatureStream only serves streams whose first request is signed
+// by one of the signing keys.
+func (s *Server) signatureStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &verifiedStream{ServerStream: ss, s: s, method: info.FullMethod})
+}
+
+type verifiedStream struct {
+	grpc.ServerStream
+	s        *Server
+	method   string
+	verified bool
+}
+
+func (vs *verifiedStream) RecvMsg(m interface{}) error {
+	if err := vs.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if !vs.verified {
+		if err := vs.s.verifyCall(vs.Context(), vs.method, m); err != nil {
+			return err
+		}
+		vs.verified = true
+	}
+	return nil
+}
+
+// verifyCall checks the signature in the metadata of a call to method with req.
+func (s *Server) verifyCall(ctx context.Context, method string, req interface{}) error {
+	pm, ok := req.(proto.Message)
+	if !ok {
+		return status.Error(codes.Internal, "request is not a protobuf message")
+	}
+
+	m, err := signing.GRPCMessage(method, pm)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	err = s.signing.Verify(m, func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	})
+	if err != nil {
+		signing.Reject(ctx, err)
+		if err == signing.ErrBusy {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return nil
+}
+
+// stopGRPC stops the gRPC server gracefully, or forcefully if ctx is done first.
+func stopGRPC(ctx context.Context, g *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		g.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		g.Stop()
+	}
+}
+
+func (g *grpcServer) Increment(_ context.Context, r *clusterpb.IncrementRequest) (*clusterpb.Count, error) {
+	if r.Delta == 0 {
+		return nil, status.Error(codes.InvalidArgument, errZeroDelta.Error())
+	}
+	return &clusterpb.Count{Count: g.s.increment(r.Delta, r.IdempotencyKey)}, nil
+}
+
+func (g *grpcServer) Get(context.Context, *clusterpb.GetRequest) (*clusterpb.Count, error) {
+	return &clusterpb.Count{Count: g.s.db.Count()}, nil
+}
+
+func (g *grpcServer) BatchIncrement(_ context.Context, r *clusterpb.BatchIncrementRequest) (*clusterpb.BatchIncrementResponse, error) {
+	if len(r.Increments) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no increments")
+	}
+	for _, inc := range r.Increments {
+		if inc.Delta == 0 {
+			return nil, status.Error(codes.InvalidArgument, errZeroDelta.Error())
+		}
+	}
+
+	resp := clusterpb.BatchIncrementResponse{Counts: make([]uint64, len(r.Increments))}
+	for i, inc := range r.Increments {
+		resp.Counts[i] = g.s.increment(inc.Delta, inc.IdempotencyKey)
+	}
+
+	return &resp, nil
+}
+
+func (g *grpcServer) Watch(r *clusterpb.WatchRequest, stream clusterpb.Cluster_WatchServer) error {
+	interval := g.s.minWatchInterval()
+	if d := time.Duration(r.MinIntervalMs) * time.Millisecond; d > interval {
+		interval = d
+	}
+
+	return g.s.streamCounters(stream.Context(), g.s.db, []string{db.DefaultCounter}, interval, grpcWatchStream{stream})
+}
+
+type grpcWatchStream struct {
+	stream clusterpb.Cluster_WatchServer
+}
+
+func (st grpcWatchStream) send(u counterUpdate) error {
+	return st.stream.Send(&clusterpb.Count{Count: u.Count})
+}
+
+func (st grpcWatchStream) heartbeat() error {
+	return nil // gRPC has its own keepalive
+}
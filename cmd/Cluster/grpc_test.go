@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/api/clusterpb"
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGRPC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	os.Remove("test.test") // in case previous run failed
+
+	s := Server{
+		ctx:  ctx,
+		db:   db.NewDB("test.test"),
+		idem: newIdempotencyCache(ctx),
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGRPCServer(&s)
+	go g.Serve(lis)
+	defer g.Stop()
+
+	cc, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := clusterpb.NewClusterClient(cc)
+
+	watch, err := c.Watch(ctx, &clusterpb.WatchRequest{MinIntervalMs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := watch.Recv(); err != nil {
+		t.Fatal(err)
+	} else if n.Count != 0 {
+		t.Fatalf("expected initial count 0, got %d", n.Count)
+	}
+
+	if n, err := c.Increment(ctx, &clusterpb.IncrementRequest{Delta: 1}); err != nil {
+		t.Fatal(err)
+	} else if n.Count != 1 {
+		t.Fatalf("expected 1, got %d", n.Count)
+	}
+
+	batch, err := c.BatchIncrement(ctx, &clusterpb.BatchIncrementRequest{Increments: []*clusterpb.IncrementRequest{
+		{Delta: 5, IdempotencyKey: "a"},
+		{Delta: 5, IdempotencyKey: "a"},
+		{Delta: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, exp := range []uint64{6, 6, 8} {
+		if batch.Counts[i] != exp {
+			t.Fatalf("expected %v, got %v", []uint64{6, 6, 8}, batch.Counts)
+		}
+	}
+
+	if n, err := c.Get(ctx, &clusterpb.GetRequest{}); err != nil {
+		t.Fatal(err)
+	} else if n.Count != 8 {
+		t.Fatalf("expected 8, got %d", n.Count)
+	}
+
+	// updates are coalesced, but must end with the latest count.
+	for {
+		n, err := watch.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Count == 8 {
+			break
+		}
+	}
+}
+
+func TestGRPCSigning(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	os.Remove("test.test") // in case previous run failed
+
+	key := signing.Key{ID: "k1", Secret: []byte("secret")}
+	s := Server{
+		ctx:     ctx,
+		db:      db.NewDB("test.test"),
+		idem:    newIdempotencyCache(ctx),
+		signing: signing.NewVerifier([]signing.Key{key}, 0),
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGRPCServer(&s)
+	go g.Serve(lis)
+	defer g.Stop()
+
+	cc, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := clusterpb.NewClusterClient(cc)
+
+	signed := func(method string, req proto.Message) context.Context {
+		m, err := signing.GRPCMessage(method, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var md []string
+		if err := key.Sign(m, func(k, v string) { md = append(md, k, v) }); err != nil {
+			t.Fatal(err)
+		}
+		return metadata.AppendToOutgoingContext(ctx, md...)
+	}
+
+	req := &clusterpb.IncrementRequest{Delta: 2}
+	if _, err := c.Increment(ctx, req); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unsigned call to be rejected, got %v", err)
+	}
+
+	if _, err := c.Increment(signed(clusterpb.Cluster_Increment_FullMethodName, &clusterpb.IncrementRequest{Delta: 3}), req); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected call with tampered request to be rejected, got %v", err)
+	}
+
+	if n, err := c.Increment(signed(clusterpb.Cluster_Increment_FullMethodName, req), req); err != nil {
+		t.Fatal(err)
+	} else if n.Count != 2 {
+		t.Fatalf("expected 2, got %d", n.Count)
+	}
+
+	watchReq := &clusterpb.WatchRequest{MinIntervalMs: 1}
+	watch, err := c.Watch(ctx, watchReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watch.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unsigned stream to be rejected, got %v", err)
+	}
+
+	watch, err = c.Watch(signed(clusterpb.Cluster_Watch_FullMethodName, watchReq), watchReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := watch.Recv(); err != nil {
+		t.Fatal(err)
+	} else if n.Count != 2 {
+		t.Fatalf("expected 2, got %d", n.Count)
+	}
+}
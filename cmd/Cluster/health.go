@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/RoanBrand/RequestCounter/internal/health"
+	"github.com/pkg/errors"
+)
+
+// healthzHandler reports whether the server is alive:
+// it is persisting the db.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	health.Checks{
+		"flusher": s.flusherCheck,
+	}.ServeHTTP(w, r)
+}
+
+// readyzHandler reports whether the server should receive requests:
+// it is alive, loaded the saved db and is not shutting down.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	health.Checks{
+		"db":       func(context.Context) error { return s.db.LoadErr() },
+		"flusher":  s.flusherCheck,
+		"shutdown": s.shutdownCheck,
+	}.ServeHTTP(w, r)
+}
+
+func (s *Server) flusherCheck(context.Context) error {
+	return s.db.FlushErr()
+}
+
+func (s *Server) shutdownCheck(context.Context) error {
+	if s.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+	return nil
+}
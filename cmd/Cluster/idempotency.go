@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyTTL     = time.Minute
+	idempotencyMaxKeys = 100000
+)
+
+// idempotencyCache remembers the result of recent requests by their
+// idempotency key, so that a retried or hedged request is counted once.
+// Keys are only known to this instance, so RequestCounter retries and
+// hedges a request only to the endpoints of the instance it sent it to.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	results map[string]*idempotentResult
+	order   []*idempotentResult // oldest first, may hold removed results
+}
+
+// idempotentResult is the result of the request with key,
+// which is in flight until done is closed.
+type idempotentResult struct {
+	key     string
+	done    chan struct{}
+	count   uint64
+	err     error
+	expires time.Time
+}
+
+func newIdempotencyCache(ctx context.Context) *idempotencyCache {
+	c := &idempotencyCache{results: make(map[string]*idempotentResult)}
+
+	go func() {
+		t := time.NewTicker(idempotencyTTL / 2)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				c.expire(now)
+			}
+		}
+	}()
+
+	return c
+}
+
+// do returns the result previously stored for key,
+// otherwise it stores and returns the result of f.
+func (c *idempotencyCache) do(key string, f func() uint64) uint64 {
+	count, _ := c.try(key, func() (uint64, error) { return f(), nil })
+	return count
+}
+
+// try is like do, but the result of f is only stored if it succeeds,
+// so that a refused request is tried again when retried.
+// Requests with the same key wait for the one in flight,
+// without holding up requests with other keys.
+func (c *idempotencyCache) try(key string, f func() (uint64, error)) (uint64, error) {
+	for {
+		c.mu.Lock()
+		r, ok := c.results[key]
+		if !ok || r.expired(time.Now()) {
+			break // with c.mu held
+		}
+		c.mu.Unlock()
+
+		<-r.done
+		if r.err == nil {
+			return r.count, nil
+		}
+		// it failed, so this attempt is tried again.
+	}
+
+	r := &idempotentResult{key: key, done: make(chan struct{})}
+	c.add(r)
+	c.mu.Unlock()
+
+	r.count, r.err = f()
+
+	c.mu.Lock()
+	r.expires = time.Now().Add(idempotencyTTL)
+	if r.err != nil {
+		c.remove(r)
+	}
+	close(r.done)
+	c.mu.Unlock()
+
+	return r.count, r.err
+}
+
+// add stores r, evicting the oldest done results if the cache is full.
+// Results in flight are never evicted, as their retries would count
+// them again, so the cache can be over full while they are.
+// c.mu must be held.
+func (c *idempotencyCache) add(r *idempotentResult) {
+	for n := len(c.order); n > 0 && len(c.results) >= idempotencyMaxKeys; n-- {
+		old := c.order[0]
+		c.order = c.order[1:]
+		if old.inFlight() && c.results[old.key] == old {
+			c.order = append(c.order, old) // kept as if it were the newest
+			continue
+		}
+		c.remove(old)
+	}
+
+	c.results[r.key] = r
+	c.order = append(c.order, r)
+}
+
+// remove forgets r, unless it has been replaced. c.mu must be held.
+func (c *idempotencyCache) remove(r *idempotentResult) {
+	if c.results[r.key] == r {
+		delete(c.results, r.key)
+	}
+}
+
+func (c *idempotencyCache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// results are added in about the order they expire in.
+	for len(c.order) > 0 && c.order[0].expired(now) {
+		c.remove(c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// inFlight reports whether r is not done yet. c.mu must be held.
+func (r *idempotentResult) inFlight() bool {
+	return r.expires.IsZero()
+}
+
+// expired reports whether r is done and expired. c.mu must be held.
+func (r *idempotentResult) expired(now time.Time) bool {
+	return !r.expires.IsZero() && now.After(r.expires)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newIdempotencyCache(ctx)
+
+	// a request with another key is not held up by one in flight.
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls int
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count := c.do("a", func() uint64 {
+				calls++
+				close(started)
+				<-release
+				return 7
+			})
+			if count != 7 {
+				t.Errorf("expected 7, got %d", count)
+			}
+		}()
+	}
+
+	<-started
+	if count := c.do("b", func() uint64 { return 1 }); count != 1 {
+		t.Fatalf("expected 1, got %d", count)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("expected one call, got %d", calls)
+	}
+
+	// a failed request is tried again.
+	if _, err := c.try("c", func() (uint64, error) { return 0, errors.New("refused") }); err == nil {
+		t.Fatal("expected error")
+	}
+	if count, err := c.try("c", func() (uint64, error) { return 3, nil }); err != nil || count != 3 {
+		t.Fatalf("expected 3, got %d %v", count, err)
+	}
+
+	// the oldest keys are evicted when full.
+	for i := 0; i < idempotencyMaxKeys; i++ {
+		c.do(strconv.Itoa(i), func() uint64 { return 0 })
+	}
+	if len(c.results) != idempotencyMaxKeys {
+		t.Fatalf("expected %d keys, have %d", idempotencyMaxKeys, len(c.results))
+	}
+	if _, ok := c.results["a"]; ok {
+		t.Fatal("expected oldest key to be evicted")
+	}
+	if _, ok := c.results[strconv.Itoa(idempotencyMaxKeys-1)]; !ok {
+		t.Fatal("expected newest key to be kept")
+	}
+
+	// a request in flight is not evicted, so its retry waits for it.
+	started, release = make(chan struct{}), make(chan struct{})
+	go c.do("in-flight", func() uint64 {
+		close(started)
+		<-release
+		return 9
+	})
+	<-started
+	for i := 0; i < idempotencyMaxKeys; i++ {
+		c.do("new"+strconv.Itoa(i), func() uint64 { return 0 })
+	}
+	retried := make(chan uint64)
+	go func() { retried <- c.do("in-flight", func() uint64 { return 10 }) }()
+	close(release)
+	if count := <-retried; count != 9 {
+		t.Fatalf("expected retry to get the result in flight, got %d", count)
+	}
+
+	c.expire(time.Now().Add(idempotencyTTL + time.Second))
+	if len(c.results) != 0 || len(c.order) != 0 {
+		t.Fatalf("expected all keys to expire, have %d", len(c.results))
+	}
+}
@@ -2,21 +2,103 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/health"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
+	"github.com/pkg/errors"
 )
 
 func main() {
+	healthcheck := flag.Bool("healthcheck", false, "probe /readyz of the server running on LISTEN_ADDR and exit")
+	verifyAudit := flag.String("verify-audit", "", "verify the hash chain of the audit log `file` and exit")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], allSettings...)
+	if err != nil {
+		if cfg != nil {
+			// report the problems with ranges and files along with those of kinds.
+			if _, srvErr := serverConfigFrom(cfg.Get); srvErr != nil {
+				err = config.Errors{err, srvErr}
+			}
+		}
+		logging.Error("invalid config", logging.Err(err))
+		os.Exit(2)
+	}
+
+	if cfg.Print {
+		if err := cfg.Write(os.Stdout); err != nil {
+			logging.Error("error printing config", logging.Err(err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := logging.SetupFrom("cluster", cfg.Get); err != nil {
+		logging.Error("invalid logging config", logging.Err(err))
+		os.Exit(2)
+	}
+
+	if *verifyAudit != "" {
+		st := db.VerifyAuditLog(*verifyAudit)
+		if !st.OK {
+			logging.Error("audit log verification failed", logging.F("file", *verifyAudit),
+				logging.F("seq", st.BadSeq), logging.F("reason", st.Error))
+			os.Exit(1)
+		}
+		logging.Info("audit log verified", logging.F("file", *verifyAudit),
+			logging.F("entries", st.Entries), logging.F("head", st.Head))
+		return
+	}
+
+	if *healthcheck {
+		if err := health.Probe(cfg.Get("LISTEN_ADDR"), "/readyz", cfg.Get("TLS_CERT") != ""); err != nil {
+			logging.Error("unhealthy", logging.Err(err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	srvCfg, err := serverConfigFrom(cfg.Get)
+	if err != nil {
+		logging.Error("invalid config", logging.Err(err))
+		os.Exit(2)
+	}
+
+	if err := run(srvCfg, cfg); err != nil {
+		logging.Error("server error", logging.Err(err))
+		os.Exit(1)
+	}
+}
+
+// run serves with srvCfg until interrupted, reloading cfg on changes.
+func run(srvCfg serverConfig, cfg *config.Config) error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	stopTracing, err := tracing.SetupFrom("cluster", cfg.Get)
+	if err != nil {
+		return errors.WithMessage(err, "setting up tracing")
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), srvCfg.ShutdownTimeout)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			logging.Error("error stopping tracing", logging.Err(err))
+		}
+	}()
+
 	var s Server
-	s.Init(ctx, os.Getenv("LISTEN_ADDR"), os.Getenv("DB_FILE"))
+	if err := s.Init(ctx, srvCfg); err != nil {
+		return errors.WithMessage(err, "starting server")
+	}
 	defer s.Close()
 
-	if err := s.Run(); err != nil {
-		log.Println("server error:", err)
-	}
+	go cfg.ReloadOnChange(ctx, s.applyConfig, logging.ConfigReload)
+
+	return s.Run()
 }
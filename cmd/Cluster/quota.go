@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/pkg/errors"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaHandler serves the usage of the quota in the path, /quota/{id}.
+// A POST atomically takes the amount in the n query parameter, default 1,
+// from the quota, unless it has too little left, in which case
+// nothing is taken and it responds with 429. Either way the usage is
+// returned as JSON and in X-Quota-* headers.
+func (s *Server) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/quota/")
+
+	var u quota.Usage
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		u, err = s.quotas.Usage(id)
+
+	case http.MethodPost:
+		n := uint64(1)
+		if v := r.URL.Query().Get("n"); v != "" {
+			if n, err = strconv.ParseUint(v, 10, 64); err != nil || n == 0 {
+				requestid.Error(w, r, "n must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		u, err = s.quotas.Take(id, n)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		requestid.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err == quota.ErrNotFound {
+		requestid.Error(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	quota.SetHeaders(w.Header(), u)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost && !u.Allowed {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	if err := json.NewEncoder(w).Encode(u); err != nil {
+		logging.Ctx(r.Context()).Warn("error sending response", logging.Err(err))
+	}
+}
+
+// incrementQuota counts an increment of delta with add, unless idempotencyKey
+// was recently seen, and returns the new count. If quota id is defined, delta
+// is taken from it as the increment is counted, and not again for repeated
+// requests, and the request is refused with 429 once it is exhausted.
+// The quota's usage is set in the X-Quota-* headers of w.
+// It responds with an error itself and returns false if not counted.
+func (s *Server) incrementQuota(w http.ResponseWriter, r *http.Request, id string, delta uint64, idempotencyKey string, add func() (uint64, error)) (uint64, bool) {
+	enforced := id != "" && s.quotas != nil
+
+	var usage *quota.Usage
+	take := func() (uint64, error) {
+		if enforced {
+			u, err := s.quotas.Take(id, delta)
+			switch {
+			case err == quota.ErrNotFound:
+				// not defined, so not enforced.
+			case err != nil:
+				return 0, err
+			default:
+				usage = &u
+				if !u.Allowed {
+					return 0, errQuotaExceeded
+				}
+			}
+		}
+		return add()
+	}
+
+	var count uint64
+	var err error
+	if idempotencyKey == "" || s.idem == nil {
+		count, err = take()
+	} else {
+		count, err = s.idem.try(idempotencyKey, take)
+	}
+
+	if usage == nil && enforced {
+		// a repeated request that was already counted.
+		if u, err := s.quotas.Usage(id); err == nil {
+			usage = &u
+		}
+	}
+	if usage != nil {
+		quota.SetHeaders(w.Header(), *usage)
+	}
+
+	switch {
+	case err == errQuotaExceeded:
+		requestid.Error(w, r, err.Error(), http.StatusTooManyRequests)
+		return 0, false
+	case err != nil:
+		requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return count, true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+)
+
+func TestQuotaHandler(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	defer os.Remove("test.test")
+
+	s := Server{db: db.NewDB("test.test")}
+	defer s.db.Close()
+
+	var err error
+	if s.quotas, err = quota.New(s.db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.quotas.Put(quota.Quota{ID: "acme", Counter: "acme", Limit: 2, Window: quota.Duration(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.quotaHandler(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if w := do(http.MethodPost, "/quota/acme?n=2"); w.Code != http.StatusOK || w.Header().Get(quota.RemainingHeader) != "0" {
+		t.Fatalf("expected quota to be taken, got %d remaining %q", w.Code, w.Header().Get(quota.RemainingHeader))
+	}
+
+	w := do(http.MethodPost, "/quota/acme")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get(quota.LimitHeader) != "2" {
+		t.Fatalf("expected exhausted quota to be refused, got %d %v", w.Code, w.Header())
+	}
+
+	if w := do(http.MethodGet, "/quota/acme"); w.Code != http.StatusOK {
+		t.Fatalf("expected usage, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/quota/other"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown quota, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/quota/acme?n=0"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid n, got %d", w.Code)
+	}
+}
+
+func TestQuotaIncrement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+
+	s := Server{ctx: ctx, db: db.NewDB("test.test"), idem: newIdempotencyCache(ctx)}
+	defer s.db.Close()
+
+	var err error
+	if s.quotas, err = quota.New(s.db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.quotas.Put(quota.Quota{ID: "acme", Counter: "acme", Limit: 1, Window: quota.Duration(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(id, idempotencyKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(quota.Header, id)
+		r.Header.Set("Idempotency-Key", idempotencyKey)
+		w := httptest.NewRecorder()
+		s.requestHandler(w, r)
+		return w
+	}
+
+	if w := do("acme", "a"); w.Code != http.StatusOK || w.Header().Get(quota.RemainingHeader) != "0" {
+		t.Fatalf("expected increment within quota, got %d %v", w.Code, w.Header())
+	}
+	// a retry is neither counted nor taken from the quota again.
+	if w := do("acme", "a"); w.Code != http.StatusOK || s.db.Count() != 1 {
+		t.Fatalf("expected retry to get the same answer, got %d with count %d", w.Code, s.db.Count())
+	}
+
+	w := do("acme", "b")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || s.db.Count() != 1 {
+		t.Fatalf("expected exhausted quota not to count, got %d with count %d", w.Code, s.db.Count())
+	}
+
+	if w := do("undefined", "c"); w.Code != http.StatusOK || s.db.Count() != 2 {
+		t.Fatalf("expected undefined quota not to be enforced, got %d with count %d", w.Code, s.db.Count())
+	}
+}
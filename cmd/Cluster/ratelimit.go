@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/ratelimit"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+)
+
+const maxRateLimitBody = 1 << 20
+
+// rateLimitHandler adds the counts per client of a RequestCounter instance's
+// rate limit window to those of all instances, and returns their totals.
+func (s *Server) rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		requestid.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var wc ratelimit.WindowCounts
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRateLimitBody)).Decode(&wc); err != nil {
+		requestid.Error(w, r, "invalid window counts: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	totals, err := s.windows.Add(wc)
+	if err != nil {
+		requestid.Error(w, r, "invalid window counts: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(totals); err != nil {
+		logging.Ctx(r.Context()).Warn("error sending response", logging.Err(err))
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/admin"
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/resp"
+)
+
+// respHandler serves db counters to Redis clients.
+// The count served over http is the counter named db.DefaultCounter.
+// Clients can increment and read counters, but must AUTH with one of
+// ADMIN_TOKENS to set or delete them, or to increment counters
+// not allowed by the server's clientCounters.
+type respHandler struct {
+	s *Server
+}
+
+func newRESPServer(s *Server) *resp.Server {
+	return resp.NewServer(respHandler{s})
+}
+
+// changeCtx is the context of changes made by the client of w,
+// recorded in the audit log as made by who it authenticated as, from its address.
+func (h respHandler) changeCtx(w *resp.Writer) context.Context {
+	who := "resp:" + w.User()
+	if addr := w.RemoteAddr(); addr != nil {
+		who += "@" + addr.String()
+	}
+	return db.WithWho(context.Background(), who)
+}
+
+func (h respHandler) ServeRESP(w *resp.Writer, args []string) {
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+
+	arity, ok := respArity[cmd]
+	if !ok {
+		w.WriteError(fmt.Sprintf("ERR unknown command '%s'", cmd))
+		return
+	}
+	if len(args) < arity.min || (arity.max >= 0 && len(args) > arity.max) {
+		w.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+		return
+	}
+
+	if respAdminCommands[cmd] && w.User() == "" {
+		w.WriteError("NOAUTH Authentication required.")
+		return
+	}
+
+	db := h.s.db
+	switch cmd {
+	case "AUTH":
+		if len(h.s.respTokens) == 0 {
+			w.WriteError("ERR AUTH is not enabled, set ADMIN_TOKENS")
+			return
+		}
+
+		// AUTH token, or AUTH name token.
+		who, ok := admin.CheckToken(h.s.respTokens, args[len(args)-1])
+		if !ok || (len(args) == 2 && args[0] != who) {
+			w.WriteError("WRONGPASS invalid username-password pair")
+			return
+		}
+		w.SetUser(who)
+		w.WriteSimple("OK")
+
+	case "PING":
+		if len(args) == 1 {
+			w.WriteBulk(args[0])
+		} else {
+			w.WriteSimple("PONG")
+		}
+
+	case "INCR", "INCRBY":
+		delta := int64(1)
+		if cmd == "INCRBY" {
+			var err error
+			if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				w.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			if delta < 0 {
+				w.WriteError("ERR counters can only be incremented")
+				return
+			}
+			if delta == 0 {
+				w.WriteError("ERR " + errZeroDelta.Error())
+				return
+			}
+		}
+
+		if w.User() == "" {
+			if err := h.s.checkClientCounter(args[0]); err != nil {
+				w.WriteError("ERR " + err.Error())
+				return
+			}
+		}
+
+		v, err := db.Add(args[0], uint64(delta))
+		if err != nil {
+			w.WriteError("ERR " + err.Error())
+			return
+		}
+		w.WriteInt(int64(v))
+
+	case "GET":
+		if v, ok := db.Get(args[0]); ok {
+			w.WriteBulk(strconv.FormatUint(v, 10))
+		} else {
+			w.WriteNil()
+		}
+
+	case "SET":
+		if len(args) != 2 {
+			w.WriteError("ERR syntax error")
+			return
+		}
+
+		v, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			w.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+
+		if err := db.Set(h.changeCtx(w), args[0], v); err != nil {
+			w.WriteError("ERR " + err.Error())
+			return
+		}
+		w.WriteSimple("OK")
+
+	case "DEL":
+		deleted := int64(0)
+		ctx := h.changeCtx(w)
+		for _, name := range args {
+			if db.Delete(ctx, name) {
+				deleted++
+			}
+		}
+		w.WriteInt(deleted)
+
+	case "KEYS":
+		re, err := globRegexp(args[0])
+		if err != nil {
+			w.WriteError("ERR invalid pattern")
+			return
+		}
+
+		var names []string
+		for _, name := range db.Names() {
+			if re.MatchString(name) {
+				names = append(names, name)
+			}
+		}
+
+		w.WriteArrayLen(len(names))
+		for _, name := range names {
+			w.WriteBulk(name)
+		}
+
+	case "INFO":
+		w.WriteBulk(fmt.Sprintf(
+			"# Server\r\nredis_version:6.0.0\r\nserver_name:requestcounter-cluster\r\n\r\n# Keyspace\r\ndb0:keys=%d,expires=0\r\n",
+			len(db.Names()),
+		))
+
+	case "SELECT":
+		if args[0] != "0" {
+			w.WriteError("ERR DB index is out of range")
+			return
+		}
+		w.WriteSimple("OK")
+
+	case "COMMAND":
+		w.WriteArrayLen(0)
+
+	case "CLIENT":
+		w.WriteSimple("OK")
+
+	case "HELLO":
+		// only RESP2 is supported, clients fall back to it on error.
+		w.WriteError("NOPROTO unsupported protocol version")
+	}
+}
+
+// respArity is the number of arguments supported commands take.
+// A max of -1 means no limit.
+var respArity = map[string]struct{ min, max int }{
+	"AUTH":    {1, 2},
+	"PING":    {0, 1},
+	"INCR":    {1, 1},
+	"INCRBY":  {2, 2},
+	"GET":     {1, 1},
+	"SET":     {2, -1},
+	"DEL":     {1, -1},
+	"KEYS":    {1, 1},
+	"INFO":    {0, -1},
+	"SELECT":  {1, 1},
+	"COMMAND": {0, -1},
+	"CLIENT":  {1, -1},
+	"HELLO":   {0, -1},
+}
+
+// respAdminCommands can only be used by authenticated clients.
+var respAdminCommands = map[string]bool{
+	"SET": true,
+	"DEL": true,
+}
+
+// globRegexp converts a Redis glob pattern, supporting *, ?, [...] and \ escapes, to a regexp.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			b.WriteByte('[')
+			if strings.HasPrefix(class, "^") {
+				b.WriteByte('^')
+				class = class[1:]
+			}
+			b.WriteString(strings.NewReplacer(`\`, `\\`, `[`, `\[`).Replace(class))
+			b.WriteByte(']')
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/resp"
+)
+
+func TestRESP(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+
+	s := Server{
+		ctx:            context.Background(),
+		db:             db.NewDB("test.test"),
+		respTokens:     map[string]string{"ops": "secret"},
+		clientCounters: parseClientCounters("a", 10),
+	}
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+	defer s.db.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := newRESPServer(&s)
+	go rs.Serve(ln)
+	defer rs.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, w := resp.NewReader(c), resp.NewWriter(c)
+
+	tests := []struct {
+		cmd []string
+		exp interface{}
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"INCR", "a"}, int64(1)},
+		{[]string{"INCRBY", "a", "9"}, int64(10)},
+		{[]string{"INCRBY", "a", "-1"}, resp.Error("ERR counters can only be incremented")},
+		{[]string{"INCR", "c"}, resp.Error("ERR counter does not exist")},
+		{[]string{"INCR", "a@24h0m0s@2023-01-02T00:00:00Z"}, resp.Error("ERR counter of a quota window")},
+		{[]string{"GET", "a"}, "10"},
+		{[]string{"GET", "missing"}, nil},
+		{[]string{"SET", "b", "42"}, resp.Error("NOAUTH Authentication required.")},
+		{[]string{"DEL", "a"}, resp.Error("NOAUTH Authentication required.")},
+		{[]string{"AUTH", "guess"}, resp.Error("WRONGPASS invalid username-password pair")},
+		{[]string{"AUTH", "other", "secret"}, resp.Error("WRONGPASS invalid username-password pair")},
+		{[]string{"AUTH", "ops", "secret"}, "OK"},
+		{[]string{"SET", "b", "42"}, "OK"},
+		{[]string{"SET", "b", "x"}, resp.Error("ERR value is not an integer or out of range")},
+		{[]string{"INCR", "c"}, int64(1)},
+		{[]string{"DEL", "c"}, int64(1)},
+		{[]string{"incr", db.DefaultCounter}, int64(1)},
+		{[]string{"KEYS", "*"}, []interface{}{"a", "b", db.DefaultCounter}},
+		{[]string{"KEYS", "[ab]"}, []interface{}{"a", "b"}},
+		{[]string{"DEL", "a", "missing"}, int64(1)},
+		{[]string{"GET", "a"}, nil},
+		{[]string{"NOPE"}, resp.Error("ERR unknown command 'NOPE'")},
+		{[]string{"GET"}, resp.Error("ERR wrong number of arguments for 'get' command")},
+	}
+
+	// pipeline all commands, then read all replies.
+	for _, tt := range tests {
+		w.WriteCommand(tt.cmd...)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		v, err := r.ReadValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(v, tt.exp) {
+			t.Fatalf("%v: expected %#v, got %#v", tt.cmd, tt.exp, v)
+		}
+	}
+
+	if s.db.Count() != 1 {
+		t.Fatalf("expected count 1, got %d", s.db.Count())
+	}
+}
@@ -2,30 +2,200 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"log"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"github.com/RoanBrand/RequestCounter/internal/admin"
+	"github.com/RoanBrand/RequestCounter/internal/certs"
 	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/RoanBrand/RequestCounter/internal/ratelimit"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/resp"
+	"github.com/RoanBrand/RequestCounter/internal/rules"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tcpproto"
+	"github.com/RoanBrand/RequestCounter/internal/tenant"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
 )
 
 type Server struct {
-	ctx context.Context
-	s   http.Server
-	db  *db.DB
+	ctx  context.Context
+	s    http.Server
+	db   *db.DB
+	idem *idempotencyCache
+
+	grpcAddr string
+	grpc     *grpc.Server
+
+	tcpAddr string
+	tcp     *tcpproto.Server
+
+	respAddr string
+	resp     *resp.Server
+	// respTokens are accepted by the RESP AUTH command, by name.
+	// Only authenticated RESP clients can set or delete counters.
+	respTokens map[string]string
+
+	statsdAddr string
+	statsd     *statsdServer
+
+	// clientCounters limits the counters StatsD and unauthenticated RESP clients can change.
+	clientCounters clientCounters
+
+	// admin serves debugging endpoints and the admin API, if enabled.
+	admin *http.Server
+
+	// metrics of this server, served with the package level ones.
+	metrics *metrics.Registry
+
+	// tls serves the http, gRPC, TCP and RESP listeners over TLS, if set.
+	// If it verifies client certificates, they are required, and the
+	// StatsD listener is disabled as UDP can't require them.
+	tls *certs.Server
+
+	// signing requires http and gRPC requests to be signed, if set.
+	// The TCP, RESP and StatsD listeners are then disabled unless
+	// client certificates are required instead.
+	signing *signing.Verifier
+
+	// minimum time between updates sent to watchers, reloadable.
+	watchInterval time.Duration
+
+	rules *rules.Engine
+
+	// windows counts requests per client of RequestCounter's cluster-wide rate limits.
+	windows *ratelimit.Windows
+
+	quotas *quota.Manager
+
+	// tenants have their own namespace of counters.
+	tenants *tenant.Registry
+
+	// time Close waits for in-flight requests to finish.
+	shutdownTimeout time.Duration
 }
 
-func (s *Server) Init(ctx context.Context, listenAddr, dbFilePath string) {
+func (s *Server) Init(ctx context.Context, cfg serverConfig) error {
 	s.ctx = ctx
-	s.db = db.NewDB(dbFilePath)
+	s.tls = cfg.TLS
+	s.signing = cfg.Signing
+	s.watchInterval = cfg.WatchInterval
+	s.shutdownTimeout = cfg.ShutdownTimeout
+	s.clientCounters = cfg.ClientCounters
+	s.db = db.NewDB(cfg.DBFile)
+	if err := s.db.EnableAudit(); err != nil {
+		return err
+	}
+	s.idem = newIdempotencyCache(ctx)
+	s.windows = ratelimit.NewWindows()
+
+	if cfg.RulesFile != "" {
+		engine, err := rules.New(s.db, cfg.RulesFile, cfg.DBFile+".webhooks")
+		if err != nil {
+			return err
+		}
+		s.rules = engine
+		go s.rules.Run(ctx)
+	}
+
+	quotas, err := quota.New(s.db, cfg.QuotasFile)
+	if err != nil {
+		return err
+	}
+	s.quotas = quotas
+	go s.quotas.Run(ctx)
+
+	if s.tenants, err = tenant.New(cfg.TenantsFile); err != nil {
+		return err
+	}
+
+	if cfg.GRPCAddr != "" {
+		s.grpcAddr = cfg.GRPCAddr
+		s.grpc = newGRPCServer(s)
+	}
+
+	if s.signing != nil && (s.tls == nil || !s.tls.VerifiesClients()) {
+		// their requests can not be signed, so only serve them to clients with certificates.
+		disable := func(name string, addr *string) {
+			if *addr != "" {
+				logging.Warn(name + " listener disabled, signing requires client certificates for it")
+				*addr = ""
+			}
+		}
+		disable("tcp", &cfg.TCPAddr)
+		disable("resp", &cfg.RESPAddr)
+		disable("statsd", &cfg.StatsDAddr)
+	}
+
+	if cfg.TCPAddr != "" {
+		s.tcpAddr = cfg.TCPAddr
+		s.tcp = newTCPServer(s)
+	}
+
+	if cfg.RESPAddr != "" {
+		s.respAddr = cfg.RESPAddr
+		s.respTokens = cfg.Admin.Tokens
+		s.resp = newRESPServer(s)
+	}
+
+	if cfg.StatsDAddr != "" && s.tls != nil && s.tls.VerifiesClients() {
+		// UDP has no TLS, so its clients can't be required to have certificates.
+		logging.Warn("statsd listener disabled, client certificates can't be verified over UDP")
+		cfg.StatsDAddr = ""
+	}
+
+	if cfg.StatsDAddr != "" {
+		s.statsdAddr = cfg.StatsDAddr
+		s.statsd = newStatsDServer(s)
+	}
+
+	if cfg.Admin.Addr != "" {
+		s.admin, err = admin.NewServer(cfg.Admin, &adminAPI{s: s})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.watchInterval == 0 {
+		s.watchInterval = defaultWatchInterval
+	}
+	if s.shutdownTimeout == 0 {
+		s.shutdownTimeout = defaultShutdownTimeout
+	}
+
+	s.metrics = metrics.NewRegistry()
+	s.metrics.NewGaugeVecFunc("counter_value", "Current value of each counter.", "counter", s.counterValues)
+	s.metrics.NewGaugeVecFunc("tenant_requests", "Current count of each tenant.", "tenant", s.tenantCounts)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.requestHandler)
-	s.s.Handler = mux
+	mux.Handle("/", metrics.InstrumentHandler("count", tracing.Handler("count", logging.AccessLog(true, s.verified(http.HandlerFunc(s.requestHandler))))))
+	mux.Handle("/watch", metrics.InstrumentHandler("watch", logging.AccessLog(false, s.verified(http.HandlerFunc(s.watchHandler)))))
+	mux.Handle(ratelimit.SyncPath, metrics.InstrumentHandler("ratelimit", s.verified(http.HandlerFunc(s.rateLimitHandler))))
+	mux.Handle("/quota/", metrics.InstrumentHandler("quota", logging.AccessLog(false, s.verified(http.HandlerFunc(s.quotaHandler)))))
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.Handle("/metrics", metrics.Handler(s.metrics))
+	var h http.Handler = mux
+	if s.tls != nil {
+		s.s.TLSConfig = s.tls.Config(tls.VerifyClientCertIfGiven)
+		if s.tls.VerifiesClients() {
+			h = requireClientCert(h)
+		}
+	}
+	s.s.Handler = requestid.Handler(h)
 
-	s.s.Addr = listenAddr
+	s.s.Addr = cfg.ListenAddr
 
 	s.s.BaseContext = func(_ net.Listener) context.Context {
 		return s.ctx
@@ -33,15 +203,97 @@ func (s *Server) Init(ctx context.Context, listenAddr, dbFilePath string) {
 
 	go func(s *Server) {
 		<-s.ctx.Done()
-		log.Println("stopping server")
+		logging.Info("stopping server")
 		if err := s.Close(); err != nil {
-			log.Println("error stopping server:", err)
+			logging.Error("error stopping server", logging.Err(err))
 		}
 	}(s)
+
+	return nil
 }
 
 func (s *Server) Run() error {
-	err := s.s.ListenAndServe()
+	if s.admin != nil {
+		lis, err := admin.Listen(s.admin)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.admin.Serve(lis); err != nil && err != http.ErrServerClosed {
+				logging.Error("admin server error", logging.Err(err))
+			}
+		}()
+	}
+
+	if s.grpc != nil {
+		lis, err := net.Listen("tcp", s.grpcAddr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		go func() {
+			if err := s.grpc.Serve(lis); err != nil {
+				logging.Error("grpc server error", logging.Err(err))
+			}
+		}()
+	}
+
+	if s.tcp != nil {
+		lis, err := net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if s.tls != nil {
+			lis = tls.NewListener(lis, s.tls.Config(tls.RequireAndVerifyClientCert))
+		}
+
+		go func() {
+			if err := s.tcp.Serve(lis); err != nil {
+				logging.Error("tcp server error", logging.Err(err))
+			}
+		}()
+	}
+
+	if s.resp != nil {
+		lis, err := net.Listen("tcp", s.respAddr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if s.tls != nil {
+			clientAuth := tls.NoClientCert
+			if s.tls.VerifiesClients() {
+				clientAuth = tls.RequireAndVerifyClientCert
+			}
+			lis = tls.NewListener(lis, s.tls.Config(clientAuth))
+		}
+
+		go func() {
+			if err := s.resp.Serve(lis); err != nil {
+				logging.Error("resp server error", logging.Err(err))
+			}
+		}()
+	}
+
+	if s.statsd != nil {
+		pc, err := net.ListenPacket("udp", s.statsdAddr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		go func() {
+			if err := s.statsd.Serve(pc); err != nil {
+				logging.Error("statsd server error", logging.Err(err))
+			}
+		}()
+	}
+
+	var err error
+	if s.tls != nil {
+		err = s.s.ListenAndServeTLS("", "")
+	} else {
+		err = s.s.ListenAndServe()
+	}
 	if err == http.ErrServerClosed {
 		return nil
 	}
@@ -49,10 +301,47 @@ func (s *Server) Run() error {
 	return err
 }
 
+// minWatchInterval returns the minimum time between updates sent to watchers.
+func (s *Server) minWatchInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&s.watchInterval)))
+}
+
+func (s *Server) setWatchInterval(d time.Duration) {
+	atomic.StoreInt64((*int64)(&s.watchInterval), int64(d))
+}
+
 func (s *Server) Close() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
 	defer cancel()
 
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil {
+			logging.Error("error stopping admin server", logging.Err(err))
+		}
+	}
+
+	if s.grpc != nil {
+		stopGRPC(ctx, s.grpc)
+	}
+
+	if s.tcp != nil {
+		if err := s.tcp.Close(); err != nil {
+			logging.Error("error stopping tcp server", logging.Err(err))
+		}
+	}
+
+	if s.resp != nil {
+		if err := s.resp.Close(); err != nil {
+			logging.Error("error stopping resp server", logging.Err(err))
+		}
+	}
+
+	if s.statsd != nil {
+		if err := s.statsd.Close(); err != nil {
+			logging.Error("error stopping statsd server", logging.Err(err))
+		}
+	}
+
 	err := s.s.Shutdown(ctx)
 	if err != nil {
 		if err == http.ErrServerClosed {
@@ -65,13 +354,109 @@ func (s *Server) Close() error {
 	return s.db.Close()
 }
 
+// requireClientCert only serves requests with a verified client certificate,
+// other than health checks, so that orchestrators can probe them without one.
+func requireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		client, ok := certs.VerifiedClient(r.TLS)
+		if !ok {
+			requestid.Error(w, r, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		ctx := logging.ContextWith(r.Context(), logging.F("client", client))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// verified serves requests with h only if they are signed, when signing is enabled.
+func (s *Server) verified(h http.Handler) http.Handler {
+	if s.signing == nil {
+		return h
+	}
+	return s.signing.Handler(h)
+}
+
+// errZeroDelta is returned by every transport for an increment of 0,
+// so that they agree on what it means.
+var errZeroDelta = tcpproto.ErrZeroDelta
+
+// requestHandler increments the count by one, or by the 8 byte
+// little endian delta in the body of a POST request,
+// and returns the new count. Requests with an Idempotency-Key header
+// already seen recently are not counted again and get the same count.
+// Requests of a tenant increment its count instead, see incrementTenant.
+// Requests with an X-Quota header are taken from that quota, see incrementQuota.
 func (s *Server) requestHandler(w http.ResponseWriter, r *http.Request) {
-	newCount := s.db.IncCount()
+	t, ok := s.resolveTenant(w, r)
+	if !ok {
+		return
+	}
+
+	delta := uint64(1)
+	if r.Method == http.MethodPost {
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, 9))
+		if err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(b) != 8 {
+			requestid.Error(w, r, "delta must be 8 bytes", http.StatusBadRequest)
+			return
+		}
+
+		delta = binary.LittleEndian.Uint64(b)
+		if delta == 0 {
+			requestid.Error(w, r, errZeroDelta.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var newCount uint64
+	if t != nil {
+		if newCount, ok = s.incrementTenant(w, r, t, delta); !ok {
+			return
+		}
+	} else if id := r.Header.Get(quota.Header); id != "" {
+		add := func() (uint64, error) { return s.db.AddCount(delta), nil }
+		if newCount, ok = s.incrementQuota(w, r, id, delta, r.Header.Get("Idempotency-Key"), add); !ok {
+			return
+		}
+	} else {
+		newCount = s.increment(delta, r.Header.Get("Idempotency-Key"))
+	}
 	resp := make([]byte, 8)
 	binary.LittleEndian.PutUint64(resp, newCount)
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	if _, err := w.Write(resp); err != nil {
-		log.Println("error", err)
+		logging.Ctx(r.Context()).Warn("error sending response", logging.Err(err))
+	}
+}
+
+// increment adds delta to the count, unless idempotencyKey
+// was recently seen, and returns the new count.
+func (s *Server) increment(delta uint64, idempotencyKey string) uint64 {
+	if idempotencyKey == "" || s.idem == nil {
+		return s.db.AddCount(delta)
+	}
+
+	return s.idem.do(idempotencyKey, func() uint64 { return s.db.AddCount(delta) })
+}
+
+// counterValues returns the value of every counter, for metrics.
+func (s *Server) counterValues() map[string]float64 {
+	names := s.db.Names()
+	values := make(map[string]float64, len(names))
+	for _, name := range names {
+		if v, ok := s.db.Get(name); ok {
+			values[name] = float64(v)
+		}
 	}
+	return values
 }
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/RoanBrand/RequestCounter/api/clusterpb"
 	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/resp"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tcpproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func TestRequestHandler(t *testing.T) {
@@ -100,3 +110,268 @@ func TestRequestHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestHandlerDelta(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+
+	s := Server{
+		ctx: context.Background(),
+		db:  db.NewDB("test.test"),
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+
+	for i, delta := range []uint64{5, 10, 1} {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, delta)
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		s.requestHandler(w, req)
+		res := w.Result()
+
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data) != 8 {
+			t.Fatalf("not 8 bytes. Is: %d", len(data))
+		}
+
+		if got, exp := binary.LittleEndian.Uint64(data), []uint64{5, 15, 16}[i]; got != exp {
+			t.Fatalf("expected %d, got %d", exp, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte{1, 2}))
+	w := httptest.NewRecorder()
+	s.requestHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// TestDeltaTransports checks that every transport gives the same result for the same delta.
+func TestDeltaTransports(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+
+	s := Server{
+		ctx: ctx,
+		db:  db.NewDB("test.test"),
+	}
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+	defer s.db.Close()
+
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ln
+	}
+
+	hs := httptest.NewServer(http.HandlerFunc(s.requestHandler))
+	defer hs.Close()
+
+	gln := listen()
+	g := newGRPCServer(&s)
+	go g.Serve(gln)
+	defer g.Stop()
+	cc, err := grpc.Dial(gln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	gc := clusterpb.NewClusterClient(cc)
+
+	tln := listen()
+	ts := newTCPServer(&s)
+	go ts.Serve(tln)
+	defer ts.Close()
+	tc := tcpproto.NewClient(tln.Addr().String(), 1, time.Second, nil)
+	defer tc.Close()
+
+	rln := listen()
+	rs := newRESPServer(&s)
+	go rs.Serve(rln)
+	defer rs.Close()
+	rc, err := net.Dial("tcp", rln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	rr, rw := resp.NewReader(rc), resp.NewWriter(rc)
+
+	transports := map[string]func(delta uint64) (uint64, error){
+		"http": func(delta uint64) (uint64, error) {
+			b := make([]byte, 8)
+			binary.LittleEndian.PutUint64(b, delta)
+			res, err := http.Post(hs.URL, "application/octet-stream", bytes.NewReader(b))
+			if err != nil {
+				return 0, err
+			}
+			defer res.Body.Close()
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != http.StatusOK {
+				return 0, fmt.Errorf("%d: %s", res.StatusCode, body)
+			}
+			return binary.LittleEndian.Uint64(body), nil
+		},
+		"grpc": func(delta uint64) (uint64, error) {
+			n, err := gc.Increment(ctx, &clusterpb.IncrementRequest{Delta: delta})
+			if err != nil {
+				return 0, err
+			}
+			return n.Count, nil
+		},
+		"tcp": func(delta uint64) (uint64, error) {
+			return tc.Increment(ctx, delta, "")
+		},
+		"resp": func(delta uint64) (uint64, error) {
+			rw.WriteCommand("INCRBY", db.DefaultCounter, fmt.Sprint(delta))
+			if err := rw.Flush(); err != nil {
+				return 0, err
+			}
+			v, err := rr.ReadValue()
+			if err != nil {
+				return 0, err
+			}
+			if e, ok := v.(resp.Error); ok {
+				return 0, e
+			}
+			return uint64(v.(int64)), nil
+		},
+	}
+
+	for _, delta := range []uint64{0, 1, 5} {
+		for name, increment := range transports {
+			before := s.db.Count()
+			n, err := increment(delta)
+			if delta == 0 {
+				if err == nil || s.db.Count() != before {
+					t.Fatalf("%s: expected delta 0 to be refused, got %d %v", name, n, err)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%s: delta %d: %v", name, delta, err)
+			}
+			if n != before+delta {
+				t.Fatalf("%s: delta %d: expected %d, got %d", name, delta, before+delta, n)
+			}
+		}
+	}
+}
+
+func TestInitTwice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		var s Server
+		dbFile := filepath.Join(dir, strconv.Itoa(i))
+		if err := s.Init(ctx, serverConfig{ListenAddr: "127.0.0.1:0", DBFile: dbFile, RulesFile: dbFile + ".rules", QuotasFile: dbFile + ".quotas", TenantsFile: dbFile + ".tenants"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInitSigningDisablesUnsignedListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var s Server
+	dbFile := filepath.Join(t.TempDir(), "test")
+	err := s.Init(ctx, serverConfig{
+		ListenAddr: "127.0.0.1:0",
+		TCPAddr:    "127.0.0.1:0",
+		RESPAddr:   "127.0.0.1:0",
+		StatsDAddr: "127.0.0.1:0",
+		DBFile:     dbFile,
+		Signing:    signing.NewVerifier([]signing.Key{{ID: "k1", Secret: []byte("secret")}}, time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.tcp != nil || s.resp != nil || s.statsd != nil {
+		t.Fatal("expected tcp, resp and statsd listeners to be disabled without client certificates")
+	}
+}
+
+func TestRequestHandlerIdempotency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.Remove("test.test") // in case previous run failed
+
+	s := Server{
+		ctx:  ctx,
+		db:   db.NewDB("test.test"),
+		idem: newIdempotencyCache(ctx),
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+
+	for i, key := range []string{"a", "b", "a", "", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+
+		w := httptest.NewRecorder()
+		s.requestHandler(w, req)
+
+		if got, exp := binary.LittleEndian.Uint64(w.Body.Bytes()), []uint64{1, 2, 1, 3, 4}[i]; got != exp {
+			t.Fatalf("request %d: expected %d, got %d", i, exp, got)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.Remove("test.test") // in case previous run failed
+
+	s := Server{
+		ctx: ctx,
+		db:  db.NewDB("test.test"),
+	}
+	defer os.Remove("test.test")
+
+	check := func(h http.HandlerFunc, expected int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != expected {
+			t.Fatalf("expected status %d, got %d: %s", expected, w.Code, w.Body)
+		}
+	}
+
+	check(s.healthzHandler, http.StatusOK)
+	check(s.readyzHandler, http.StatusOK)
+	if s.db.Count() != 0 {
+		t.Fatal("health checks must not count requests")
+	}
+
+	cancel()
+	check(s.healthzHandler, http.StatusOK)
+	check(s.readyzHandler, http.StatusServiceUnavailable)
+
+	s.db.Close()
+	check(s.healthzHandler, http.StatusServiceUnavailable)
+}
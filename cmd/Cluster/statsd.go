@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const statsdMaxPacket = 64 * 1024
+
+var (
+	statsdPackets     = expvar.NewInt("statsd_packets")
+	statsdLines       = expvar.NewInt("statsd_lines")
+	statsdParseErrors = expvar.NewInt("statsd_parse_errors")
+	statsdDropped     = expvar.NewInt("statsd_dropped")
+	statsdRefused     = expvar.NewInt("statsd_refused")
+)
+
+// statsdServer applies StatsD counter lines, "name:N|c" with an optional
+// sample rate "|@0.1", received over UDP to the named db counters.
+// Other metric types are dropped, and counters not allowed by the
+// server's clientCounters refused.
+type statsdServer struct {
+	s *Server
+
+	mu     sync.Mutex
+	pc     net.PacketConn
+	closed bool
+}
+
+func newStatsDServer(s *Server) *statsdServer {
+	return &statsdServer{s: s}
+}
+
+// Serve reads packets from pc until Close is called.
+func (ss *statsdServer) Serve(pc net.PacketConn) error {
+	ss.mu.Lock()
+	if ss.closed {
+		ss.mu.Unlock()
+		pc.Close()
+		return nil
+	}
+	ss.pc = pc
+	ss.mu.Unlock()
+
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			ss.mu.Lock()
+			closed := ss.closed
+			ss.mu.Unlock()
+			if closed {
+				return nil
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return errors.WithStack(err)
+		}
+
+		statsdPackets.Add(1)
+		ss.handlePacket(buf[:n])
+	}
+}
+
+func (ss *statsdServer) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.closed {
+		return nil
+	}
+
+	ss.closed = true
+	if ss.pc != nil {
+		return ss.pc.Close()
+	}
+	return nil
+}
+
+func (ss *statsdServer) handlePacket(p []byte) {
+	for len(p) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line, p = p[:i], p[i+1:]
+		} else {
+			line, p = p, nil
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		statsdLines.Add(1)
+		name, delta, ok, err := parseStatsDLine(line)
+		if err != nil {
+			statsdParseErrors.Add(1)
+			continue
+		}
+		if !ok {
+			statsdDropped.Add(1)
+			continue
+		}
+
+		if err := ss.s.checkClientCounter(name); err != nil {
+			statsdRefused.Add(1)
+			continue
+		}
+		if _, err := ss.s.db.Add(name, delta); err != nil {
+			statsdDropped.Add(1)
+		}
+	}
+}
+
+// parseStatsDLine parses a line like "name:N|c|@rate".
+// ok is false for valid lines of metric types other than counters.
+func parseStatsDLine(line []byte) (name string, delta uint64, ok bool, err error) {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return "", 0, false, errors.New("missing name")
+	}
+	name = string(line[:colon])
+
+	fields := bytes.Split(line[colon+1:], []byte{'|'})
+	if len(fields) < 2 {
+		return "", 0, false, errors.New("missing type")
+	}
+
+	value, err := strconv.ParseFloat(string(fields[0]), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", 0, false, errors.New("invalid value")
+	}
+
+	if string(fields[1]) != "c" {
+		return name, 0, false, nil
+	}
+
+	rate := 1.0
+	for _, f := range fields[2:] {
+		if len(f) > 1 && f[0] == '@' {
+			rate, err = strconv.ParseFloat(string(f[1:]), 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return "", 0, false, errors.New("invalid sample rate")
+			}
+		}
+		// other fields, like "#tags", are ignored.
+	}
+
+	scaled := math.Round(value / rate)
+	if scaled <= 0 {
+		// counters can't be decremented, and a delta of 0 is refused everywhere.
+		return name, 0, false, nil
+	}
+	if scaled > math.MaxInt64 {
+		return "", 0, false, errors.New("value out of range")
+	}
+
+	return name, uint64(scaled), true, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+)
+
+func TestParseStatsDLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		name  string
+		delta uint64
+		ok    bool
+		err   bool
+	}{
+		{"hits:1|c", "hits", 1, true, false},
+		{"hits:3|c|@0.1", "hits", 30, true, false},
+		{"hits:2|c|#env:prod", "hits", 2, true, false},
+		{"hits:1.4|c", "hits", 1, true, false},
+		{"latency:320|ms", "latency", 0, false, false},
+		{"hits:-1|c", "hits", 0, false, false},
+		{"hits:0|c", "hits", 0, false, false},
+		{"hits:1", "", 0, false, true},
+		{":1|c", "", 0, false, true},
+		{"hits:x|c", "", 0, false, true},
+		{"hits:1|c|@0", "", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		name, delta, ok, err := parseStatsDLine([]byte(tt.line))
+		if (err != nil) != tt.err {
+			t.Fatalf("%q: unexpected error %v", tt.line, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if name != tt.name || delta != tt.delta || ok != tt.ok {
+			t.Fatalf("%q: expected %s %d %v, got %s %d %v", tt.line, tt.name, tt.delta, tt.ok, name, delta, ok)
+		}
+	}
+}
+
+func TestStatsDPacket(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+
+	s := Server{
+		ctx:            context.Background(),
+		db:             db.NewDB("test.test"),
+		clientCounters: parseClientCounters("a", 10),
+	}
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+	defer s.db.Close()
+
+	errs := statsdParseErrors.Value()
+	dropped := statsdDropped.Value()
+	refused := statsdRefused.Value()
+
+	ss := newStatsDServer(&s)
+	ss.handlePacket([]byte("a:1|c\na:2|c|@0.5\n\nb:1|g\nbad\nc:1|c\n" + db.DefaultCounter + ":3|c"))
+
+	if v, _ := s.db.Get("a"); v != 5 {
+		t.Fatalf("expected a to be 5, got %d", v)
+	}
+	if _, ok := s.db.Get("b"); ok {
+		t.Fatal("expected gauge to be dropped")
+	}
+	if s.db.Count() != 3 {
+		t.Fatalf("expected count 3, got %d", s.db.Count())
+	}
+
+	if statsdParseErrors.Value() != errs+1 {
+		t.Fatal("expected a parse error")
+	}
+	if statsdDropped.Value() != dropped+1 {
+		t.Fatal("expected a dropped line")
+	}
+	if _, ok := s.db.Get("c"); ok || statsdRefused.Value() != refused+1 {
+		t.Fatal("expected counter not allowed to be refused")
+	}
+}
+
+func TestClientCounters(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+
+	s := Server{
+		ctx:            context.Background(),
+		db:             db.NewDB("test.test"),
+		clientCounters: parseClientCounters("hits, api.*", 3),
+	}
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+	defer s.db.Close()
+
+	if _, err := s.db.Add("existing", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"existing", true},
+		{db.DefaultCounter, true},
+		{"hits", true},
+		{"hits2", false},
+		{"api.users", true},
+		{"other", false},
+		{"api." + strings.Repeat("x", maxClientCounterName), false},
+		{"acme@24h0m0s@2023-01-02T00:00:00Z", false},
+	}
+	for _, tt := range tests {
+		if err := s.checkClientCounter(tt.name); (err == nil) != tt.ok {
+			t.Fatalf("%.20s: expected allowed %v, got %v", tt.name, tt.ok, err)
+		}
+	}
+
+	// existing window counters are refused too
+	if _, err := s.db.Add("acme@24h0m0s@2023-01-02T00:00:00Z", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkClientCounter("acme@24h0m0s@2023-01-02T00:00:00Z"); err == nil {
+		t.Fatal("expected window counter to be refused")
+	}
+
+	// at the cap only existing counters can be added to
+	if _, err := s.db.Add("hits", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkClientCounter("api.orders"); err == nil {
+		t.Fatal("expected new counter beyond the cap to be refused")
+	}
+	if err := s.checkClientCounter("hits"); err != nil {
+		t.Fatal(err)
+	}
+}
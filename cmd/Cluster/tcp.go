@@ -0,0 +1,20 @@
+package main
+
+import "github.com/RoanBrand/RequestCounter/internal/tcpproto"
+
+// tcpHandler serves the count over cluster's raw TCP protocol.
+type tcpHandler struct {
+	s *Server
+}
+
+func newTCPServer(s *Server) *tcpproto.Server {
+	return tcpproto.NewServer(tcpHandler{s})
+}
+
+func (h tcpHandler) Increment(delta uint64, idempotencyKey string) uint64 {
+	return h.s.increment(delta, idempotencyKey)
+}
+
+func (h tcpHandler) Count() uint64 {
+	return h.s.db.Count()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/tcpproto"
+)
+
+// Compare the cost of a count increment over http and over the raw TCP protocol.
+// go test -bench=Increment ./cmd/Cluster/
+
+func newBenchServer() (*Server, func()) {
+	os.Remove("test.test") // in case previous run failed
+
+	s := &Server{
+		ctx: context.Background(),
+		db:  db.NewDB("test.test"),
+	}
+
+	return s, func() {
+		s.db.Close()
+		os.Remove("test.test")
+	}
+}
+
+func BenchmarkHTTPIncrement(b *testing.B) {
+	s, cleanup := newBenchServer()
+	defer cleanup()
+
+	hs := httptest.NewServer(http.HandlerFunc(s.requestHandler))
+	defer hs.Close()
+
+	c := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 100}}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := c.Get(hs.URL)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || len(body) != 8 {
+				b.Error("bad response", err)
+				return
+			}
+			_ = binary.LittleEndian.Uint64(body)
+		}
+	})
+}
+
+func BenchmarkTCPIncrement(b *testing.B) {
+	s, cleanup := newBenchServer()
+	defer cleanup()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ts := newTCPServer(s)
+	go ts.Serve(ln)
+	defer ts.Close()
+
+	c := tcpproto.NewClient(ln.Addr().String(), 4, time.Second, nil)
+	defer c.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.Increment(context.Background(), 1, ""); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestTCP(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+
+	s := Server{
+		ctx:  context.Background(),
+		db:   db.NewDB("test.test"),
+		idem: newIdempotencyCache(context.Background()),
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTCPServer(&s)
+	go ts.Serve(ln)
+	defer ts.Close()
+
+	c := tcpproto.NewClient(ln.Addr().String(), 1, time.Second, nil)
+	defer c.Close()
+
+	for i, key := range []string{"a", "a", ""} {
+		n, err := c.Increment(context.Background(), 3, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := []uint64{3, 3, 6}[i]; n != exp {
+			t.Fatalf("expected %d, got %d", exp, n)
+		}
+	}
+
+	if n := s.db.Count(); n != 6 {
+		t.Fatalf("expected db count 6, got %d", n)
+	}
+}
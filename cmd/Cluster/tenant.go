@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/tenant"
+)
+
+// resolveTenant returns the tenant of r, nil if it has none, or responds
+// with an error and returns false if it names one that it can't use.
+func (s *Server) resolveTenant(w http.ResponseWriter, r *http.Request) (*tenant.Tenant, bool) {
+	if s.tenants == nil {
+		return nil, true
+	}
+
+	t, err := s.tenants.Resolve(r)
+	if err != nil {
+		logging.Ctx(r.Context()).Info("tenant refused", logging.F("reason", err.Error()))
+		requestid.Error(w, r, err.Error(), tenant.StatusCode(err))
+		return nil, false
+	}
+	return t, true
+}
+
+// tenantCounters returns the counters of the tenant of r, or those of the db
+// if it has none, or responds with an error and returns false.
+func (s *Server) tenantCounters(w http.ResponseWriter, r *http.Request) (counterGetter, bool) {
+	t, ok := s.resolveTenant(w, r)
+	if !ok {
+		return nil, false
+	}
+	if t == nil {
+		return s.db, true
+	}
+
+	ns, err := s.db.Namespace(t.ID)
+	if err != nil {
+		requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return ns, true
+}
+
+// incrementTenant adds delta to the count of tenant t, unless idempotencyKey
+// was recently seen, and returns its new count. It is taken from the quota
+// of t, or if it has none, the one named by the request, see incrementQuota.
+// It responds with an error itself and returns false if not counted.
+func (s *Server) incrementTenant(w http.ResponseWriter, r *http.Request, t *tenant.Tenant, delta uint64) (uint64, bool) {
+	ns, err := s.db.Namespace(t.ID)
+	if err != nil {
+		requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	w.Header().Set(tenant.Header, t.ID)
+
+	id := t.Quota
+	if id == "" {
+		id = r.Header.Get(quota.Header)
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		// can't be the key of another tenant's request, header values can't hold NUL.
+		key = t.ID + "\x00" + key
+	}
+
+	return s.incrementQuota(w, r, id, delta, key, func() (uint64, error) {
+		return ns.Add(db.DefaultCounter, delta)
+	})
+}
+
+// tenantCounts returns the count of every tenant, for metrics.
+func (s *Server) tenantCounts() map[string]float64 {
+	tenants := s.tenants.Tenants()
+	counts := make(map[string]float64, len(tenants))
+	for _, t := range tenants {
+		if ns, err := s.db.Namespace(t.ID); err == nil {
+			v, _ := ns.Get(db.DefaultCounter)
+			counts[t.ID] = float64(v)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/RoanBrand/RequestCounter/internal/tenant"
+)
+
+func TestTenantRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+
+	s := Server{
+		ctx:  ctx,
+		db:   db.NewDB("test.test"),
+		idem: newIdempotencyCache(ctx),
+	}
+	defer s.db.Close()
+
+	var err error
+	if s.quotas, err = quota.New(s.db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if s.tenants, err = tenant.New(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.quotas.Put(quota.Quota{ID: "acme", Counter: "acme", Limit: 2, Window: quota.Duration(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.tenants.Put(tenant.Tenant{ID: "acme", Keys: []string{"k1"}, Quota: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.tenants.Put(tenant.Tenant{ID: "beta"}); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(header, value, idempotencyKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		w := httptest.NewRecorder()
+		s.requestHandler(w, req)
+		return w
+	}
+	count := func(w *httptest.ResponseRecorder) uint64 {
+		if w.Body.Len() != 8 {
+			t.Fatalf("expected count, got %d %s", w.Code, w.Body)
+		}
+		return binary.LittleEndian.Uint64(w.Body.Bytes())
+	}
+
+	if c := count(do("", "", "")); c != 1 {
+		t.Fatalf("expected count 1, got %d", c)
+	}
+
+	w := do(tenant.KeyHeader, "k1", "a")
+	if c := count(w); c != 1 || w.Header().Get(tenant.Header) != "acme" || w.Header().Get(quota.RemainingHeader) != "1" {
+		t.Fatalf("expected count 1 of acme with 1 left, got %d %v", c, w.Header())
+	}
+	// a repeated request is not taken from the quota again.
+	if w := do(tenant.KeyHeader, "k1", "a"); count(w) != 1 || w.Header().Get(quota.RemainingHeader) != "1" {
+		t.Fatalf("expected repeated request not to be counted, got %v", w.Header())
+	}
+	if c := count(do(tenant.KeyHeader, "k1", "b")); c != 2 {
+		t.Fatalf("expected count 2 of acme, got %d", c)
+	}
+	if w := do(tenant.KeyHeader, "k1", "c"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected acme to be over its quota, got %d", w.Code)
+	}
+
+	if c := count(do(tenant.Header, "beta", "a")); c != 1 {
+		t.Fatalf("expected count 1 of beta, got %d", c)
+	}
+	if w := do(tenant.Header, "acme", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected acme to require its key, got %d", w.Code)
+	}
+	if w := do(tenant.KeyHeader, "nope", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unknown key to be refused, got %d", w.Code)
+	}
+	if w := do(tenant.Header, "other", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown tenant, got %d", w.Code)
+	}
+
+	if c := count(do("", "", "")); c != 2 {
+		t.Fatalf("expected count 2 without tenant, got %d", c)
+	}
+	if counts := s.tenantCounts(); counts["acme"] != 2 || counts["beta"] != 1 {
+		t.Fatalf("unexpected tenant counts %v", counts)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/websocket"
+)
+
+const (
+	defaultWatchInterval = time.Millisecond * 100
+	watchHeartbeat       = time.Second * 15
+)
+
+type counterUpdate struct {
+	Counter string `json:"counter"`
+	Count   uint64 `json:"count"`
+}
+
+// watchStream sends counter updates to a watcher.
+type watchStream interface {
+	send(u counterUpdate) error
+	heartbeat() error
+}
+
+// watchHandler streams changes of the counters named by the "counter" query
+// parameters, by default the count, as Server-Sent Events or WebSocket messages.
+// Updates are sent at most once per interval, which can be made longer
+// than the server's with the "interval" query parameter.
+// Requests of a tenant watch the counters of its namespace.
+func (s *Server) watchHandler(w http.ResponseWriter, r *http.Request) {
+	counters, ok := s.tenantCounters(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	names := q["counter"]
+	if len(names) == 0 {
+		names = []string{db.DefaultCounter}
+	}
+
+	interval := s.minWatchInterval()
+	if v := q.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			requestid.Error(w, r, "invalid interval", http.StatusBadRequest)
+			return
+		}
+		if d > interval {
+			interval = d
+		}
+	}
+
+	if websocket.IsUpgrade(r) {
+		c, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		go c.ReadLoop()
+
+		// the server no longer notices the client going away once hijacked.
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-c.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		s.streamCounters(ctx, counters, names, interval, wsStream{c})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		requestid.Error(w, r, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	s.streamCounters(r.Context(), counters, names, interval, sseStream{w, flusher})
+}
+
+// counterGetter gets counters by name, those of the db or of a namespace of it.
+type counterGetter interface {
+	Get(name string) (uint64, bool)
+}
+
+// streamCounters sends the current value of the named counters of c and then
+// their changes, at most once per interval, until ctx or the server is done.
+func (s *Server) streamCounters(ctx context.Context, c counterGetter, names []string, interval time.Duration, st watchStream) error {
+	changed, stop := s.db.Watch()
+	defer stop()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	last := make(map[string]uint64, len(names))
+	for {
+		for _, name := range names {
+			v, _ := c.Get(name)
+			if l, ok := last[name]; ok && l == v {
+				continue
+			}
+
+			last[name] = v
+			if err := st.send(counterUpdate{name, v}); err != nil {
+				return err
+			}
+		}
+
+		// coalesce changes to at most one update per interval.
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-s.ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.ctx.Done():
+				return nil
+			case <-changed:
+				waiting = false
+			case <-heartbeat.C:
+				if err := st.heartbeat(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+type sseStream struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (st sseStream) send(u counterUpdate) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	if _, err := st.w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if _, err := st.w.Write(append(b, '\n', '\n')); err != nil {
+		return err
+	}
+	st.f.Flush()
+	return nil
+}
+
+func (st sseStream) heartbeat() error {
+	if _, err := st.w.Write([]byte(": ping\n\n")); err != nil {
+		return err
+	}
+	st.f.Flush()
+	return nil
+}
+
+type wsStream struct {
+	c *websocket.Conn
+}
+
+func (st wsStream) send(u counterUpdate) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return st.c.WriteText(b)
+}
+
+func (st wsStream) heartbeat() error {
+	return st.c.Ping()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+)
+
+func newWatchServer(t *testing.T) (*Server, *httptest.Server, context.CancelFunc) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		ctx:           ctx,
+		db:            db.NewDB("test.test"),
+		watchInterval: time.Millisecond,
+	}
+
+	hs := httptest.NewServer(http.HandlerFunc(s.watchHandler))
+	t.Cleanup(func() {
+		cancel()
+		hs.Close()
+		s.db.Close()
+		os.Remove("test.test")
+		os.Remove("test.test.counters")
+	})
+
+	return s, hs, cancel
+}
+
+func TestWatchSSE(t *testing.T) {
+	s, hs, cancel := newWatchServer(t)
+
+	resp, err := http.Get(hs.URL + "?counter=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	next := func() counterUpdate {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.HasPrefix(line, "data: ") {
+				var u counterUpdate
+				if err := json.Unmarshal([]byte(line[6:]), &u); err != nil {
+					t.Fatal(err)
+				}
+				return u
+			}
+		}
+	}
+
+	if u := next(); u.Counter != "a" || u.Count != 0 {
+		t.Fatalf("unexpected initial update %+v", u)
+	}
+
+	s.db.Add("a", 3)
+	if u := next(); u.Count != 3 {
+		t.Fatalf("expected 3, got %+v", u)
+	}
+
+	// stream must end once the server stops.
+	cancel()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchWebSocket(t *testing.T) {
+	s, hs, _ := newWatchServer(t)
+
+	c, err := net.Dial("tcp", hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("GET /?counter=" + db.DefaultCounter + " HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	if a := resp.Header.Get("Sec-WebSocket-Accept"); a != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept %q", a)
+	}
+
+	next := func() counterUpdate {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr[0] != 0x81 {
+			t.Fatalf("expected text frame, got %x", hdr[0])
+		}
+
+		l := int(hdr[1])
+		if l == 126 {
+			var b [2]byte
+			io.ReadFull(r, b[:])
+			l = int(binary.BigEndian.Uint16(b[:]))
+		}
+
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+
+		var u counterUpdate
+		if err := json.Unmarshal(b, &u); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	if u := next(); u.Counter != db.DefaultCounter || u.Count != 0 {
+		t.Fatalf("unexpected initial update %+v", u)
+	}
+
+	s.db.IncCount()
+	s.db.IncCount()
+
+	// updates are coalesced, but must end with the latest count.
+	for u := next(); u.Count != 2; u = next() {
+	}
+}
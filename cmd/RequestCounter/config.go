@@ -0,0 +1,276 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/admin"
+	"github.com/RoanBrand/RequestCounter/internal/certs"
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/ratelimit"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
+	"github.com/pkg/errors"
+)
+
+// defaultShutdownTimeout is the time Close waits for in-flight requests, if not configured.
+const defaultShutdownTimeout = time.Second * 5
+
+var settings = []config.Setting{
+	{Name: "LISTEN_ADDR", Usage: "address of the http listener"},
+	{Name: "DB_FILE", Usage: "file to persist the node count to"},
+	{Name: "CLUSTER_ADDR", Usage: "comma separated cluster endpoints, http(s)://, grpc:// or tcp://", Reloadable: true},
+	{Name: "TLS_CERT", Usage: "certificate file to serve over TLS"},
+	{Name: "TLS_KEY", Usage: "key file of TLS_CERT"},
+	{Name: "HEDGE_PERCENTILE", Kind: config.Float, Usage: "latency percentile after which to hedge requests to cluster, disabled if not set"},
+	{Name: "DEGRADED_MODE", Kind: config.Bool, Default: "false", Usage: "keep serving when cluster is unreachable"},
+	{Name: "PENDING_DB_FILE", Usage: "file to persist requests not yet reported to cluster to, default DB_FILE.pending"},
+	{Name: "QUOTA_PER_KEY", Kind: config.Bool, Default: "false", Usage: "hold clients with an API key to the cluster quota named after it"},
+	{Name: "QUOTA_DEFAULT", Usage: "cluster quota of other clients, none if not set"},
+	{Name: "TENANT_KEY_HEADER", Usage: "header with a tenant's API key"},
+	{Name: "TENANT_HOST_SUFFIX", Usage: "domain under which the first label of the host is the tenant"},
+	{Name: "SHUTDOWN_TIMEOUT", Kind: config.Duration, Default: "5s", Usage: "time to finish in-flight requests when stopping"},
+}
+
+// clientSettings configure the cluster client, see clientConfigFrom.
+var clientSettings = []config.Setting{
+	{Name: "CLUSTER_TIMEOUT", Kind: config.Duration, Default: "5s", Usage: "timeout of a request to a cluster endpoint", Reloadable: true},
+	{Name: "CLUSTER_DIAL_TIMEOUT", Kind: config.Duration, Default: "2s", Usage: "timeout of connecting to cluster"},
+	{Name: "CLUSTER_KEEP_ALIVE", Kind: config.Duration, Default: "30s", Usage: "keep-alive period of connections to cluster"},
+	{Name: "CLUSTER_TLS_HANDSHAKE_TIMEOUT", Kind: config.Duration, Default: "5s", Usage: "timeout of TLS handshakes with cluster"},
+	{Name: "CLUSTER_IDLE_CONN_TIMEOUT", Kind: config.Duration, Default: "90s", Usage: "time idle connections to cluster are kept"},
+	{Name: "CLUSTER_MAX_IDLE_CONNS", Kind: config.Int, Default: "100", Usage: "idle connections kept to cluster"},
+	{Name: "CLUSTER_MAX_IDLE_CONNS_PER_HOST", Kind: config.Int, Default: "100", Usage: "idle connections kept per cluster endpoint"},
+	{Name: "CLUSTER_MAX_CONNS_PER_HOST", Kind: config.Int, Default: "0", Usage: "connections per cluster endpoint, 0 for no limit"},
+	{Name: "CLUSTER_TCP_POOL_SIZE", Kind: config.Int, Default: "4", Usage: "connections per tcp:// endpoint"},
+	{Name: "CLUSTER_HTTP2", Kind: config.Bool, Default: "true", Usage: "use HTTP/2 with https:// endpoints"},
+	{Name: "CLUSTER_TLS_CA", Usage: "CA file of cluster's certificate"},
+	{Name: "CLUSTER_TLS_CERT", Usage: "client certificate file to present to cluster"},
+	{Name: "CLUSTER_TLS_KEY", Usage: "key file of CLUSTER_TLS_CERT"},
+	{Name: "CLUSTER_TLS_SERVER_NAME", Usage: "name to verify cluster's certificate against"},
+	{Name: "CLUSTER_SIGNING_KEY", Usage: "id:secret key to sign requests to cluster with", Secret: true},
+}
+
+// clientConfigFrom overrides the default cluster client config
+// with any clientSettings set. Their kinds are checked by config.Load,
+// so values that are not of their kind are left to it to report.
+func clientConfigFrom(get config.Getter) (clientConfig, error) {
+	c := defaultClientConfig()
+
+	durations := []struct {
+		env string
+		v   *time.Duration
+	}{
+		{"CLUSTER_TIMEOUT", &c.Timeout},
+		{"CLUSTER_DIAL_TIMEOUT", &c.DialTimeout},
+		{"CLUSTER_KEEP_ALIVE", &c.KeepAlive},
+		{"CLUSTER_TLS_HANDSHAKE_TIMEOUT", &c.TLSHandshakeTimeout},
+		{"CLUSTER_IDLE_CONN_TIMEOUT", &c.IdleConnTimeout},
+	}
+	for _, d := range durations {
+		if parsed, err := time.ParseDuration(get(d.env)); err == nil {
+			*d.v = parsed
+		}
+	}
+
+	ints := []struct {
+		env string
+		v   *int
+	}{
+		{"CLUSTER_MAX_IDLE_CONNS", &c.MaxIdleConns},
+		{"CLUSTER_MAX_IDLE_CONNS_PER_HOST", &c.MaxIdleConnsPerHost},
+		{"CLUSTER_MAX_CONNS_PER_HOST", &c.MaxConnsPerHost},
+		{"CLUSTER_TCP_POOL_SIZE", &c.TCPPoolSize},
+	}
+	for _, i := range ints {
+		if parsed, err := strconv.Atoi(get(i.env)); err == nil {
+			*i.v = parsed
+		}
+	}
+
+	caFile, certFile, keyFile := get("CLUSTER_TLS_CA"), get("CLUSTER_TLS_CERT"), get("CLUSTER_TLS_KEY")
+	if caFile != "" || certFile != "" || keyFile != "" {
+		tlsConfig, err := certs.ClientConfig(caFile, certFile, keyFile, get("CLUSTER_TLS_SERVER_NAME"))
+		if err != nil {
+			return c, errors.WithMessage(err, "CLUSTER_TLS")
+		}
+		c.TLS = tlsConfig
+	}
+
+	if v := get("CLUSTER_SIGNING_KEY"); v != "" {
+		key, err := signing.ParseKey(v)
+		if err != nil {
+			return c, errors.WithMessage(err, "CLUSTER_SIGNING_KEY")
+		}
+		c.Signing = &key
+	}
+
+	if parsed, err := strconv.ParseBool(get("CLUSTER_HTTP2")); err == nil {
+		c.HTTP2 = parsed
+	}
+
+	return c, nil
+}
+
+// allSettings are the settings of the command and the packages it configures.
+var allSettings = [][]config.Setting{settings, clientSettings, ratelimit.Settings, admin.Settings, logging.Settings, tracing.Settings, config.Settings}
+
+// serverConfig is the config of a Server, see Init.
+type serverConfig struct {
+	ListenAddr   string
+	DBFile       string
+	ClusterAddrs string
+	Client       clientConfig
+
+	Admin   admin.Config
+	TLS     *certs.Server // nil to serve without TLS
+	Clients ratelimit.Config
+	Quota   *quotaConfig  // nil to not hold clients to quotas
+	Tenants *tenantConfig // nil to not count per tenant
+
+	// HedgePercentile is the latency percentile after which
+	// requests to cluster are hedged, disabled if 0.
+	HedgePercentile float64
+	// PendingDBFile persists requests not yet reported to cluster
+	// in degraded mode, disabled if not set.
+	PendingDBFile string
+
+	ShutdownTimeout time.Duration
+}
+
+// serverConfigFrom checks settings and returns the config of the server.
+// All problems found are returned together as config.Errors.
+func serverConfigFrom(get config.Getter) (serverConfig, error) {
+	c := serverConfig{
+		ListenAddr:   get("LISTEN_ADDR"),
+		DBFile:       get("DB_FILE"),
+		ClusterAddrs: get("CLUSTER_ADDR"),
+	}
+
+	var errs config.Errors
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// kinds are checked by config.Load, so only ranges are left to check.
+	if c.ShutdownTimeout, _ = time.ParseDuration(get("SHUTDOWN_TIMEOUT")); c.ShutdownTimeout <= 0 {
+		check(errors.Errorf("SHUTDOWN_TIMEOUT: invalid timeout %q", get("SHUTDOWN_TIMEOUT")))
+	}
+
+	_, err := clusterTimeout(get)
+	check(err)
+
+	if p := get("HEDGE_PERCENTILE"); p != "" {
+		c.HedgePercentile, _ = strconv.ParseFloat(p, 64)
+		if c.HedgePercentile <= 0 || c.HedgePercentile > 100 {
+			check(errors.Errorf("HEDGE_PERCENTILE: invalid percentile %q", p))
+		}
+	}
+
+	if degraded, _ := strconv.ParseBool(get("DEGRADED_MODE")); degraded {
+		c.PendingDBFile = get("PENDING_DB_FILE")
+		if c.PendingDBFile == "" {
+			c.PendingDBFile = c.DBFile + ".pending"
+		}
+	}
+
+	_, err = newEndpoints(c.ClusterAddrs)
+	check(errors.WithMessage(err, "CLUSTER_ADDR"))
+
+	c.Client, err = clientConfigFrom(get)
+	check(err)
+
+	c.Admin, err = admin.ConfigFrom(get)
+	check(err)
+
+	c.Clients, err = ratelimit.ConfigFrom(get)
+	check(err)
+
+	c.Quota, err = quotaConfigFrom(get)
+	check(err)
+
+	c.Tenants, err = tenantConfigFrom(get)
+	check(err)
+
+	_, err = tracing.ConfigFrom("requestcounter", get)
+	check(err)
+
+	if certFile := get("TLS_CERT"); certFile != "" {
+		c.TLS, err = certs.LoadServer(certFile, get("TLS_KEY"), "")
+		check(errors.WithMessage(err, "TLS_CERT"))
+	}
+
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// clusterTimeout returns the CLUSTER_TIMEOUT of requests to cluster,
+// which must be positive, as requests without one could hang forever.
+func clusterTimeout(get config.Getter) (time.Duration, error) {
+	timeout, err := time.ParseDuration(get("CLUSTER_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 0, errors.Errorf("CLUSTER_TIMEOUT: invalid timeout %q", get("CLUSTER_TIMEOUT"))
+	}
+	return timeout, nil
+}
+
+// applyConfig puts the reloadable settings of next that differ from prev into effect.
+func (s *Server) applyConfig(prev, next *config.Config) error {
+	changed := func(names ...string) bool {
+		for _, name := range names {
+			if prev.Get(name) != next.Get(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if changed("LOG_LEVEL", "LOG_FORMAT", "ACCESS_LOG_SAMPLE_RATIO") {
+		if err := logging.SetupFrom("requestcounter", next.Get); err != nil {
+			return err
+		}
+	}
+
+	if changed("CLUSTER_ADDR") {
+		if err := s.cluster.update(s.ctx, next.Get("CLUSTER_ADDR")); err != nil {
+			return errors.WithMessage(err, "CLUSTER_ADDR")
+		}
+	}
+
+	if changed("CLUSTER_TIMEOUT") {
+		timeout, err := clusterTimeout(next.Get)
+		if err != nil {
+			return err
+		}
+		s.setTimeout(timeout)
+	}
+
+	if changed("RATE_LIMIT", "RATE_LIMIT_BURST", "RATE_LIMIT_CLUSTER") {
+		cfg, err := ratelimit.ConfigFrom(next.Get)
+		if err != nil {
+			return err
+		}
+
+		var local, cluster bool
+		if s.limits != nil {
+			local, cluster = s.limits.local != nil, s.limits.cluster != nil
+		}
+		if local != (cfg.Rate > 0) || cluster != (cfg.ClusterLimit > 0) {
+			return errors.New("enabling or disabling rate limits needs a restart")
+		}
+
+		if local {
+			s.limits.local.SetRate(cfg.Rate, cfg.Burst)
+		}
+		if cluster {
+			s.limits.cluster.SetLimit(cfg.ClusterLimit)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+)
+
+func TestServerConfigFrom(t *testing.T) {
+	settings := map[string]string{
+		"CLUSTER_ADDR":     "http://cluster:8000",
+		"CLUSTER_TIMEOUT":  "5s",
+		"DB_FILE":          "test.test",
+		"DEGRADED_MODE":    "true",
+		"SHUTDOWN_TIMEOUT": "5s",
+	}
+	get := func(name string) string { return settings[name] }
+
+	c, err := serverConfigFrom(get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PendingDBFile != "test.test.pending" {
+		t.Fatalf("expected default pending file, got %q", c.PendingDBFile)
+	}
+
+	settings["CLUSTER_ADDR"] = ""
+	settings["SHUTDOWN_TIMEOUT"] = "-1s"
+	settings["HEDGE_PERCENTILE"] = "101"
+	settings["RATE_LIMIT"] = "-1"
+	settings["TENANT_HOST_SUFFIX"] = "example.com"
+	settings["CLUSTER_TIMEOUT"] = "0s"
+
+	_, err = serverConfigFrom(get)
+	errs, ok := err.(config.Errors)
+	if !ok || len(errs) != 6 {
+		t.Fatalf("expected all 6 problems reported, got %v", err)
+	}
+}
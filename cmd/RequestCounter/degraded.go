@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+const reconcileInterval = time.Second * 5
+
+// EnableDegradedMode makes the server keep serving requests when cluster
+// is unreachable. Increments that could not be reported are persisted
+// in pendingDBFilePath and replayed to cluster once it is reachable again.
+func (s *Server) EnableDegradedMode(pendingDBFilePath string) {
+	s.pending = db.NewDB(pendingDBFilePath)
+	s.reconcile = make(chan struct{}, 1)
+
+	s.batchFile = pendingDBFilePath + ".batch"
+	batch, err := loadPendingBatch(s.batchFile)
+	if err != nil {
+		logging.Error("error loading pending batch", logging.Err(err))
+	}
+	s.batch = batch
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.stopReconciler, s.reconcilerDone = cancel, make(chan struct{})
+	go func() {
+		defer close(s.reconcilerDone)
+		s.reconciler(ctx)
+	}()
+}
+
+// degradedResponse counts a request that could not be reported to cluster
+// and responds with the node count and an estimated cluster count.
+func (s *Server) degradedResponse(w http.ResponseWriter) {
+	pending := s.pending.IncCount()
+	newNodeCount := s.db.IncCount()
+
+	clusterCount := "unavailable"
+	if last := atomic.LoadUint64(&s.lastClusterCount); last != 0 {
+		clusterCount = fmt.Sprintf("estimated at %d", last+pending)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := fmt.Fprintf(
+		w,
+		"You are talking to instance %s%s.\nThis is request %d to this instance. The cluster is unreachable, its count is %s.\n",
+		s.hostName,
+		s.s.Addr,
+		newNodeCount,
+		clusterCount,
+	)
+	if err != nil {
+		logging.Warn("error sending response", logging.Err(err))
+	}
+}
+
+func (s *Server) notifyReconciler() {
+	if s.pending == nil || s.pending.Count() == 0 {
+		return
+	}
+
+	if len(s.reconcile) == 0 {
+		select {
+		case s.reconcile <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reconciler periodically, or when cluster is known to be reachable again,
+// replays pending increments to cluster until ctx is done.
+func (s *Server) reconciler(ctx context.Context) {
+	t := time.NewTicker(reconcileInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-s.reconcile:
+		}
+
+		if err := s.replayPending(ctx); err != nil {
+			logging.Warn("error replaying pending requests to cluster", logging.Err(err))
+		}
+	}
+}
+
+// replayPending reports pending increments to cluster in a batch.
+// The batch and its idempotency key are persisted before it is sent, and the
+// same batch is sent again until cluster acknowledges it, so that it is
+// counted once even if an answer is lost, or the server restarted meanwhile.
+func (s *Server) replayPending(ctx context.Context) error {
+	if s.batch == nil {
+		pending := s.pending.Count()
+		if pending == 0 {
+			return nil
+		}
+
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return err
+		}
+
+		// the batch must not be more than the persisted count,
+		// which it is subtracted from after a restart.
+		if err := s.pending.Snapshot(); err != nil {
+			return err
+		}
+		batch := &pendingBatch{delta: pending, key: key}
+		if eps := s.cluster.ordered(); len(eps) > 0 {
+			batch.instance = instanceOf(eps[0].addr)
+		}
+		if err := batch.save(s.batchFile); err != nil {
+			return err
+		}
+		s.batch = batch
+	}
+
+	if s.batch.instance != "" && len(instanceEndpoints(s.cluster.ordered(), s.batch.instance)) == 0 {
+		// the instance was removed from CLUSTER_ADDR, and with it any chance of a double count.
+		logging.Warn("cluster instance of pending batch removed, sending it to another", logging.F("instance", s.batch.instance))
+		s.batch.instance = ""
+	}
+
+	pending := s.batch.delta
+	newClusterCount, err := s.addClusterCountOnce(ctx, pending, s.batch.key, s.batch.instance)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to report %d requests", pending)
+	}
+
+	// forget the batch before subtracting it: if interrupted in between,
+	// it is reported again rather than lost.
+	if err := removePendingBatch(s.batchFile); err != nil {
+		return err
+	}
+	s.batch = nil
+
+	// only this goroutine subtracts, so the count is still at least pending.
+	s.pending.SubCount(pending)
+	atomic.StoreUint64(&s.lastClusterCount, newClusterCount)
+	logging.Info("reported pending requests to cluster", logging.F("pending", pending))
+	return nil
+}
+
+// pendingBatch is pending increments that are being reported to cluster.
+type pendingBatch struct {
+	delta uint64
+	// idempotency key and the cluster instance that knows it,
+	// the same for every attempt. Any instance if empty.
+	key, instance string
+}
+
+// save writes b to file as the delta, little endian, followed by
+// the key and instance separated by a space.
+func (b *pendingBatch) save(file string) error {
+	fb := make([]byte, 8, 8+len(b.key)+1+len(b.instance))
+	binary.LittleEndian.PutUint64(fb, b.delta)
+	fb = append(fb, b.key...)
+	fb = append(fb, ' ')
+	fb = append(fb, b.instance...)
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, fb, 0644); err != nil {
+		return errors.Wrap(err, "unable to save "+file)
+	}
+	return errors.Wrap(os.Rename(tmp, file), "unable to save "+file)
+}
+
+// loadPendingBatch returns the batch saved in file, or nil if there is none.
+func loadPendingBatch(file string) (*pendingBatch, error) {
+	fb, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "unable to read "+file)
+	}
+
+	if len(fb) <= 8 {
+		return nil, errors.New("pending batch file corrupted: " + file)
+	}
+	key, instance, _ := strings.Cut(string(fb[8:]), " ")
+	return &pendingBatch{delta: binary.LittleEndian.Uint64(fb), key: key, instance: instance}, nil
+}
+
+func removePendingBatch(file string) error {
+	if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.Wrap(err, "unable to remove "+file)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	dnsPrefix          = "dns+"
+	dnsRefreshInterval = time.Second * 30
+
+	minBackoff = time.Millisecond * 500
+	maxBackoff = time.Second * 30
+)
+
+// endpoint is a cluster instance with its observed health and latency.
+type endpoint struct {
+	addr string
+
+	mu        sync.Mutex
+	latency   time.Duration // moving average of successful requests
+	failures  int           // consecutive
+	downUntil time.Time
+}
+
+func (e *endpoint) success(latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = (e.latency*4 + latency) / 5
+	}
+
+	if e.failures > 0 {
+		logging.Info("cluster endpoint recovered", logging.F("endpoint", e.addr))
+	}
+	e.failures = 0
+	e.downUntil = time.Time{}
+}
+
+func (e *endpoint) failure() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	backoff := maxBackoff
+	if e.failures < 16 {
+		if b := minBackoff << e.failures; b < maxBackoff {
+			backoff = b
+		}
+	}
+
+	e.failures++
+	e.downUntil = time.Now().Add(backoff)
+}
+
+func (e *endpoint) state() (healthy bool, latency time.Duration, downUntil time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().After(e.downUntil), e.latency, e.downUntil
+}
+
+// endpoints is the set of cluster instances to send requests to.
+// Addresses prefixed with "dns+", e.g. "dns+http://cluster:8083",
+// are resolved to an endpoint per address the host name resolves to.
+type endpoints struct {
+	resolving sync.Mutex
+
+	mu     sync.RWMutex
+	static []string
+	dns    []*url.URL
+	list   []*endpoint
+}
+
+// instanceOf returns the cluster instance the endpoint at addr belongs to,
+// by its host. The endpoints of an instance share its idempotency keys,
+// whatever their protocol.
+func instanceOf(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Hostname() == "" {
+		return addr
+	}
+	return u.Hostname()
+}
+
+// instanceEndpoints returns the endpoints of eps that belong to instance.
+func instanceEndpoints(eps []*endpoint, instance string) []*endpoint {
+	var ie []*endpoint
+	for _, e := range eps {
+		if instanceOf(e.addr) == instance {
+			ie = append(ie, e)
+		}
+	}
+	return ie
+}
+
+// newEndpoints parses a comma separated list of cluster addresses.
+func newEndpoints(addrs string) (*endpoints, error) {
+	es := endpoints{}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(addr, dnsPrefix) {
+			es.static = append(es.static, addr)
+			continue
+		}
+
+		u, err := url.Parse(strings.TrimPrefix(addr, dnsPrefix))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid cluster address "+addr)
+		}
+		es.dns = append(es.dns, u)
+	}
+
+	if len(es.static) == 0 && len(es.dns) == 0 {
+		return nil, errors.New("no cluster address configured")
+	}
+
+	for _, addr := range es.static {
+		es.list = append(es.list, &endpoint{addr: addr})
+	}
+
+	return &es, nil
+}
+
+// watchDNS resolves dns endpoints until ctx is done.
+func (es *endpoints) watchDNS(ctx context.Context) {
+	if len(es.dns) > 0 {
+		es.resolve(ctx)
+	}
+
+	go func() {
+		t := time.NewTicker(dnsRefreshInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				es.resolve(ctx)
+			}
+		}
+	}()
+}
+
+// update replaces the cluster addresses with the comma separated addrs,
+// keeping the observed state of endpoints that are still present.
+func (es *endpoints) update(ctx context.Context, addrs string) error {
+	next, err := newEndpoints(addrs)
+	if err != nil {
+		return err
+	}
+
+	es.mu.Lock()
+	es.static, es.dns = next.static, next.dns
+	es.mu.Unlock()
+
+	es.resolve(ctx)
+	return nil
+}
+
+func (es *endpoints) resolve(ctx context.Context) {
+	// so that a resolve of old addresses can't replace the list of an update.
+	es.resolving.Lock()
+	defer es.resolving.Unlock()
+
+	es.mu.RLock()
+	addrs := append([]string(nil), es.static...)
+	dns := es.dns
+	es.mu.RUnlock()
+
+	for _, u := range dns {
+		hosts, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+		if err != nil {
+			logging.Warn("error resolving cluster host", logging.F("host", u.Hostname()), logging.Err(err))
+			continue
+		}
+
+		for _, h := range hosts {
+			r := *u
+			r.Host = h
+			if port := u.Port(); port != "" {
+				r.Host = net.JoinHostPort(h, port)
+			} else if strings.Contains(h, ":") {
+				r.Host = "[" + h + "]"
+			}
+			addrs = append(addrs, r.String())
+		}
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	// keep observed state of endpoints that are still present.
+	existing := make(map[string]*endpoint, len(es.list))
+	for _, e := range es.list {
+		existing[e.addr] = e
+	}
+
+	list := make([]*endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		e, ok := existing[addr]
+		if !ok {
+			e = &endpoint{addr: addr}
+		}
+		list = append(list, e)
+	}
+
+	// don't drop everything on a failed lookup.
+	if len(list) > 0 {
+		es.list = list
+	}
+}
+
+// ordered returns the endpoints in order of preference:
+// healthy ones by latency, followed by unhealthy ones
+// by how soon they are due to be retried.
+func (es *endpoints) ordered() []*endpoint {
+	es.mu.RLock()
+	list := append([]*endpoint(nil), es.list...)
+	es.mu.RUnlock()
+
+	type ranked struct {
+		e         *endpoint
+		healthy   bool
+		latency   time.Duration
+		downUntil time.Time
+	}
+
+	rs := make([]ranked, len(list))
+	for i, e := range list {
+		rs[i].e = e
+		rs[i].healthy, rs[i].latency, rs[i].downUntil = e.state()
+	}
+
+	sort.SliceStable(rs, func(i, j int) bool {
+		if rs[i].healthy != rs[j].healthy {
+			return rs[i].healthy
+		}
+		if rs[i].healthy {
+			return rs[i].latency < rs[j].latency
+		}
+		return rs[i].downUntil.Before(rs[j].downUntil)
+	})
+
+	for i := range rs {
+		list[i] = rs[i].e
+	}
+	return list
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/RoanBrand/RequestCounter/api/clusterpb"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcScheme marks cluster endpoints that are reached over gRPC
+// instead of http, e.g. "grpc://cluster:9083".
+const grpcScheme = "grpc://"
+
+func isGRPCEndpoint(addr string) bool {
+	return strings.HasPrefix(addr, grpcScheme)
+}
+
+// grpcConns holds a client connection per gRPC cluster endpoint.
+type grpcConns struct {
+	tls *tls.Config // nil for plaintext
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func (g *grpcConns) client(target string) (clusterpb.ClusterClient, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if cc, ok := g.conns[target]; ok {
+		return clusterpb.NewClusterClient(cc), nil
+	}
+
+	// does not block, connects in the background.
+	creds := insecure.NewCredentials()
+	if g.tls != nil {
+		creds = credentials.NewTLS(g.tls)
+	}
+
+	cc, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if g.conns == nil {
+		g.conns = make(map[string]*grpc.ClientConn)
+	}
+	g.conns[target] = cc
+	return clusterpb.NewClusterClient(cc), nil
+}
+
+func (g *grpcConns) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var firstErr error
+	for target, cc := range g.conns {
+		if err := cc.Close(); err != nil && firstErr == nil {
+			firstErr = errors.WithStack(err)
+		}
+		delete(g.conns, target)
+	}
+	return firstErr
+}
+
+// grpcClusterRequest adds delta to the count of the gRPC cluster endpoint at addr.
+func (s *Server) grpcClusterRequest(ctx context.Context, addr string, delta uint64, idempotencyKey string) (uint64, error) {
+	c, err := s.grpc.client(strings.TrimPrefix(addr, grpcScheme))
+	if err != nil {
+		return 0, err
+	}
+
+	if sc := tracing.SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		ctx = metadata.AppendToOutgoingContext(ctx, tracing.TraceparentHeader, sc.Traceparent())
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestid.Header, id)
+	}
+
+	req := clusterpb.IncrementRequest{Delta: delta, IdempotencyKey: idempotencyKey}
+	if s.signing != nil {
+		m, err := signing.GRPCMessage(clusterpb.Cluster_Increment_FullMethodName, &req)
+		if err != nil {
+			return 0, err
+		}
+
+		var md []string
+		if err := s.signing.Sign(m, func(k, v string) { md = append(md, k, v) }); err != nil {
+			return 0, err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, md...)
+	}
+
+	resp, err := c.Increment(ctx, &req)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			return 0, errors.WithMessage(statusError(http.StatusBadRequest), err.Error())
+		case codes.Unauthenticated:
+			return 0, errors.WithMessage(statusError(http.StatusUnauthorized), err.Error())
+		}
+		return 0, errors.WithStack(err)
+	}
+
+	return resp.Count, nil
+}
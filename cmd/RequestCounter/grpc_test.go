@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/RoanBrand/RequestCounter/api/clusterpb"
+	"google.golang.org/grpc"
+)
+
+type fakeGRPCCluster struct {
+	clusterpb.UnimplementedClusterServer
+	count uint64
+}
+
+func (f *fakeGRPCCluster) Increment(_ context.Context, r *clusterpb.IncrementRequest) (*clusterpb.Count, error) {
+	f.count += r.Delta
+	return &clusterpb.Count{Count: f.count}, nil
+}
+
+func TestGRPCClusterRequest(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := grpc.NewServer()
+	clusterpb.RegisterClusterServer(g, &fakeGRPCCluster{})
+	go g.Serve(lis)
+	defer g.Stop()
+
+	cluster, err := newEndpoints("grpc://" + lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{ctx: context.Background(), cluster: cluster}
+	defer s.grpc.Close()
+
+	for _, exp := range []uint64{1, 2} {
+		count, err := s.makeClusterRequest(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != exp {
+			t.Fatalf("expected %d, got %d", exp, count)
+		}
+	}
+
+	if count, err := s.addClusterCount(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	} else if count != 12 {
+		t.Fatalf("expected 12, got %d", count)
+	}
+}
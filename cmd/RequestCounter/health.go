@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/api/clusterpb"
+	"github.com/RoanBrand/RequestCounter/internal/health"
+	"github.com/pkg/errors"
+)
+
+// healthzHandler reports whether the server is alive:
+// it is persisting its db, and pending increments in degraded mode.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	s.flusherChecks().ServeHTTP(w, r)
+}
+
+// readyzHandler reports whether the server should receive requests:
+// it is alive, loaded its saved db, is not shutting down and
+// can reach cluster. In degraded mode it serves requests without cluster,
+// so cluster being unreachable does not make it unready.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := s.flusherChecks()
+	checks["db"] = func(context.Context) error { return s.db.LoadErr() }
+	checks["shutdown"] = func(context.Context) error {
+		if s.ctx.Err() != nil {
+			return errors.New("shutting down")
+		}
+		return nil
+	}
+	if s.pending == nil {
+		checks["cluster"] = s.probeCluster
+	}
+	checks.ServeHTTP(w, r)
+}
+
+func (s *Server) flusherChecks() health.Checks {
+	checks := health.Checks{
+		"flusher": func(context.Context) error { return s.db.FlushErr() },
+	}
+	if s.pending != nil {
+		checks["pending_flusher"] = func(context.Context) error { return s.pending.FlushErr() }
+	}
+	return checks
+}
+
+// probeCluster checks that at least one cluster endpoint is ready,
+// trying them in order of preference, without counting a request.
+func (s *Server) probeCluster(ctx context.Context) error {
+	eps := s.cluster.ordered()
+	if len(eps) == 0 {
+		return errors.New("no cluster endpoints available")
+	}
+
+	var lastErr error
+	for _, e := range eps {
+		if lastErr = s.probeEndpoint(ctx, e.addr); lastErr == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return lastErr
+}
+
+func (s *Server) probeEndpoint(ctx context.Context, addr string) error {
+	if isGRPCEndpoint(addr) {
+		c, err := s.grpc.client(strings.TrimPrefix(addr, grpcScheme))
+		if err != nil {
+			return err
+		}
+		_, err = c.Get(ctx, &clusterpb.GetRequest{})
+		return errors.WithStack(err)
+	}
+
+	if isTCPEndpoint(addr) {
+		_, err := s.tcp.client(strings.TrimPrefix(addr, tcpScheme)).Get(ctx)
+		return err
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	u.Path, u.RawQuery = "/readyz", ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.WithStack(statusError(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeSamples      = 256
+	hedgeMinSamples   = 20
+	hedgeDefaultDelay = time.Millisecond * 50
+	hedgeMinDelay     = time.Millisecond
+)
+
+var (
+	hedgeFired = expvar.NewInt("cluster_hedges_fired")
+	hedgeWon   = expvar.NewInt("cluster_hedges_won")
+)
+
+// hedging decides how long to wait for a cluster response before sending
+// the same request to another endpoint. The delay is the configured
+// percentile of recently observed cluster latencies.
+type hedging struct {
+	percentile float64
+
+	mu      sync.Mutex
+	samples [hedgeSamples]time.Duration
+	n       int // total observed
+}
+
+func newHedging(percentile float64) *hedging {
+	return &hedging{percentile: percentile}
+}
+
+func (h *hedging) observe(latency time.Duration) {
+	h.mu.Lock()
+	h.samples[h.n%hedgeSamples] = latency
+	h.n++
+	h.mu.Unlock()
+}
+
+func (h *hedging) delay() time.Duration {
+	h.mu.Lock()
+	n := h.n
+	if n > hedgeSamples {
+		n = hedgeSamples
+	}
+	if n < hedgeMinSamples {
+		h.mu.Unlock()
+		return hedgeDefaultDelay
+	}
+
+	sorted := make([]time.Duration, n)
+	copy(sorted, h.samples[:n])
+	h.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(float64(n)*h.percentile/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= n {
+		i = n - 1
+	}
+
+	if d := sorted[i]; d > hedgeMinDelay {
+		return d
+	}
+	return hedgeMinDelay
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/pkg/errors"
+)
+
+// quotaConfig selects the cluster quota a request is held to.
+type quotaConfig struct {
+	// PerKey holds clients with a known API key to the quota named after it.
+	PerKey bool
+	// Default is the quota of other clients, none if empty.
+	Default string
+}
+
+// quotaConfigFrom returns the quota config of QUOTA_PER_KEY
+// and QUOTA_DEFAULT, or nil if quotas are not enforced.
+func quotaConfigFrom(get config.Getter) (*quotaConfig, error) {
+	var c quotaConfig
+	if v := get("QUOTA_PER_KEY"); v != "" {
+		perKey, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "QUOTA_PER_KEY")
+		}
+		c.PerKey = perKey
+	}
+	c.Default = get("QUOTA_DEFAULT")
+
+	if !c.PerKey && c.Default == "" {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// quotaRequest is the cluster quota a request is counted against,
+// and what cluster answered about it.
+type quotaRequest struct {
+	id string
+
+	mu     sync.Mutex
+	header http.Header // quota headers of cluster's answer
+}
+
+// answered records the quota headers of cluster's response.
+func (q *quotaRequest) answered(h http.Header) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.header = quotaHeaders(h)
+}
+
+// setResponseHeaders relays the quota headers of cluster's answer.
+func (q *quotaRequest) setResponseHeaders(h http.Header) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for k, v := range q.header {
+		h[k] = v
+	}
+}
+
+// quotaHeaders returns the quota headers of a response of cluster.
+func quotaHeaders(h http.Header) http.Header {
+	qh := make(http.Header)
+	for _, k := range []string{quota.LimitHeader, quota.RemainingHeader, quota.ResetHeader, "Retry-After"} {
+		if v := h.Get(k); v != "" {
+			qh.Set(k, v)
+		}
+	}
+	return qh
+}
+
+type quotaKey struct{}
+
+// quotaFrom returns the quota of a request to count, nil if it has none.
+func quotaFrom(ctx context.Context) *quotaRequest {
+	q, _ := ctx.Value(quotaKey{}).(*quotaRequest)
+	return q
+}
+
+// quotaLimited serves requests with h, holding them to their client's quota.
+// Cluster takes from it as it counts the request, so that it is taken once
+// and only for requests counted, and refuses the request with 429 once it is
+// exhausted. Its X-Quota-* headers are relayed by requestHandler.
+// Requests are counted if the quota is not defined.
+func (s *Server) quotaLimited(h http.Handler) http.Handler {
+	if s.quota == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := s.quota.Default
+		if key := s.clients.ClientKey(r); s.quota.PerKey && strings.HasPrefix(key, "key:") {
+			id = strings.TrimPrefix(key, "key:")
+		}
+		if id != "" {
+			r = r.WithContext(context.WithValue(r.Context(), quotaKey{}, &quotaRequest{id: id}))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
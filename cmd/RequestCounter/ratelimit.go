@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/ratelimit"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/pkg/errors"
+)
+
+// rateLimitSyncInterval is how often cluster-wide limits are synced with cluster.
+const rateLimitSyncInterval = time.Second
+
+var rateLimited = metrics.NewCounterVec("rate_limited_total", "Number of requests rejected by rate limits.", "limit")
+
+// rateLimits limits requests per client, by this instance
+// and across all instances.
+type rateLimits struct {
+	local   *ratelimit.Limiter       // nil if disabled
+	cluster *ratelimit.WindowLimiter // nil if disabled
+}
+
+func newRateLimits(cfg ratelimit.Config) *rateLimits {
+	var l rateLimits
+	if cfg.Rate > 0 {
+		l.local = ratelimit.NewLimiter(cfg.Rate, cfg.Burst)
+	}
+	if cfg.ClusterLimit > 0 {
+		l.cluster = ratelimit.NewWindowLimiter(cfg.ClusterLimit, cfg.ClusterWindow)
+	}
+	return &l
+}
+
+// rateLimited serves requests with h, unless their client is over a limit,
+// in which case they get a 429 with a Retry-After header.
+func (s *Server) rateLimited(h http.Handler) http.Handler {
+	if s.limits == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := s.clients.ClientKey(r)
+
+		limit, ok, wait := "local", true, time.Duration(0)
+		if s.limits.local != nil {
+			ok, wait = s.limits.local.Allow(key)
+		}
+		if ok && s.limits.cluster != nil {
+			limit = "cluster"
+			ok, wait = s.limits.cluster.Allow(key)
+		}
+
+		if !ok {
+			rateLimited.With(limit).Inc()
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+			requestid.Error(w, r, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// syncRateLimits syncs cluster-wide limits with cluster until ctx is done.
+func (s *Server) syncRateLimits(ctx context.Context) {
+	t := time.NewTicker(rateLimitSyncInterval)
+	defer t.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		err := s.limits.cluster.Sync(func(wc ratelimit.WindowCounts) (ratelimit.WindowCounts, error) {
+			return s.syncWindow(ctx, wc)
+		})
+		if err != nil && !failing {
+			logging.Warn("failed to sync rate limits with cluster", logging.Err(err))
+		} else if err == nil && failing {
+			logging.Info("syncing rate limits with cluster again")
+		}
+		failing = err != nil
+	}
+}
+
+// syncWindow adds the counts of wc to cluster's and returns its totals.
+func (s *Server) syncWindow(ctx context.Context, wc ratelimit.WindowCounts) (ratelimit.WindowCounts, error) {
+	var totals ratelimit.WindowCounts
+
+	target := s.httpClusterEndpoint()
+	if target == nil {
+		return totals, errors.New("no http cluster endpoint to sync with")
+	}
+
+	if timeout := s.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	body, err := json.Marshal(wc)
+	if err != nil {
+		return totals, errors.WithStack(err)
+	}
+
+	addr := strings.TrimSuffix(target.String(), "/") + ratelimit.SyncPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewReader(body))
+	if err != nil {
+		return totals, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.signing != nil {
+		if err := s.signing.SignRequest(req, body); err != nil {
+			return totals, err
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return totals, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return totals, errors.WithStack(statusError(resp.StatusCode))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&totals); err != nil {
+		return totals, errors.Wrap(err, "invalid rate limit totals from cluster")
+	}
+	return totals, nil
+}
@@ -1,44 +1,175 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/RoanBrand/RequestCounter/internal/admin"
+	"github.com/RoanBrand/RequestCounter/internal/certs"
 	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/RoanBrand/RequestCounter/internal/ratelimit"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
 	"github.com/pkg/errors"
 )
 
+var (
+	clusterDuration = metrics.NewHistogramVec("cluster_request_duration_seconds", "Latency of requests to cluster endpoints.", metrics.DefBuckets, "endpoint")
+	clusterErrors   = metrics.NewCounterVec("cluster_request_errors_total", "Number of failed requests to cluster endpoints.", "endpoint")
+)
+
 type Server struct {
 	ctx      context.Context
 	s        http.Server
 	db       *db.DB
 	hostName string
+
+	// last cluster count received, used to estimate it when in degraded mode.
+	lastClusterCount uint64
+
+	cluster        *endpoints
+	client         *http.Client
+	clusterTimeout time.Duration // per request to a cluster endpoint, reloadable
+	grpc           grpcConns
+	tcp            tcpClients
+	hedge          *hedging // nil if disabled
+	signing        *signing.Key
+
+	// pending holds increments not yet reported to cluster.
+	// Only set when in degraded mode.
+	pending   *db.DB
+	reconcile chan struct{}
+	// stopReconciler stops the reconciler, which closes reconcilerDone once returned.
+	stopReconciler context.CancelFunc
+	reconcilerDone chan struct{}
+	// batch is the pending increments being reported, if any,
+	// persisted in batchFile until cluster acknowledges them.
+	batch     *pendingBatch
+	batchFile string
+
+	// admin serves debugging endpoints, if enabled.
+	admin *http.Server
+
+	// metrics of this server, served with the package level ones.
+	metrics *metrics.Registry
+
+	// tls serves over TLS, if set.
+	tls *certs.Server
+
+	// clients identifies clients by API key or IP, for limits and quotas.
+	clients ratelimit.Config
+	// limits limits the rate of requests per client, if set.
+	limits *rateLimits
+	// quota holds clients to cluster quotas, if set.
+	quota *quotaConfig
+	// tenants derives the tenant of requests, if set.
+	tenants *tenantConfig
+
+	// time Close waits for in-flight requests to finish.
+	shutdownTimeout time.Duration
 }
 
-func (s *Server) Init(ctx context.Context, listenAddr, dbFilePath string) {
+func (s *Server) Init(ctx context.Context, cfg serverConfig) error {
+	cluster, err := newEndpoints(cfg.ClusterAddrs)
+	if err != nil {
+		return err
+	}
+
+	s.tls = cfg.TLS
+	s.clients = cfg.Clients
+	if cfg.Clients.Enabled() {
+		s.limits = newRateLimits(cfg.Clients)
+	}
+	s.quota = cfg.Quota
+	s.tenants = cfg.Tenants
+	if cfg.HedgePercentile != 0 {
+		s.hedge = newHedging(cfg.HedgePercentile)
+	}
+	s.shutdownTimeout = cfg.ShutdownTimeout
+	clientCfg := cfg.Client
+
+	s.cluster = cluster
+	s.cluster.watchDNS(ctx)
+	s.client = newClusterClient(clientCfg)
+	s.setTimeout(clientCfg.Timeout)
+	s.tcp.poolSize = clientCfg.TCPPoolSize
+	s.tcp.dialTimeout = clientCfg.DialTimeout
+	s.tcp.tls = clientCfg.TLS
+	s.grpc.tls = clientCfg.TLS
+	s.signing = clientCfg.Signing
+	if s.shutdownTimeout == 0 {
+		s.shutdownTimeout = defaultShutdownTimeout
+	}
+
 	hostName, err := os.Hostname()
 	if err != nil {
-		log.Println("could not resolve hostname:", err.Error())
+		logging.Warn("could not resolve hostname", logging.Err(err))
 		// continue as not critical
 	} else {
 		s.hostName = hostName
 	}
 
 	s.ctx = ctx
-	s.db = db.NewDB(dbFilePath)
+	s.db = db.NewDB(cfg.DBFile)
+
+	s.metrics = metrics.NewRegistry()
+	s.metrics.NewCounterFunc("node_requests_total", "Number of requests counted by this instance.", func() float64 {
+		return float64(s.db.Count())
+	})
+	s.metrics.NewGaugeFunc("cluster_count_last", "Last cluster count received.", func() float64 {
+		return float64(atomic.LoadUint64(&s.lastClusterCount))
+	})
+	s.metrics.NewGaugeFunc("cluster_pending_increments", "Increments not yet reported to cluster, in degraded mode.", func() float64 {
+		if s.pending == nil {
+			return 0
+		}
+		return float64(s.pending.Count())
+	})
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.requestHandler)
-	s.s.Handler = mux
+	mux.Handle("/", metrics.InstrumentHandler("count", tracing.Handler("count", logging.AccessLog(true, s.rateLimited(s.quotaLimited(http.HandlerFunc(s.requestHandler)))))))
+	mux.Handle("/watch", metrics.InstrumentHandler("watch", logging.AccessLog(false, s.rateLimited(http.HandlerFunc(s.watchHandler)))))
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.Handle("/metrics", metrics.Handler(s.metrics))
+	s.s.Handler = requestid.Handler(mux)
+	if s.tls != nil {
+		s.s.TLSConfig = s.tls.Config(tls.NoClientCert)
+	}
 
-	s.s.Addr = listenAddr
+	if cfg.Admin.Addr != "" {
+		s.admin, err = admin.NewServer(cfg.Admin, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.limits != nil && s.limits.cluster != nil {
+		go s.syncRateLimits(ctx)
+	}
+
+	if cfg.PendingDBFile != "" {
+		s.EnableDegradedMode(cfg.PendingDBFile)
+	}
+
+	s.s.Addr = cfg.ListenAddr
 
 	s.s.BaseContext = func(_ net.Listener) context.Context {
 		return s.ctx
@@ -46,15 +177,35 @@ func (s *Server) Init(ctx context.Context, listenAddr, dbFilePath string) {
 
 	go func(s *Server) {
 		<-s.ctx.Done()
-		log.Println("stopping server")
+		logging.Info("stopping server")
 		if err := s.Close(); err != nil {
-			log.Println("error stopping server:", err)
+			logging.Error("error stopping server", logging.Err(err))
 		}
 	}(s)
+
+	return nil
 }
 
 func (s *Server) Run() error {
-	err := s.s.ListenAndServe()
+	if s.admin != nil {
+		lis, err := admin.Listen(s.admin)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.admin.Serve(lis); err != nil && err != http.ErrServerClosed {
+				logging.Error("admin server error", logging.Err(err))
+			}
+		}()
+	}
+
+	var err error
+	if s.tls != nil {
+		err = s.s.ListenAndServeTLS("", "")
+	} else {
+		err = s.s.ListenAndServe()
+	}
 	if err == http.ErrServerClosed {
 		return nil
 	}
@@ -62,10 +213,25 @@ func (s *Server) Run() error {
 	return err
 }
 
+// timeout returns the timeout of requests to a cluster endpoint.
+func (s *Server) timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&s.clusterTimeout)))
+}
+
+func (s *Server) setTimeout(d time.Duration) {
+	atomic.StoreInt64((*int64)(&s.clusterTimeout), int64(d))
+}
+
 func (s *Server) Close() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
 	defer cancel()
 
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil {
+			logging.Error("error stopping admin server", logging.Err(err))
+		}
+	}
+
 	err := s.s.Shutdown(ctx)
 	if err != nil {
 		if err == http.ErrServerClosed {
@@ -75,61 +241,320 @@ func (s *Server) Close() error {
 		return err
 	}
 
+	if err := s.grpc.Close(); err != nil {
+		return err
+	}
+	s.tcp.Close()
+
+	if s.pending != nil {
+		// the reconciler must be done with pending before it is closed.
+		s.stopReconciler()
+		<-s.reconcilerDone
+
+		if err := s.pending.Close(); err != nil {
+			return err
+		}
+	}
+
 	return s.db.Close()
 }
 
 func (s *Server) requestHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	t := s.tenantOf(r)
+	if t != nil {
+		ctx = withTenant(ctx, t)
+	}
+	q := quotaFrom(ctx)
+
 	newClusterCount, err := s.makeClusterRequest(ctx)
+	if t != nil {
+		t.setResponseHeaders(w.Header())
+	}
+	if q != nil {
+		q.setResponseHeaders(w.Header())
+	}
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
+		// the tenant's request refused by cluster, or one over its quota.
+		var se statusError
+		if (t != nil || q != nil) && errors.As(err, &se) && se < http.StatusInternalServerError {
+			if se == http.StatusTooManyRequests {
+				rateLimited.With("quota").Inc()
+			}
+			requestid.Error(w, r, http.StatusText(int(se)), int(se))
+			return
+		}
+
+		logging.Ctx(ctx).Error("failed to contact cluster", logging.Err(err))
 		err := errors.WithMessage(err, "failed to contact cluster")
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		// pending increments are of the count only, not of tenants.
+		if s.pending == nil || t != nil {
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.degradedResponse(w)
 		return
 	}
 
+	if t == nil {
+		atomic.StoreUint64(&s.lastClusterCount, newClusterCount)
+	} else {
+		tenantRequests.With(t.resolved()).Inc()
+	}
+	s.notifyReconciler()
+
 	newNodeCount := s.db.IncCount()
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	_, err = fmt.Fprintf(
-		w,
-		"You are talking to instance %s%s.\nThis is request %d to this instance and request %d to the cluster.\n",
-		s.hostName,
-		s.s.Addr,
-		newNodeCount,
-		newClusterCount,
-	)
+	if t != nil {
+		_, err = fmt.Fprintf(
+			w,
+			"You are talking to instance %s%s.\nThis is request %d to this instance and request %d to the cluster for %s.\n",
+			s.hostName,
+			s.s.Addr,
+			newNodeCount,
+			newClusterCount,
+			t.resolved(),
+		)
+	} else {
+		_, err = fmt.Fprintf(
+			w,
+			"You are talking to instance %s%s.\nThis is request %d to this instance and request %d to the cluster.\n",
+			s.hostName,
+			s.s.Addr,
+			newNodeCount,
+			newClusterCount,
+		)
+	}
 	if err != nil {
-		log.Println("error sending response:", err)
+		logging.Ctx(ctx).Warn("error sending response", logging.Err(err))
 	}
 }
 
 // makeClusterRequest makes a request to cluster and
 // returns new count of total requests made to it.
 func (s *Server) makeClusterRequest(ctx context.Context) (uint64, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
-	defer cancel()
+	return s.addClusterCount(ctx, 1)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, clusterAddr, nil)
+// addClusterCount adds delta to the cluster count and returns the new count.
+// It goes to the preferred cluster instance, trying its endpoints in order
+// of preference until one succeeds. With hedging enabled, its next endpoint
+// is also tried if the first one is slow to respond, and the first answer is used.
+// All attempts share an idempotency key so that the delta is counted once by
+// the instance. Cluster instances don't share keys, so attempts never go to
+// another instance, which would count it again.
+// Requests of a tenant or with a quota, in ctx, only go to http endpoints.
+func (s *Server) addClusterCount(ctx context.Context, delta uint64) (uint64, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return 0, err
+	}
+	return s.addClusterCountOnce(ctx, delta, key, "")
+}
+
+// addClusterCountOnce is addClusterCount with the idempotency key given by
+// the caller, which must reuse it to retry the same delta, along with the
+// instance it went to. If instance is empty, the preferred one is used.
+func (s *Server) addClusterCountOnce(ctx context.Context, delta uint64, key, instance string) (count uint64, err error) {
+	ctx, span := tracing.Start(ctx, "addClusterCount", tracing.KindInternal)
+	span.SetAttr("delta", delta)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	eps := s.cluster.ordered()
+	if tenantFrom(ctx) != nil || quotaFrom(ctx) != nil {
+		eps = httpEndpoints(eps)
+	}
+	if len(eps) == 0 {
+		return 0, errors.New("no cluster endpoints available")
+	}
+	if instance == "" {
+		instance = instanceOf(eps[0].addr)
+	}
+	if eps = instanceEndpoints(eps, instance); len(eps) == 0 {
+		return 0, errors.New("no endpoints of cluster instance " + instance)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancels outstanding attempts once done
+
+	type result struct {
+		e       *endpoint
+		count   uint64
+		latency time.Duration
+		err     error
+	}
+
+	results := make(chan result, len(eps))
+	next, inFlight := 0, 0
+	launch := func() bool {
+		if next == len(eps) {
+			return false
+		}
+
+		e := eps[next]
+		next++
+		inFlight++
+
+		go func() {
+			start := time.Now()
+			count, err := s.clusterRequest(ctx, e.addr, delta, key)
+			results <- result{e, count, time.Since(start), err}
+		}()
+		return true
+	}
+
+	launch()
+
+	var hedgeTimer <-chan time.Time
+	if s.hedge != nil && len(eps) > 1 {
+		t := time.NewTimer(s.hedge.delay())
+		defer t.Stop()
+		hedgeTimer = t.C
+	}
+
+	hedged := false
+	var lastErr error
+	for inFlight > 0 {
+		select {
+		case <-hedgeTimer:
+			if launch() {
+				hedged = true
+				hedgeFired.Add(1)
+			}
+
+		case r := <-results:
+			inFlight--
+			clusterDuration.With(r.e.addr).Observe(r.latency.Seconds())
+			if r.err == nil {
+				r.e.success(r.latency)
+				if s.hedge != nil {
+					s.hedge.observe(r.latency)
+				}
+				if hedged && r.e != eps[0] {
+					hedgeWon.Add(1)
+				}
+				return r.count, nil
+			}
+
+			if ctx.Err() != nil {
+				return 0, r.err
+			}
+			clusterErrors.With(r.e.addr).Inc()
+
+			var se statusError
+			if errors.As(r.err, &se) && se < http.StatusInternalServerError {
+				return 0, r.err
+			}
+
+			r.e.failure()
+			logging.Ctx(ctx).Warn("cluster endpoint failed", logging.F("endpoint", r.e.addr), logging.Err(r.err))
+			lastErr = r.err
+
+			if inFlight == 0 {
+				launch()
+			}
+		}
+	}
+
+	return 0, lastErr
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// statusError is an unexpected http status code returned by cluster.
+type statusError int
+
+func (e statusError) Error() string {
+	return "cluster error: " + strconv.Itoa(int(e)) + " " + http.StatusText(int(e))
+}
+
+// clusterRequest adds delta to the count of the cluster endpoint at addr.
+func (s *Server) clusterRequest(ctx context.Context, addr string, delta uint64, idempotencyKey string) (count uint64, err error) {
+	ctx, span := tracing.Start(ctx, "clusterRequest", tracing.KindClient)
+	span.SetAttr("endpoint", addr)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	if timeout := s.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if isGRPCEndpoint(addr) {
+		return s.grpcClusterRequest(ctx, addr, delta, idempotencyKey)
+	}
+
+	if isTCPEndpoint(addr) {
+		return s.tcpClusterRequest(ctx, addr, delta, idempotencyKey)
+	}
+
+	ctx = httptrace.WithClientTrace(ctx, connTrace)
+
+	method, body := http.MethodGet, []byte(nil)
+	if delta != 1 {
+		body = make([]byte, 8)
+		binary.LittleEndian.PutUint64(body, delta)
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, addr, bytes.NewReader(body))
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	t := tenantFrom(ctx)
+	if t != nil {
+		t.setRequestHeaders(req.Header)
+	}
+	q := quotaFrom(ctx)
+	if q != nil {
+		req.Header.Set(quota.Header, q.id)
+	}
+	tracing.Inject(ctx, req.Header)
+	requestid.Inject(ctx, req.Header)
+	if s.signing != nil {
+		if err := s.signing.SignRequest(req, body); err != nil {
+			return 0, err
+		}
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
 
 	defer resp.Body.Close()
 
+	if t != nil {
+		t.answered(resp.Header)
+	}
+	if q != nil {
+		q.answered(resp.Header)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return 0, errors.New("cluster error: " + resp.Status)
+		return 0, errors.WithStack(statusError(resp.StatusCode))
 	}
 
 	b, err := ioutil.ReadAll(resp.Body)
@@ -0,0 +1,828 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/quota"
+	"github.com/RoanBrand/RequestCounter/internal/ratelimit"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+	"github.com/RoanBrand/RequestCounter/internal/tenant"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
+	"github.com/pkg/errors"
+)
+
+func TestDegradedMode(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.pending")
+	os.Remove("test.pending.batch")
+
+	var clusterCount uint64
+	clusterDown, loseReply := true, false
+	seen := make(map[string]bool)
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clusterDown {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+
+		delta := uint64(1)
+		if r.Method == http.MethodPost {
+			b, _ := ioutil.ReadAll(r.Body)
+			delta = binary.LittleEndian.Uint64(b)
+		}
+
+		if key := r.Header.Get("Idempotency-Key"); !seen[key] {
+			seen[key] = true
+			clusterCount += delta
+		}
+		if loseReply {
+			http.Error(w, "lost", http.StatusBadGateway)
+			return
+		}
+		resp := make([]byte, 8)
+		binary.LittleEndian.PutUint64(resp, clusterCount)
+		w.Write(resp)
+	}))
+	defer cluster.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := Server{
+		ctx:     ctx,
+		db:      db.NewDB("test.test"),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+	}
+	s.pending = db.NewDB("test.pending")
+	s.reconcile = make(chan struct{}, 1)
+	s.batchFile = "test.pending.batch"
+	defer os.Remove("test.test")
+	defer os.Remove("test.pending")
+	defer os.Remove("test.pending.batch")
+	defer s.db.Close()
+	defer s.pending.Close()
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		s.requestHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "count is unavailable") {
+			t.Fatalf("expected cluster count to be unavailable, got %q", w.Body.String())
+		}
+	}
+
+	if p := s.pending.Count(); p != 3 {
+		t.Fatalf("expected 3 pending, got %d", p)
+	}
+
+	// cluster counts the batch, but its answer is lost
+	clusterDown, loseReply = false, true
+	if err := s.replayPending(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	if p := s.pending.Count(); p != 3 {
+		t.Fatalf("expected 3 pending, got %d", p)
+	}
+
+	// after a restart the batch is sent again with the same key
+	batch, err := loadPendingBatch(s.batchFile)
+	if err != nil || batch == nil || batch.delta != 3 || batch.instance != "127.0.0.1" {
+		t.Fatalf("expected saved batch of 3 for its instance, got %+v %v", batch, err)
+	}
+	s.batch = batch
+	clusterDown = true
+	s.requestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	clusterDown, loseReply = false, false
+	if err := s.replayPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p := s.pending.Count(); p != 1 {
+		t.Fatalf("expected 1 pending, got %d", p)
+	}
+	if _, err := os.Stat(s.batchFile); !os.IsNotExist(err) {
+		t.Fatalf("expected batch file to be removed, got %v", err)
+	}
+	if err := s.replayPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := s.pending.Count(); p != 0 {
+		t.Fatalf("expected 0 pending, got %d", p)
+	}
+
+	if clusterCount != 4 {
+		t.Fatalf("expected cluster count 4, got %d", clusterCount)
+	}
+
+	w := httptest.NewRecorder()
+	s.requestHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(w.Body.String(), "request 5 to this instance and request 5 to the cluster") {
+		t.Fatalf("unexpected response %q", w.Body.String())
+	}
+}
+
+func TestCloseStopsReconciler(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.pending")
+	os.Remove("test.pending.batch")
+
+	started := make(chan struct{}, 1)
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done() // until the replay is given up
+	}))
+	defer cluster.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := Server{
+		ctx:     ctx,
+		db:      db.NewDB("test.test"),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+	}
+	defer os.Remove("test.test")
+	defer os.Remove("test.pending")
+	defer os.Remove("test.pending.batch")
+
+	s.EnableDegradedMode("test.pending")
+	s.pending.IncCount()
+	s.notifyReconciler()
+	<-started
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch is still pending, to be reported on the next start.
+	pending := db.NewDB("test.pending")
+	defer pending.Close()
+	if p := pending.Count(); p != 1 {
+		t.Fatalf("expected 1 pending, got %d", p)
+	}
+	if batch, err := loadPendingBatch("test.pending.batch"); err != nil || batch == nil || batch.delta != 1 {
+		t.Fatalf("expected saved batch of 1, got %+v %v", batch, err)
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	var badHits, goodHits int
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits++
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodHits++
+		resp := make([]byte, 8)
+		binary.LittleEndian.PutUint64(resp, uint64(goodHits))
+		w.Write(resp)
+	}))
+	defer good.Close()
+
+	cluster, err := newEndpoints(bad.URL + ", " + good.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{ctx: context.Background(), cluster: cluster, client: http.DefaultClient}
+
+	for i := 1; i <= 3; i++ {
+		count, err := s.makeClusterRequest(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != uint64(i) {
+			t.Fatalf("expected %d, got %d", i, count)
+		}
+	}
+
+	// failed endpoint must be backed off after first failure.
+	if badHits != 1 {
+		t.Fatalf("expected 1 request to failed endpoint, got %d", badHits)
+	}
+
+	if o := cluster.ordered(); o[0].addr != good.URL {
+		t.Fatalf("expected %s to be preferred, got %s", good.URL, o[0].addr)
+	}
+}
+
+func TestHedgedClusterRequest(t *testing.T) {
+	slowDone := make(chan struct{})
+	var slowKey, fastKey string
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(slowDone)
+		slowKey = r.Header.Get("Idempotency-Key")
+		<-r.Context().Done() // must be cancelled once fast answers
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastKey = r.Header.Get("Idempotency-Key")
+		resp := make([]byte, 8)
+		binary.LittleEndian.PutUint64(resp, 42)
+		w.Write(resp)
+	}))
+	defer fast.Close()
+
+	s := Server{
+		ctx:     context.Background(),
+		cluster: &endpoints{list: []*endpoint{{addr: slow.URL}, {addr: fast.URL}}},
+		client:  http.DefaultClient,
+		hedge:   newHedging(95),
+	}
+
+	fired := hedgeFired.Value()
+	count, err := s.makeClusterRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 42 {
+		t.Fatalf("expected 42, got %d", count)
+	}
+
+	<-slowDone
+	if slowKey == "" || slowKey != fastKey {
+		t.Fatalf("expected same idempotency key, got %q and %q", slowKey, fastKey)
+	}
+
+	if hedgeFired.Value() != fired+1 {
+		t.Fatal("expected hedge to fire")
+	}
+}
+
+func TestNoFailoverToOtherInstance(t *testing.T) {
+	var requests int
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(make([]byte, 8))
+	}))
+	defer other.Close()
+
+	s := Server{
+		ctx: context.Background(),
+		// another host, so another instance, that doesn't know the key.
+		cluster: &endpoints{list: []*endpoint{{addr: "http://localhost:1"}, {addr: other.URL}}},
+		client:  http.DefaultClient,
+		hedge:   newHedging(95),
+	}
+
+	if _, err := s.makeClusterRequest(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if requests != 0 {
+		t.Fatalf("expected no request to another instance, got %d", requests)
+	}
+
+	// the failed instance is backed off, so the next request goes to the other.
+	if _, err := s.makeClusterRequest(context.Background()); err != nil || requests != 1 {
+		t.Fatalf("expected next request to go to the other instance, got %v after %d", err, requests)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestClusterClientTransport(t *testing.T) {
+	var gotKey string
+	fake := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("expected cluster timeout to be applied")
+		}
+
+		gotKey = r.Header.Get("Idempotency-Key")
+		resp := make([]byte, 8)
+		binary.LittleEndian.PutUint64(resp, 7)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(resp)),
+		}, nil
+	})
+
+	s := Server{
+		ctx:            context.Background(),
+		cluster:        &endpoints{list: []*endpoint{{addr: "http://cluster"}}},
+		client:         &http.Client{Transport: fake},
+		clusterTimeout: time.Second,
+	}
+
+	count, err := s.makeClusterRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 7 {
+		t.Fatalf("expected 7, got %d", count)
+	}
+
+	if gotKey == "" {
+		t.Fatal("expected idempotency key")
+	}
+}
+
+func TestWatchProxy(t *testing.T) {
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/watch" || r.URL.Query().Get("counter") != "a" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"counter\":\"a\",\"count\":1}\n\n"))
+	}))
+	defer cluster.Close()
+
+	s := Server{
+		ctx:     context.Background(),
+		cluster: &endpoints{list: []*endpoint{{addr: "grpc://elsewhere"}, {addr: cluster.URL}}},
+		client:  cluster.Client(),
+	}
+
+	w := httptest.NewRecorder()
+	s.watchHandler(w, httptest.NewRequest(http.MethodGet, "/watch?counter=a", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if body := w.Body.String(); body != "data: {\"counter\":\"a\",\"count\":1}\n\n" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+
+	var counted int
+	clusterReady := true
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" {
+			counted++
+			return
+		}
+		if !clusterReady {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer cluster.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := Server{
+		ctx:     ctx,
+		db:      db.NewDB("test.test"),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+
+	check := func(h http.HandlerFunc, expected int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != expected {
+			t.Fatalf("expected status %d, got %d: %s", expected, w.Code, w.Body)
+		}
+	}
+
+	check(s.healthzHandler, http.StatusOK)
+	check(s.readyzHandler, http.StatusOK)
+
+	clusterReady = false
+	check(s.healthzHandler, http.StatusOK)
+	check(s.readyzHandler, http.StatusServiceUnavailable)
+
+	clusterReady = true
+	cancel()
+	check(s.readyzHandler, http.StatusServiceUnavailable)
+
+	if counted != 0 || s.db.Count() != 0 {
+		t.Fatal("health checks must not count requests")
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	var traceparent string
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(tracing.TraceparentHeader)
+		w.Write(make([]byte, 8))
+	}))
+	defer cluster.Close()
+
+	s := Server{
+		ctx:     context.Background(),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+	}
+
+	incoming, _ := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := tracing.ContextWithRemote(context.Background(), incoming)
+	if _, err := s.makeClusterRequest(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, ok := tracing.ParseTraceparent(traceparent)
+	if !ok {
+		t.Fatalf("expected traceparent to be sent to cluster, got %q", traceparent)
+	}
+	if sc.TraceID != incoming.TraceID || sc.SpanID == incoming.SpanID || !sc.Sampled {
+		t.Fatalf("expected cluster request to continue trace %s, got %s", incoming.Traceparent(), traceparent)
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	var got string
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(requestid.Header)
+		w.Write(make([]byte, 8))
+	}))
+	defer cluster.Close()
+
+	s := Server{
+		ctx:     context.Background(),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+	}
+
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	if _, err := s.makeClusterRequest(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "req-1" {
+		t.Fatalf("expected request id to be sent to cluster, got %q", got)
+	}
+}
+
+func TestSignedClusterRequest(t *testing.T) {
+	key := signing.Key{ID: "k1", Secret: []byte("secret")}
+	var count uint64
+	cluster := httptest.NewServer(signing.NewVerifier([]signing.Key{key}, 0).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delta := uint64(1)
+		if r.Method == http.MethodPost {
+			b, _ := ioutil.ReadAll(r.Body)
+			delta = binary.LittleEndian.Uint64(b)
+		}
+
+		count += delta
+		resp := make([]byte, 8)
+		binary.LittleEndian.PutUint64(resp, count)
+		w.Write(resp)
+	})))
+	defer cluster.Close()
+
+	s := Server{
+		ctx:     context.Background(),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+	}
+
+	var se statusError
+	if _, err := s.makeClusterRequest(context.Background()); !errors.As(err, &se) || se != http.StatusUnauthorized {
+		t.Fatalf("expected unsigned request to be rejected, got %v", err)
+	}
+
+	s.signing = &key
+	if n, err := s.makeClusterRequest(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 1, got %d", n)
+	}
+
+	if n, err := s.addClusterCount(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	} else if n != 6 {
+		t.Fatalf("expected 6, got %d", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	windows := ratelimit.NewWindows()
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == ratelimit.SyncPath {
+			var wc ratelimit.WindowCounts
+			json.NewDecoder(r.Body).Decode(&wc)
+			totals, _ := windows.Add(wc)
+			json.NewEncoder(w).Encode(totals)
+			return
+		}
+		w.Write(make([]byte, 8))
+	}))
+	defer cluster.Close()
+
+	trusted, _ := ratelimit.ParseNetworks("10.0.0.1")
+	s := Server{
+		ctx:     context.Background(),
+		db:      db.NewDB("test.test"),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+		clients: ratelimit.Config{TrustedProxies: trusted},
+		limits: newRateLimits(ratelimit.Config{
+			Rate:          1,
+			Burst:         2,
+			ClusterLimit:  4,
+			ClusterWindow: time.Hour,
+		}),
+	}
+	os.Remove("test.test") // in case previous run failed
+	defer os.Remove("test.test")
+	defer s.db.Close()
+	h := s.rateLimited(http.HandlerFunc(s.requestHandler))
+
+	get := func(remote, xff string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get("10.0.0.1:1000", "1.1.1.1"); w.Code != http.StatusOK {
+			t.Fatalf("expected burst request %d to be allowed, got %d", i, w.Code)
+		}
+	}
+
+	w := get("10.0.0.1:1000", "1.1.1.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if w := get("10.0.0.1:1000", "2.2.2.2"); w.Code != http.StatusOK {
+		t.Fatalf("expected other client behind proxy to be allowed, got %d", w.Code)
+	}
+
+	// another instance has let 2.2.2.2 make 3 requests this window.
+	now := time.Now().Truncate(time.Hour)
+	windows.Add(ratelimit.WindowCounts{Start: now.Unix(), Length: 3600, Counts: map[string]uint64{"ip:2.2.2.2": 3}})
+	if err := s.limits.cluster.Sync(func(wc ratelimit.WindowCounts) (ratelimit.WindowCounts, error) {
+		return s.syncWindow(context.Background(), wc)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	w = get("10.0.0.1:1000", "2.2.2.2")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected cluster-wide limit to be reached, got %d", w.Code)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	var remaining uint64 = 1
+	var quotaRequests, counted int32
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/quota/") {
+			atomic.AddInt32(&quotaRequests, 1)
+		}
+
+		// cluster takes from the quota as it counts the request.
+		if r.Header.Get(quota.Header) == "acme" {
+			u := quota.Usage{Quota: "acme", Limit: 1, Allowed: remaining > 0, Reset: time.Now().Add(time.Minute)}
+			if u.Allowed {
+				remaining--
+			}
+			u.Remaining = remaining
+			quota.SetHeaders(w.Header(), u)
+			if !u.Allowed {
+				http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		atomic.AddInt32(&counted, 1)
+		w.Write(make([]byte, 8))
+	}))
+	defer cluster.Close()
+
+	os.Remove("test.test") // in case previous run failed
+	s := Server{
+		ctx:     context.Background(),
+		db:      db.NewDB("test.test"),
+		cluster: &endpoints{list: []*endpoint{{addr: cluster.URL}}},
+		client:  cluster.Client(),
+		clients: ratelimit.Config{APIKeys: map[string]string{"acme": "k1", "other": "k2"}},
+		quota:   &quotaConfig{PerKey: true},
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+	h := s.quotaLimited(http.HandlerFunc(s.requestHandler))
+
+	get := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if key != "" {
+			r.Header.Set(ratelimit.APIKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("k1"); w.Code != http.StatusOK || w.Header().Get(quota.LimitHeader) != "1" {
+		t.Fatalf("expected request within quota, got %d %v", w.Code, w.Header())
+	}
+
+	w := get("k1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get(quota.RemainingHeader) != "0" || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected exhausted quota, got %d %v", w.Code, w.Header())
+	}
+
+	if w := get("k2"); w.Code != http.StatusOK || w.Header().Get(quota.LimitHeader) != "" {
+		t.Fatalf("expected client without a quota to be served, got %d", w.Code)
+	}
+	if w := get(""); w.Code != http.StatusOK {
+		t.Fatalf("expected client without a key to be served, got %d", w.Code)
+	}
+
+	// the quota is only taken by the increment, once per counted request.
+	if n := atomic.LoadInt32(&quotaRequests); n != 0 {
+		t.Fatalf("expected no separate quota requests, got %d", n)
+	}
+	if n := atomic.LoadInt32(&counted); n != 3 {
+		t.Fatalf("expected 3 requests counted, got %d", n)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(tenant.Header)
+		switch key := r.Header.Get(tenant.KeyHeader); {
+		case key == "k1":
+			id = "acme"
+		case key != "":
+			http.Error(w, "unknown API key", http.StatusUnauthorized)
+			return
+		}
+
+		switch id {
+		case "":
+		case "acme":
+			w.Header().Set(tenant.Header, id)
+			w.Header().Set(quota.RemainingHeader, "0")
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+			return
+		case "beta":
+			w.Header().Set(tenant.Header, id)
+		default:
+			http.Error(w, "tenant not found", http.StatusNotFound)
+			return
+		}
+
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, 7)
+		w.Write(b)
+	}))
+	defer cluster.Close()
+
+	os.Remove("test.test") // in case previous run failed
+	s := Server{
+		ctx: context.Background(),
+		db:  db.NewDB("test.test"),
+		// tenants are only sent to http endpoints, others fail over to it.
+		cluster: &endpoints{list: []*endpoint{{addr: "grpc://127.0.0.1:1"}, {addr: cluster.URL}}},
+		client:  cluster.Client(),
+		tenants: &tenantConfig{KeyHeader: "X-Client-Key", HostSuffix: ".counter.test"},
+	}
+	defer os.Remove("test.test")
+	defer s.db.Close()
+
+	get := func(host, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if key != "" {
+			r.Header.Set("X-Client-Key", key)
+		}
+		w := httptest.NewRecorder()
+		s.requestHandler(w, r)
+		return w
+	}
+
+	if w := get("beta.counter.test:8080", ""); w.Code != http.StatusOK || w.Header().Get(tenant.Header) != "beta" ||
+		!strings.Contains(w.Body.String(), "request 7 to the cluster for beta") {
+		t.Fatalf("expected request of beta by host, got %d %s", w.Code, w.Body)
+	}
+	if w := get("beta.counter.test", "k1"); w.Code != http.StatusTooManyRequests || w.Header().Get(quota.RemainingHeader) != "0" ||
+		w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected acme by key to be over quota, got %d %v", w.Code, w.Header())
+	}
+	if w := get("localhost", "nope"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unknown key to be refused, got %d", w.Code)
+	}
+	if w := get("other.counter.test", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown tenant, got %d", w.Code)
+	}
+	if w := get("localhost", ""); w.Code != http.StatusOK || w.Header().Get(tenant.Header) != "" ||
+		!strings.Contains(w.Body.String(), "request 7 to the cluster.") {
+		t.Fatalf("expected request without tenant, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	load := func(args ...string) *config.Config {
+		cfg, err := config.Load(flag.NewFlagSet("test", flag.ContinueOnError), args, allSettings...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	cluster, err := newEndpoints("http://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{
+		ctx:     context.Background(),
+		cluster: cluster,
+		limits:  newRateLimits(ratelimit.Config{Rate: 1}),
+	}
+	s.setTimeout(time.Second * 5)
+
+	prev := load("-cluster-addr", "http://a", "-rate-limit", "1")
+	next := load("-cluster-addr", "http://b, http://a", "-cluster-timeout", "1s", "-rate-limit", "3")
+	if err := s.applyConfig(prev, next); err != nil {
+		t.Fatal(err)
+	}
+
+	if eps := s.cluster.ordered(); len(eps) != 2 || eps[0].addr != "http://b" || eps[1].addr != "http://a" {
+		t.Fatalf("expected cluster addresses to be updated, got %v", eps)
+	}
+	if s.timeout() != time.Second {
+		t.Fatalf("expected cluster timeout of 1s, got %v", s.timeout())
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := s.limits.local.Allow("client"); !ok {
+			t.Fatalf("expected request %d to be allowed by the new burst", i)
+		}
+	}
+
+	if err := s.applyConfig(next, load("-cluster-addr", "http://a")); err == nil {
+		t.Fatal("expected disabling rate limits to need a restart")
+	}
+
+	before := s.timeout()
+	for _, timeout := range []string{"0s", "-1s"} {
+		bad := load("-cluster-addr", "http://b, http://a", "-cluster-timeout", timeout, "-rate-limit", "3")
+		if err := s.applyConfig(next, bad); err == nil || s.timeout() != before {
+			t.Fatalf("expected cluster timeout %s to be refused, got %v with timeout %v", timeout, err, s.timeout())
+		}
+	}
+}
+
+func TestInitDegradedMode(t *testing.T) {
+	for _, f := range []string{"test.test", "test.pending", "test.pending.batch"} {
+		os.Remove(f) // in case previous run failed
+		defer os.Remove(f)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var s Server
+	cfg := serverConfig{
+		ListenAddr:      "127.0.0.1:0",
+		DBFile:          "test.test",
+		ClusterAddrs:    "http://127.0.0.1:1",
+		PendingDBFile:   "test.pending",
+		ShutdownTimeout: time.Second,
+	}
+	if err := s.Init(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s.pending == nil {
+		t.Fatal("expected Init to enable degraded mode")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/tcpproto"
+)
+
+// tcpScheme marks cluster endpoints that are reached over cluster's
+// raw TCP protocol instead of http, e.g. "tcp://cluster:10083".
+const tcpScheme = "tcp://"
+
+func isTCPEndpoint(addr string) bool {
+	return strings.HasPrefix(addr, tcpScheme)
+}
+
+// tcpClients holds a pooled client per TCP cluster endpoint.
+type tcpClients struct {
+	poolSize    int
+	dialTimeout time.Duration
+	tls         *tls.Config // nil for plain TCP
+
+	mu      sync.Mutex
+	clients map[string]*tcpproto.Client
+}
+
+func (t *tcpClients) client(addr string) *tcpproto.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.clients[addr]; ok {
+		return c
+	}
+
+	if t.clients == nil {
+		t.clients = make(map[string]*tcpproto.Client)
+	}
+
+	c := tcpproto.NewClient(addr, t.poolSize, t.dialTimeout, t.tls)
+	t.clients[addr] = c
+	return c
+}
+
+func (t *tcpClients) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for addr, c := range t.clients {
+		c.Close()
+		delete(t.clients, addr)
+	}
+	return nil
+}
+
+// tcpClusterRequest adds delta to the count of the TCP cluster endpoint at addr.
+func (s *Server) tcpClusterRequest(ctx context.Context, addr string, delta uint64, idempotencyKey string) (uint64, error) {
+	return s.tcp.client(strings.TrimPrefix(addr, tcpScheme)).Increment(ctx, delta, idempotencyKey)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/tenant"
+	"github.com/pkg/errors"
+)
+
+var tenantRequests = metrics.NewCounterVec("tenant_requests_total", "Number of requests counted per tenant.", "tenant")
+
+// tenantConfig derives the tenant of requests, counted by cluster
+// in the tenant's own namespace.
+type tenantConfig struct {
+	// KeyHeader is the header with a tenant's API key, resolved by cluster.
+	KeyHeader string
+	// HostSuffix is the domain under which the first label of the host
+	// is the tenant id, e.g. ".counter.example.com" for acme.counter.example.com.
+	HostSuffix string
+}
+
+// tenantConfigFrom returns the tenant config of TENANT_KEY_HEADER
+// and TENANT_HOST_SUFFIX, or nil if there are no tenants.
+func tenantConfigFrom(get config.Getter) (*tenantConfig, error) {
+	c := tenantConfig{
+		KeyHeader:  get("TENANT_KEY_HEADER"),
+		HostSuffix: strings.ToLower(get("TENANT_HOST_SUFFIX")),
+	}
+	if c.HostSuffix != "" && !strings.HasPrefix(c.HostSuffix, ".") {
+		return nil, errors.New("TENANT_HOST_SUFFIX must start with a dot")
+	}
+
+	if c.KeyHeader == "" && c.HostSuffix == "" {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// tenantRequest is the tenant a request is counted for,
+// and what cluster answered about it.
+type tenantRequest struct {
+	key, id string // as derived from the request, one of them set
+
+	mu     sync.Mutex
+	tenant string      // as resolved by cluster
+	header http.Header // quota headers of cluster's answer
+}
+
+// tenantOf returns the tenant of r, by the API key in the key header,
+// otherwise by the host, or nil if it has none.
+func (s *Server) tenantOf(r *http.Request) *tenantRequest {
+	if s.tenants == nil {
+		return nil
+	}
+
+	if s.tenants.KeyHeader != "" {
+		if key := r.Header.Get(s.tenants.KeyHeader); key != "" {
+			return &tenantRequest{key: key}
+		}
+	}
+
+	if s.tenants.HostSuffix != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if id := strings.TrimSuffix(host, s.tenants.HostSuffix); id != host && id != "" && !strings.Contains(id, ".") {
+			return &tenantRequest{id: id}
+		}
+	}
+	return nil
+}
+
+// setRequestHeaders selects the tenant in a request to cluster.
+func (t *tenantRequest) setRequestHeaders(h http.Header) {
+	if t.key != "" {
+		h.Set(tenant.KeyHeader, t.key)
+	} else {
+		h.Set(tenant.Header, t.id)
+	}
+}
+
+// answered records the tenant and quota headers of cluster's response.
+func (t *tenantRequest) answered(h http.Header) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tenant = h.Get(tenant.Header)
+	t.header = quotaHeaders(h)
+}
+
+// setResponseHeaders relays the tenant and quota headers of cluster's answer.
+func (t *tenantRequest) setResponseHeaders(h http.Header) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tenant != "" {
+		h.Set(tenant.Header, t.tenant)
+	}
+	for k, v := range t.header {
+		h[k] = v
+	}
+}
+
+func (t *tenantRequest) resolved() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.tenant
+}
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, t *tenantRequest) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// tenantFrom returns the tenant of a request to count, nil if it has none.
+func tenantFrom(ctx context.Context) *tenantRequest {
+	t, _ := ctx.Value(tenantKey{}).(*tenantRequest)
+	return t
+}
+
+// stripTenantHeaders removes the headers selecting a tenant from a request
+// to cluster, so that clients can't select one other than derived for them.
+func stripTenantHeaders(h http.Header) {
+	h.Del(tenant.KeyHeader)
+	h.Del(tenant.Header)
+}
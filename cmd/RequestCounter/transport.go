@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/signing"
+)
+
+var (
+	clusterConnsNew    = expvar.NewInt("cluster_conns_new")
+	clusterConnsReused = expvar.NewInt("cluster_conns_reused")
+)
+
+// clientConfig configures the http client used to talk to cluster.
+type clientConfig struct {
+	Timeout             time.Duration // per request to a cluster endpoint
+	DialTimeout         time.Duration
+	KeepAlive           time.Duration
+	TLSHandshakeTimeout time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int // 0 means no limit
+	HTTP2               bool
+	TCPPoolSize         int // connections per tcp:// endpoint
+	// TLS connects to https:// endpoints, and to gRPC
+	// and TCP endpoints if set, presenting a client certificate if it has one.
+	TLS *tls.Config
+	// Signing signs http and gRPC requests, if set.
+	Signing *signing.Key
+}
+
+func defaultClientConfig() clientConfig {
+	return clientConfig{
+		Timeout:             time.Second * 5,
+		DialTimeout:         time.Second * 2,
+		KeepAlive:           time.Second * 30,
+		TLSHandshakeTimeout: time.Second * 5,
+		IdleConnTimeout:     time.Second * 90,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		HTTP2:               true,
+		TCPPoolSize:         4,
+	}
+}
+
+// newClusterClient returns a http client with its own connection pool.
+// Since every request goes to a handful of cluster endpoints,
+// the idle pool per host is much larger than http.DefaultTransport's 2.
+func newClusterClient(c clientConfig) *http.Client {
+	d := net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}
+
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           d.DialContext,
+		ForceAttemptHTTP2:     c.HTTP2,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       c.TLS,
+	}
+
+	if !c.HTTP2 {
+		// a non-nil empty map disables http2.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return &http.Client{Transport: t}
+}
+
+// connTrace records whether connections to cluster get reused.
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		if info.Reused {
+			clusterConnsReused.Add(1)
+		} else {
+			clusterConnsNew.Add(1)
+		}
+	},
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+)
+
+// watchHandler proxies counter change streams, Server-Sent Events or
+// WebSocket, from the /watch endpoint of the preferred http cluster endpoint.
+// Requests of a tenant watch the counters of its namespace.
+func (s *Server) watchHandler(w http.ResponseWriter, r *http.Request) {
+	target := s.httpClusterEndpoint()
+	if target == nil {
+		requestid.Error(w, r, "no http cluster endpoint to watch", http.StatusBadGateway)
+		return
+	}
+
+	t := s.tenantOf(r)
+
+	proxy := httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + "/watch"
+			req.Host = target.Host
+			stripTenantHeaders(req.Header)
+			if t != nil {
+				t.setRequestHeaders(req.Header)
+			}
+			requestid.Inject(req.Context(), req.Header)
+			if s.signing != nil {
+				if err := s.signing.SignRequest(req, nil); err != nil {
+					logging.Ctx(req.Context()).Error("failed to sign watch request", logging.Err(err))
+				}
+			}
+		},
+		Transport:     s.client.Transport,
+		FlushInterval: -1, // stream updates as they come
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+// httpClusterEndpoint returns the preferred http cluster endpoint, or nil if there is none.
+func (s *Server) httpClusterEndpoint() *url.URL {
+	for _, e := range httpEndpoints(s.cluster.ordered()) {
+		if u, err := url.Parse(e.addr); err == nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// httpEndpoints returns the http endpoints of eps, in the same order.
+func httpEndpoints(eps []*endpoint) []*endpoint {
+	var h []*endpoint
+	for _, e := range eps {
+		if !isGRPCEndpoint(e.addr) && !isTCPEndpoint(e.addr) {
+			h = append(h, e)
+		}
+	}
+	return h
+}
@@ -0,0 +1,191 @@
+// Package admin serves debugging endpoints, pprof profiles, expvar vars
+// and build info, and an authenticated admin API, on a listener separate
+// from the public one.
+package admin
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/certs"
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/pkg/errors"
+)
+
+var started = time.Now()
+
+// Addr returns addr, bound to localhost if it has no host,
+// so that the admin endpoints are not exposed by accident.
+func Addr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// Config configures the admin listener.
+type Config struct {
+	// Addr to listen on, disabled if empty. See Addr.
+	Addr string
+	// Tokens are the accepted bearer tokens, by the name of who uses them.
+	Tokens map[string]string
+	// CertFile and KeyFile serve over TLS, reloaded when they change.
+	// Client certificates signed by ClientCAFile are then accepted instead of a token.
+	CertFile, KeyFile, ClientCAFile string
+}
+
+// Settings configure the admin listener, see ConfigFrom.
+var Settings = []config.Setting{
+	{Name: "ADMIN_ADDR", Usage: "address of the admin listener, disabled if not set"},
+	{Name: "ADMIN_TOKENS", Usage: "comma separated name:token pairs accepted as bearer tokens", Secret: true},
+	{Name: "ADMIN_TLS_CERT", Usage: "certificate file to serve the admin listener over TLS"},
+	{Name: "ADMIN_TLS_KEY", Usage: "key file of ADMIN_TLS_CERT"},
+	{Name: "ADMIN_CLIENT_CA", Usage: "CA file of admin client certificates to accept"},
+}
+
+// ConfigFrom returns the config of Settings.
+func ConfigFrom(get config.Getter) (Config, error) {
+	c := Config{
+		Addr:         get("ADMIN_ADDR"),
+		CertFile:     get("ADMIN_TLS_CERT"),
+		KeyFile:      get("ADMIN_TLS_KEY"),
+		ClientCAFile: get("ADMIN_CLIENT_CA"),
+	}
+
+	if v := get("ADMIN_TOKENS"); v != "" {
+		c.Tokens = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			name, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || name == "" || token == "" {
+				return c, errors.New("ADMIN_TOKENS: expected name:token pairs")
+			}
+			c.Tokens[name] = token
+		}
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return c, errors.New("ADMIN_TLS_CERT and ADMIN_TLS_KEY must be set together")
+	}
+	if c.ClientCAFile != "" && c.CertFile == "" {
+		return c, errors.New("ADMIN_CLIENT_CA requires ADMIN_TLS_CERT and ADMIN_TLS_KEY")
+	}
+	return c, nil
+}
+
+// authEnabled reports whether requests can be authenticated.
+func (c Config) authEnabled() bool {
+	return len(c.Tokens) > 0 || c.ClientCAFile != ""
+}
+
+// NewServer returns the admin server for cfg, serving the mux of NewMux
+// and api under /admin/. If cfg can authenticate requests, all of it
+// requires authentication. Otherwise only the debugging endpoints are
+// served, as the api would be open to anyone who can reach the listener.
+func NewServer(cfg Config, api http.Handler) (*http.Server, error) {
+	mux := NewMux()
+	if api != nil {
+		if !cfg.authEnabled() {
+			api = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestid.Error(w, r, "admin API disabled, set ADMIN_TOKENS or ADMIN_CLIENT_CA", http.StatusForbidden)
+			})
+		}
+		mux.Handle("/admin/", metrics.InstrumentHandler("admin", logging.AccessLog(false, api)))
+	}
+
+	var h http.Handler = mux
+	if cfg.authEnabled() {
+		h = authenticate(cfg.Tokens, h)
+	}
+
+	srv := &http.Server{Addr: Addr(cfg.Addr), Handler: requestid.Handler(h)}
+	if cfg.CertFile != "" {
+		server, err := certs.LoadServer(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// tokens still work without a certificate.
+		srv.TLSConfig = server.Config(tls.VerifyClientCertIfGiven)
+	}
+	return srv, nil
+}
+
+// Listen listens on the address of srv, with TLS if configured.
+func Listen(srv *http.Server) (net.Listener, error) {
+	lis, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if srv.TLSConfig != nil {
+		lis = tls.NewListener(lis, srv.TLSConfig)
+	}
+	return lis, nil
+}
+
+// NewMux returns a mux serving:
+//
+//	/debug/pprof/  pprof profiles
+//	/debug/vars    expvar vars, including db and flusher stats
+//	/buildinfo     version, vcs and go build info as JSON
+//
+// More admin endpoints can be added to it.
+func NewMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/buildinfo", buildInfoHandler)
+	return mux
+}
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Path      string            `json:"path"`
+	Version   string            `json:"version"`
+	GoVersion string            `json:"go_version"`
+	Settings  map[string]string `json:"settings,omitempty"` // e.g. vcs.revision, vcs.time
+	Started   time.Time         `json:"started"`
+}
+
+// ReadBuildInfo returns the build info embedded in the binary.
+func ReadBuildInfo() BuildInfo {
+	bi := BuildInfo{GoVersion: runtime.Version(), Started: started}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return bi
+	}
+
+	bi.Path = info.Main.Path
+	bi.Version = info.Main.Version
+	bi.Settings = make(map[string]string, len(info.Settings))
+	for _, s := range info.Settings {
+		bi.Settings[s.Key] = s.Value
+	}
+	return bi
+}
+
+func buildInfoHandler(w http.ResponseWriter, _ *http.Request) {
+	WriteJSON(w, http.StatusOK, ReadBuildInfo())
+}
+
+// WriteJSON replies with v as JSON.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
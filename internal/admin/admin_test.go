@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddr(t *testing.T) {
+	tests := map[string]string{
+		":6060":          "127.0.0.1:6060",
+		"0.0.0.0:6060":   "0.0.0.0:6060",
+		"localhost:6060": "localhost:6060",
+		"[::1]:6060":     "[::1]:6060",
+		"not an address": "not an address",
+	}
+	for in, want := range tests {
+		if got := Addr(in); got != want {
+			t.Errorf("Addr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMux(t *testing.T) {
+	mux := NewMux()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/buildinfo"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, w.Code)
+		}
+
+		if path == "/buildinfo" {
+			var bi BuildInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &bi); err != nil {
+				t.Fatal(err)
+			}
+			if bi.GoVersion == "" || bi.Started.IsZero() {
+				t.Fatalf("expected go version and start time, got %+v", bi)
+			}
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Who(r.Context())))
+	})
+
+	do := func(srv *http.Server, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// without a way to authenticate, only debugging endpoints are served.
+	srv, err := NewServer(Config{Addr: ":6060"}, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Addr != "127.0.0.1:6060" {
+		t.Fatalf("expected localhost address, got %s", srv.Addr)
+	}
+	if w := do(srv, "/admin/x", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected api to be disabled, got %d", w.Code)
+	}
+	if w := do(srv, "/buildinfo", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected build info, got %d", w.Code)
+	}
+
+	srv, err = NewServer(Config{Tokens: map[string]string{"alice": "a", "bob": "b"}}, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/admin/x", "/buildinfo"} {
+		if w := do(srv, path, ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("%s: expected 401, got %d", path, w.Code)
+		}
+	}
+	if w := do(srv, "/admin/x", "b"); w.Code != http.StatusOK || w.Body.String() != "bob" {
+		t.Fatalf("expected bob to be authenticated, got %d %q", w.Code, w.Body.String())
+	}
+}
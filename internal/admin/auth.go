@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/certs"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+)
+
+type whoKey struct{}
+
+// Who returns who made the authenticated request of ctx:
+// the name of its bearer token, or the common name of its client certificate.
+func Who(ctx context.Context) string {
+	who, _ := ctx.Value(whoKey{}).(string)
+	return who
+}
+
+// authenticate serves only requests to h with one of tokens, by name,
+// as bearer token, or with a client certificate verified by the listener.
+func authenticate(tokens map[string]string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, ok := certs.VerifiedClient(r.TLS)
+		if ok {
+			who = "cert:" + who
+		} else if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+			who, ok = CheckToken(tokens, token)
+		}
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			requestid.Error(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), whoKey{}, who)
+		ctx = logging.ContextWith(ctx, logging.F("admin", who))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CheckToken returns the name of token, comparing it to
+// every token in constant time to not leak them by timing.
+func CheckToken(tokens map[string]string, token string) (string, bool) {
+	var who string
+	found := 0
+	for name, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			who = name
+			found = 1
+		}
+	}
+	return who, found == 1
+}
@@ -0,0 +1,240 @@
+// Package certs loads TLS certificates and CAs from files, and reloads
+// them when the files change, so certificates can be rotated without
+// restarting the services.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// checkInterval is how often the files are checked for changes, at most.
+var checkInterval = time.Second * 10
+
+// watched is a value loaded from files, reloaded when needed if they changed.
+type watched struct {
+	files []string
+	load  func() (interface{}, error)
+
+	mu      sync.Mutex
+	v       interface{}
+	mod     []time.Time
+	checked time.Time
+}
+
+func newWatched(load func() (interface{}, error), files ...string) (*watched, error) {
+	w := &watched{files: files, load: load}
+	w.mod = w.modTimes()
+
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	w.v = v
+	w.checked = time.Now()
+	return w, nil
+}
+
+func (w *watched) modTimes() []time.Time {
+	mod := make([]time.Time, len(w.files))
+	for i, f := range w.files {
+		if fi, err := os.Stat(f); err == nil {
+			mod[i] = fi.ModTime()
+		}
+	}
+	return mod
+}
+
+// get returns the value, reloading it first if the files changed since it
+// was loaded. If reloading fails, the previous value is kept.
+func (w *watched) get() interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if time.Since(w.checked) < checkInterval {
+		return w.v
+	}
+	w.checked = time.Now()
+
+	mod := w.modTimes()
+	changed := false
+	for i := range mod {
+		if !mod[i].Equal(w.mod[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return w.v
+	}
+
+	v, err := w.load()
+	if err != nil {
+		// maybe caught halfway through a rotation, try again later.
+		logging.Warn("unable to reload certificates, keeping previous", logging.F("files", w.files), logging.Err(err))
+		return w.v
+	}
+
+	logging.Info("reloaded certificates", logging.F("files", w.files))
+	w.v, w.mod = v, mod
+	return v
+}
+
+// Cert is a certificate and key, reloaded when their files change.
+type Cert struct {
+	w *watched
+}
+
+func LoadCert(certFile, keyFile string) (*Cert, error) {
+	w, err := newWatched(func() (interface{}, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load certificate "+certFile)
+		}
+		return &cert, nil
+	}, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Cert{w}, nil
+}
+
+func (c *Cert) get() *tls.Certificate {
+	return c.w.get().(*tls.Certificate)
+}
+
+// GetCertificate is for tls.Config.GetCertificate, to serve the certificate.
+func (c *Cert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.get(), nil
+}
+
+// GetClientCertificate is for tls.Config.GetClientCertificate,
+// to present the certificate as a client.
+func (c *Cert) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.get(), nil
+}
+
+// Pool is a pool of CA certificates, reloaded when its file changes.
+type Pool struct {
+	w *watched
+}
+
+func LoadPool(caFile string) (*Pool, error) {
+	w, err := newWatched(func() (interface{}, error) {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read CA "+caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + caFile)
+		}
+		return pool, nil
+	}, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Pool{w}, nil
+}
+
+func (p *Pool) Get() *x509.CertPool {
+	return p.w.get().(*x509.CertPool)
+}
+
+// Server is the certificate of a server, and the CA of
+// client certificates it verifies, if any.
+type Server struct {
+	cert      *Cert
+	clientCAs *Pool
+}
+
+// LoadServer loads the certificate and key files,
+// and the client CA file if set.
+func LoadServer(certFile, keyFile, clientCAFile string) (*Server, error) {
+	cert, err := LoadCert(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{cert: cert}
+	if clientCAFile != "" {
+		if s.clientCAs, err = LoadPool(clientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// VerifiesClients reports whether client certificates are verified.
+func (s *Server) VerifiesClients() bool {
+	return s.clientCAs != nil
+}
+
+// Config returns the config to serve TLS with. If client certificates are
+// verified, clientAuth is how, by default they are required.
+func (s *Server) Config(clientAuth tls.ClientAuthType) *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: s.cert.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if s.clientCAs == nil {
+		return cfg
+	}
+
+	if clientAuth == tls.NoClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	cfg.ClientAuth = clientAuth
+	cfg.ClientCAs = s.clientCAs.Get()
+
+	// the client CAs are only read from the config of each handshake.
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := cfg.Clone()
+		c.ClientCAs = s.clientCAs.Get()
+		c.GetConfigForClient = nil
+		return c, nil
+	}
+	return cfg
+}
+
+// VerifiedClient returns the common name of the verified
+// client certificate of a connection, if any.
+func VerifiedClient(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// ClientConfig returns the config to connect with TLS, verifying servers
+// with caFile, or the system CAs if not set, and presenting the client
+// certificate of certFile and keyFile, if set.
+// The CA is not reloaded, as it is rotated much less often than certificates.
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := LoadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool.Get()
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := LoadCert(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = cert.GetClientCertificate
+	}
+	return cfg, nil
+}
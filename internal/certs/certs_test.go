@@ -0,0 +1,135 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type issued struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate for cn signed by ca, or self signed if nil,
+// and writes it and its key to cn.crt and cn.key in dir.
+func issue(t *testing.T, dir, cn string, serial int64, ca *issued, usage x509.ExtKeyUsage) *issued {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(file, typ string, b []byte) {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(cn+".crt", "CERTIFICATE", der)
+	write(cn+".key", "EC PRIVATE KEY", keyDER)
+	return &issued{cert, key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	defer func(d time.Duration) { checkInterval = d }(checkInterval)
+	checkInterval = 0
+
+	ca := issue(t, dir, "ca", 1, nil, 0)
+	issue(t, dir, "server", 2, ca, x509.ExtKeyUsageServerAuth)
+	issue(t, dir, "client", 3, ca, x509.ExtKeyUsageClientAuth)
+
+	server, err := LoadServer(file("server.crt"), file("server.key"), file("ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _ := VerifiedClient(r.TLS)
+		io.WriteString(w, client)
+	}))
+	ts.TLS = server.Config(tls.NoClientCert)
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(cfg *tls.Config) (string, *x509.Certificate, error) {
+		c := http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := c.Get(ts.URL)
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), resp.TLS.PeerCertificates[0], nil
+	}
+
+	cfg, err := ClientConfig(file("ca.crt"), file("client.crt"), file("client.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, cert, err := get(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != "client" || cert.SerialNumber.Int64() != 2 {
+		t.Fatalf("expected verified client and server certificate 2, got %q and %d", client, cert.SerialNumber)
+	}
+
+	noCert, _ := ClientConfig(file("ca.crt"), "", "", "")
+	if _, _, err := get(noCert); err == nil {
+		t.Fatal("expected client without certificate to be refused")
+	}
+
+	// rotate the server certificate.
+	time.Sleep(10 * time.Millisecond) // for a different mod time
+	issue(t, dir, "server", 4, ca, x509.ExtKeyUsageServerAuth)
+	cfg, _ = ClientConfig(file("ca.crt"), file("client.crt"), file("client.key"), "")
+	if _, cert, err = get(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cert.SerialNumber.Int64() != 4 {
+		t.Fatalf("expected rotated server certificate 4, got %d", cert.SerialNumber)
+	}
+}
@@ -0,0 +1,255 @@
+// Package config resolves the settings of a command from, in order of
+// precedence, command line flags, environment variables, a config file
+// and defaults, and checks them at startup.
+//
+// A setting is named by its environment variable, e.g. LISTEN_ADDR.
+// Its flag is the name in lower case with hyphens, e.g. -listen-addr,
+// and its key in a config file either of them, or with underscores.
+//
+// Settings marked Reloadable can be changed without a restart by changing
+// the environment or config file and reloading, see Reload and Watch.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileEnv is the environment variable naming the config file,
+// if the -config flag is not given.
+const FileEnv = "CONFIG_FILE"
+
+// Kind is the type of the value of a setting, checked when loading.
+type Kind int
+
+const (
+	String Kind = iota
+	Bool
+	Int
+	Float
+	Duration
+)
+
+func (k Kind) check(v string) error {
+	var err error
+	switch k {
+	case Bool:
+		_, err = strconv.ParseBool(v)
+	case Int:
+		_, err = strconv.ParseInt(v, 10, 64)
+	case Float:
+		_, err = strconv.ParseFloat(v, 64)
+	case Duration:
+		_, err = time.ParseDuration(v)
+	}
+	if err != nil {
+		return errors.Errorf("invalid %s %q", k, v)
+	}
+	return nil
+}
+
+func (k Kind) String() string {
+	switch k {
+	case Bool:
+		return "bool"
+	case Int:
+		return "integer"
+	case Float:
+		return "number"
+	case Duration:
+		return "duration"
+	default:
+		return "string"
+	}
+}
+
+// Setting is a setting of a command.
+type Setting struct {
+	Name    string
+	Kind    Kind
+	Default string
+	Usage   string
+	// Secret settings are redacted when printed.
+	Secret bool
+	// Reloadable settings are applied by Reload, others need a restart.
+	Reloadable bool
+}
+
+// Flag returns the name of the setting's flag.
+func (s Setting) Flag() string {
+	return strings.ReplaceAll(strings.ToLower(s.Name), "_", "-")
+}
+
+// Getter returns the value of the setting called name, empty if not set.
+type Getter func(name string) string
+
+// Sources of values, in increasing order of precedence.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+type value struct {
+	v      string
+	source string
+}
+
+// Config is the resolved settings of a command.
+type Config struct {
+	settings []Setting
+	values   map[string]value
+	flags    map[string]string // values of flags given, by setting name
+
+	// File is the config file read, if any.
+	File string
+	// Print is set if -print-config was given, to print the config and exit.
+	Print bool
+}
+
+// Errors are all the problems found with a config.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Load registers settings as flags of fs, along with -config and -print-config,
+// parses args with it, and resolves the value of each setting.
+// Environment variables that are set but empty are taken as not set.
+// All values that are not of the kind of their setting, and unknown
+// settings in the config file, are returned as Errors along with the
+// Config, so that callers can report the rest of its problems with them.
+func Load(fs *flag.FlagSet, args []string, settings ...[]Setting) (*Config, error) {
+	c := Config{values: make(map[string]value)}
+	for _, group := range settings {
+		c.settings = append(c.settings, group...)
+	}
+
+	flags := make(map[string]*string, len(c.settings))
+	for _, s := range c.settings {
+		usage := s.Usage + " (env " + s.Name + ")"
+		flags[s.Name] = fs.String(s.Flag(), s.Default, usage)
+	}
+	file := fs.String("config", "", "read settings from JSON, YAML or TOML `file` (env "+FileEnv+")")
+	fs.BoolVar(&c.Print, "print-config", false, "print the resolved settings, with secrets redacted, and exit")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	c.File = *file
+	if !set["config"] {
+		c.File = os.Getenv(FileEnv)
+	}
+
+	c.flags = make(map[string]string)
+	for _, s := range c.settings {
+		if set[s.Flag()] {
+			c.flags[s.Name] = *flags[s.Name]
+		}
+	}
+
+	if err := c.resolve(); err != nil {
+		if _, ok := err.(Errors); ok {
+			return &c, err
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// resolve sets the value of each setting from its flag,
+// the environment, the config file or its default.
+func (c *Config) resolve() error {
+	var fromFile map[string]string
+	var errs Errors
+	if c.File != "" {
+		var err error
+		if fromFile, err = readFile(c.File); err != nil {
+			return err
+		}
+	}
+
+	known := make(map[string]bool, len(c.settings))
+	for _, s := range c.settings {
+		known[s.Name] = true
+
+		v := value{s.Default, SourceDefault}
+		if f, ok := fromFile[s.Name]; ok && f != "" {
+			v = value{f, SourceFile}
+		}
+		if e := os.Getenv(s.Name); e != "" {
+			v = value{e, SourceEnv}
+		}
+		if f, ok := c.flags[s.Name]; ok {
+			v = value{f, SourceFlag}
+		}
+
+		if v.v != "" {
+			if err := s.Kind.check(v.v); err != nil {
+				errs = append(errs, errors.WithMessage(err, s.Name+" from "+v.source))
+			}
+		}
+		c.values[s.Name] = v
+	}
+
+	for name := range fromFile {
+		if !known[name] {
+			errs = append(errs, errors.New("unknown setting "+name+" in "+c.File))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Get returns the value of the setting called name, empty if not set.
+// It panics if there is no such setting, which is a programming error.
+func (c *Config) Get(name string) string {
+	v, ok := c.values[name]
+	if !ok {
+		panic("config: unknown setting " + name)
+	}
+	return v.v
+}
+
+// Source returns where the value of the setting called name came from.
+func (c *Config) Source(name string) string {
+	return c.values[name].source
+}
+
+// Write writes the settings as NAME=value lines with their source,
+// in the order they were given to Load. Secrets are redacted.
+func (c *Config) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if c.File != "" {
+		fmt.Fprintf(tw, "# config file %s\n", c.File)
+	}
+	for _, s := range c.settings {
+		v := c.values[s.Name]
+		if s.Secret && v.v != "" {
+			v.v = "redacted"
+		}
+		fmt.Fprintf(tw, "%s=%s\t# %s\n", s.Name, v.v, v.source)
+	}
+	return errors.WithStack(tw.Flush())
+}
@@ -0,0 +1,272 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var testSettings = []Setting{
+	{Name: "TEST_ADDR", Default: ":8080", Usage: "address"},
+	{Name: "TEST_TIMEOUT", Kind: Duration, Default: "5s", Usage: "timeout"},
+	{Name: "TEST_KEYS", Usage: "keys", Secret: true},
+	{Name: "TEST_RATE", Kind: Float, Usage: "rate", Reloadable: true},
+}
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	return Load(flag.NewFlagSet("test", flag.ContinueOnError), args, testSettings)
+}
+
+func TestPrecedence(t *testing.T) {
+	os.Remove("test.yaml") // in case previous run failed
+	defer os.Remove("test.yaml")
+
+	err := os.WriteFile("test.yaml", []byte(`# settings
+test_addr: ":9090"
+test-timeout: 10s # comment
+test_rate: 2
+test_keys:
+  - a:1
+  - "b:2"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TEST_TIMEOUT", "20s")
+	defer os.Unsetenv("TEST_TIMEOUT")
+	os.Setenv("TEST_RATE", "") // empty is not set
+	defer os.Unsetenv("TEST_RATE")
+
+	c, err := load(t, "-config", "test.yaml", "--test-addr", ":7070")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, exp := range map[string][2]string{
+		"TEST_ADDR":    {":7070", SourceFlag},
+		"TEST_TIMEOUT": {"20s", SourceEnv},
+		"TEST_KEYS":    {"a:1,b:2", SourceFile},
+		"TEST_RATE":    {"2", SourceFile},
+	} {
+		if v, src := c.Get(name), c.Source(name); v != exp[0] || src != exp[1] {
+			t.Errorf("%s: expected %q from %s, got %q from %s", name, exp[0], exp[1], v, src)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := c.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if s := out.String(); !strings.Contains(s, "TEST_KEYS=redacted") || strings.Contains(s, "a:1") {
+		t.Fatalf("expected secret to be redacted, got\n%s", s)
+	}
+
+	c, err = load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Get("TEST_ADDR") != ":8080" || c.Source("TEST_ADDR") != SourceDefault {
+		t.Fatalf("expected default, got %q from %s", c.Get("TEST_ADDR"), c.Source("TEST_ADDR"))
+	}
+}
+
+func TestValidation(t *testing.T) {
+	os.Remove("test.json") // in case previous run failed
+	defer os.Remove("test.json")
+
+	if err := os.WriteFile("test.json", []byte(`{"TEST_RATE": "fast", "TEST_TYPO": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := load(t, "-config", "test.json", "-test-timeout", "5 seconds")
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", err)
+	}
+	if c == nil || c.Get("TEST_ADDR") != ":8080" {
+		t.Fatal("expected config to be returned with its errors")
+	}
+	for _, exp := range []string{"TEST_RATE from file", "TEST_TIMEOUT from flag", "unknown setting TEST_TYPO"} {
+		if !strings.Contains(err.Error(), exp) {
+			t.Errorf("expected %q in %v", exp, err)
+		}
+	}
+}
+
+func TestParseFiles(t *testing.T) {
+	toml, err := parseTOML([]byte(`# settings
+test_addr = ":9090"
+test_rate = 1.5 # comment
+test_keys = ["a:1", 'b:#2']
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toml["TEST_ADDR"] != ":9090" || toml["TEST_RATE"] != "1.5" || toml["TEST_KEYS"] != "a:1,b:#2" {
+		t.Fatalf("unexpected toml settings %v", toml)
+	}
+	if _, err := parseTOML([]byte("[table]\na = 1\n")); err == nil {
+		t.Fatal("expected tables to be refused")
+	}
+
+	js, err := parseJSON([]byte(`{"test_keys": ["a:1", "b:2"], "TEST_RATE": 3, "test-addr": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if js["TEST_KEYS"] != "a:1,b:2" || js["TEST_RATE"] != "3" || js["TEST_ADDR"] != "" {
+		t.Fatalf("unexpected json settings %v", js)
+	}
+	if _, err := parseJSON([]byte(`{"test": {"nested": 1}}`)); err == nil {
+		t.Fatal("expected nested settings to be refused")
+	}
+
+	yaml, err := parseYAML([]byte("test_keys: [a:1, \"b, 2\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if yaml["TEST_KEYS"] != "a:1,b, 2" {
+		t.Fatalf("unexpected yaml settings %v", yaml)
+	}
+	if _, err := parseYAML([]byte("test:\n  nested: 1\n")); err == nil {
+		t.Fatal("expected nested settings to be refused")
+	}
+}
+
+func TestReload(t *testing.T) {
+	os.Remove("test.toml") // in case previous run failed
+	defer os.Remove("test.toml")
+
+	if err := os.WriteFile("test.toml", []byte("test_addr = \":9090\"\ntest_rate = 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := load(t, "-config", "test.toml", "-test-timeout", "1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := c.Watch(ctx, time.Millisecond*10)
+
+	if err := os.WriteFile("test.toml", []byte("test_addr = \":9091\"\ntest_rate = 2.5\ntest_timeout = \"2s\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("expected file change to trigger a reload")
+	}
+
+	var applied []string
+	apply := func(prev, next *Config) error {
+		applied = append(applied, prev.Get("TEST_RATE")+"->"+next.Get("TEST_RATE"))
+		return nil
+	}
+	next, changes, err := c.Reload(apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0] != "1->2.5" {
+		t.Fatalf("expected rate change to be applied, got %v", applied)
+	}
+	if len(changes) != 2 || changes[0].Setting.Name != "TEST_ADDR" || changes[1].Setting.Name != "TEST_RATE" {
+		t.Fatalf("expected addr and rate to change, got %+v", changes)
+	}
+	if next.Get("TEST_ADDR") != ":9090" || next.Get("TEST_TIMEOUT") != "1s" {
+		t.Fatalf("expected addr to need a restart and flag to be kept, got %q and %q", next.Get("TEST_ADDR"), next.Get("TEST_TIMEOUT"))
+	}
+
+	// bad config is refused, and a failed apply rolled back.
+	os.Setenv("TEST_RATE", "fast")
+	_, _, err = next.Reload(apply)
+	os.Unsetenv("TEST_RATE")
+	if err == nil || len(applied) != 1 {
+		t.Fatalf("expected invalid rate to be refused, got %v", err)
+	}
+
+	os.Setenv("TEST_RATE", "3")
+	defer os.Unsetenv("TEST_RATE")
+	applied = nil
+	kept, _, err := next.Reload(func(prev, next *Config) error {
+		applied = append(applied, prev.Get("TEST_RATE")+"->"+next.Get("TEST_RATE"))
+		if next.Get("TEST_RATE") == "3" {
+			return errors.New("rate too high")
+		}
+		return nil
+	})
+	if err == nil || kept != next || len(applied) != 2 || applied[1] != "3->2.5" {
+		t.Fatalf("expected failed apply to be rolled back, got %v after %v", err, applied)
+	}
+
+	cancel()
+	for range reload {
+	}
+}
+
+func TestReloadOnChange(t *testing.T) {
+	os.Remove("test.json") // in case previous run failed
+	defer os.Remove("test.json")
+	defer os.Remove("test.json.tmp")
+
+	if err := os.WriteFile("test.json", []byte(`{"test_rate": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", "test.json", "-config-watch-interval", "10ms"}, testSettings, Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	applied, reported := make(chan string, 2), make(chan []Change, 2)
+	apply := func(prev, next *Config) error {
+		applied <- prev.Get("TEST_RATE") + "->" + next.Get("TEST_RATE")
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		c.ReloadOnChange(ctx, apply, func(changes []Change, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			reported <- changes
+		})
+		close(done)
+	}()
+
+	// each reload compares against the config of the last one.
+	for _, rate := range []string{"2", "3"} {
+		time.Sleep(time.Millisecond * 20) // for the file to be seen as changed
+		// replaced whole, so it is never read half written.
+		if err := os.WriteFile("test.json.tmp", []byte(`{"test_rate": `+rate+`, "test_addr": ":9090"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename("test.json.tmp", "test.json"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case changes := <-reported:
+			if len(changes) == 0 || changes[len(changes)-1].New != rate {
+				t.Fatalf("expected rate change to %s to be reported, got %+v", rate, changes)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected file change to be reloaded")
+		}
+	}
+	if a, b := <-applied, <-applied; a != "1->2" || b != "2->3" {
+		t.Fatalf("expected rate changes to be applied in turn, got %s and %s", a, b)
+	}
+
+	cancel()
+	<-done
+}
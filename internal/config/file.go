@@ -0,0 +1,268 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readFile returns the settings in file, by setting name. Its format is
+// taken from its extension: .json, .yaml or .yml, or .toml. Settings are
+// flat, so only top level keys with scalar values, or lists of them,
+// which are joined with commas, are supported.
+func readFile(file string) (map[string]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read config file")
+	}
+
+	var parse func([]byte) (map[string]string, error)
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".json":
+		parse = parseJSON
+	case ".yaml", ".yml":
+		parse = parseYAML
+	case ".toml":
+		parse = parseTOML
+	default:
+		return nil, errors.New("config file " + file + ": unknown format " + strconv.Quote(ext) + ", expected .json, .yaml or .toml")
+	}
+
+	settings, err := parse(b)
+	if err != nil {
+		return nil, errors.WithMessage(err, "config file "+file)
+	}
+	return settings, nil
+}
+
+// settingName returns the name of the setting of a key in a config file.
+func settingName(key string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(key), "-", "_"))
+}
+
+func parseJSON(b []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for k, v := range raw {
+		var s string
+		var err error
+		if list, ok := v.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i := 0; i < len(list) && err == nil; i++ {
+				items[i], err = jsonScalar(list[i])
+			}
+			s = strings.Join(items, ",")
+		} else {
+			s, err = jsonScalar(v)
+		}
+		if err != nil {
+			return nil, errors.WithMessage(err, k)
+		}
+		settings[settingName(k)] = s
+	}
+	return settings, nil
+}
+
+func jsonScalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	default:
+		return "", errors.New("expected a string, number, bool or list of them")
+	}
+}
+
+// parseYAML parses flat YAML: "key: value" lines, where values can be
+// quoted, flow lists like [a, b], or block lists of "- item" lines
+// following a key without a value.
+func parseYAML(b []byte) (map[string]string, error) {
+	settings := make(map[string]string)
+	var listKey string
+	var list []string
+
+	endList := func() {
+		if listKey != "" {
+			settings[listKey] = strings.Join(list, ",")
+			listKey, list = "", nil
+		}
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := stripComment(sc.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" {
+				return nil, errors.Errorf("line %d: list item without a key", n)
+			}
+			item, err := unquote(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if err != nil {
+				return nil, errors.WithMessagef(err, "line %d", n)
+			}
+			list = append(list, item)
+			continue
+		}
+		endList()
+
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, errors.Errorf("line %d: nested settings are not supported", n)
+		}
+
+		key, v, ok := strings.Cut(trimmed, ": ")
+		if !ok && strings.HasSuffix(trimmed, ":") {
+			key, ok = strings.TrimSuffix(trimmed, ":"), true
+		}
+		if !ok {
+			return nil, errors.Errorf("line %d: expected key: value", n)
+		}
+
+		v = strings.TrimSpace(v)
+		if v == "" {
+			listKey = settingName(key)
+			settings[listKey] = ""
+			continue
+		}
+
+		s, err := scalarOrList(v)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "line %d", n)
+		}
+		settings[settingName(key)] = s
+	}
+	endList()
+	return settings, errors.WithStack(sc.Err())
+}
+
+// parseTOML parses flat TOML: "key = value" lines, where values are
+// strings, numbers, bools or single line arrays of them. Tables are not supported.
+func parseTOML(b []byte) (map[string]string, error) {
+	settings := make(map[string]string)
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, errors.Errorf("line %d: tables are not supported", n)
+		}
+
+		key, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, errors.Errorf("line %d: expected key = value", n)
+		}
+
+		s, err := scalarOrList(strings.TrimSpace(v))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "line %d", n)
+		}
+		settings[settingName(strings.Trim(strings.TrimSpace(key), `"`))] = s
+	}
+	return settings, errors.WithStack(sc.Err())
+}
+
+// scalarOrList returns a value, or the items of a list like [a, "b"] joined with commas.
+func scalarOrList(v string) (string, error) {
+	if !strings.HasPrefix(v, "[") {
+		return unquote(v)
+	}
+	if !strings.HasSuffix(v, "]") {
+		return "", errors.New("unterminated list")
+	}
+
+	inner := strings.TrimSpace(v[1 : len(v)-1])
+	if inner == "" {
+		return "", nil
+	}
+
+	var items []string
+	for _, item := range splitList(inner) {
+		s, err := unquote(strings.TrimSpace(item))
+		if err != nil {
+			return "", err
+		}
+		items = append(items, s)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// splitList splits the items of a list at commas outside quotes.
+func splitList(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		items = append(items, rest)
+	}
+	return items
+}
+
+// unquote returns a value without its double or single quotes, if any.
+func unquote(v string) (string, error) {
+	switch {
+	case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+		s, err := strconv.Unquote(v)
+		return s, errors.Wrap(err, "invalid string "+v)
+	case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+// stripComment removes a # comment from a line, if not in quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
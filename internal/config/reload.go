@@ -0,0 +1,150 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Settings configure reloading, see Watch.
+var Settings = []Setting{
+	{Name: "CONFIG_WATCH_INTERVAL", Kind: Duration, Default: "10s", Usage: "how often to check the config file for changes, 0 to only reload on SIGHUP"},
+}
+
+// Change is a setting whose value changed on Reload.
+type Change struct {
+	Setting  Setting
+	Old, New string
+}
+
+// Values returns the old and new value, redacted if the setting is secret.
+func (ch Change) Values() (old, new string) {
+	if !ch.Setting.Secret {
+		return ch.Old, ch.New
+	}
+	return redact(ch.Old), redact(ch.New)
+}
+
+func redact(v string) string {
+	if v == "" {
+		return v
+	}
+	return "redacted"
+}
+
+// Reload resolves the settings again, reading the config file anew.
+// The environment of a running process does not change, so settings set in
+// it, like flags, keep their values, and only those from the file or their
+// defaults can change. Settings that are not Reloadable keep theirs until a restart. If any Reloadable setting changed, apply is called to put
+// the new values into effect. If it fails, it is called again from the new
+// config to the old one to roll back what it did, and the old config is kept.
+//
+// It returns the config in effect and the settings that changed,
+// including those that need a restart.
+func (c *Config) Reload(apply func(prev, next *Config) error) (*Config, []Change, error) {
+	next := Config{settings: c.settings, values: make(map[string]value), flags: c.flags, File: c.File}
+	if err := next.resolve(); err != nil {
+		return c, nil, err
+	}
+
+	var changes []Change
+	reload := false
+	for _, s := range c.settings {
+		old, v := c.values[s.Name], next.values[s.Name]
+		if old.v == v.v {
+			continue
+		}
+
+		changes = append(changes, Change{s, old.v, v.v})
+		if s.Reloadable {
+			reload = true
+		} else {
+			next.values[s.Name] = old
+		}
+	}
+	if !reload {
+		return &next, changes, nil
+	}
+
+	if err := apply(c, &next); err != nil {
+		if rbErr := apply(&next, c); rbErr != nil {
+			return c, nil, errors.WithMessagef(err, "rolling back failed (%v)", rbErr)
+		}
+		return c, nil, errors.WithMessage(err, "rolled back")
+	}
+	return &next, changes, nil
+}
+
+// Watch returns a channel that receives when the config should be reloaded:
+// on SIGHUP, and when the config file changes, checked every interval unless 0.
+// Triggers while the last is not yet received are merged.
+// The channel is closed once ctx is done.
+func (c *Config) Watch(ctx context.Context, interval time.Duration) <-chan struct{} {
+	reload := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	last := fileVersion(c.File)
+
+	go func() {
+		defer close(reload)
+		defer signal.Stop(hup)
+
+		var tick <-chan time.Time
+		if c.File != "" && interval > 0 {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			tick = t.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				trigger()
+			case <-tick:
+				if v := fileVersion(c.File); v != last {
+					last = v
+					trigger()
+				}
+			}
+		}
+	}()
+	return reload
+}
+
+// ReloadOnChange reloads the config with apply every time Watch triggers,
+// checking the config file every CONFIG_WATCH_INTERVAL of Settings, until
+// ctx is done. The outcome of each reload is passed to report.
+func (c *Config) ReloadOnChange(ctx context.Context, apply func(prev, next *Config) error, report func(changes []Change, err error)) {
+	interval, _ := time.ParseDuration(c.Get("CONFIG_WATCH_INTERVAL"))
+	current := c
+	for range c.Watch(ctx, interval) {
+		next, changes, err := current.Reload(apply)
+		current = next
+		report(changes, err)
+	}
+}
+
+// fileVersion identifies the contents of file by its size and modification time.
+func fileVersion(file string) [2]int64 {
+	if file == "" {
+		return [2]int64{}
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return [2]int64{-1, -1}
+	}
+	return [2]int64{fi.Size(), fi.ModTime().UnixNano()}
+}
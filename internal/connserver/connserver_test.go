@@ -0,0 +1,58 @@
+package connserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served, done := make(chan struct{}), make(chan struct{})
+	s := New(func(c net.Conn) {
+		close(served)
+		io.Copy(io.Discard, c) // until closed
+		close(done)
+	})
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(ln) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-served
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("expected Close to wait for open connections")
+	}
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Serve to return")
+	}
+
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(ln2); err != nil {
+		t.Fatalf("expected Serve after Close to return nil, got %v", err)
+	}
+}
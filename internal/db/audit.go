@@ -0,0 +1,335 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/pkg/errors"
+)
+
+var auditErrors = metrics.NewCounter("db_audit_errors_total", "Number of counter changes that could not be recorded in the audit log.")
+
+func auditFile(dbFilePath string) string {
+	return dbFilePath + ".audit"
+}
+
+type whoKey struct{}
+
+// WithWho returns ctx with who is making changes to the db through it,
+// to record in the audit log.
+func WithWho(ctx context.Context, who string) context.Context {
+	return context.WithValue(ctx, whoKey{}, who)
+}
+
+func whoFrom(ctx context.Context) string {
+	who, _ := ctx.Value(whoKey{}).(string)
+	return who
+}
+
+// AuditEntry records a change to a counter, other than an increment.
+// Each entry holds the hash of the one before it, and its hash covers
+// both, so changing or removing an entry breaks the chain after it.
+type AuditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Who       string    `json:"who"`
+	RequestID string    `json:"request_id,omitempty"`
+	Action    string    `json:"action"` // set, reset, delete or rename
+	// Namespace is the namespace of the counter, empty for the default one.
+	Namespace string `json:"namespace,omitempty"`
+	Counter   string `json:"counter"`
+	Old       uint64 `json:"old"`
+	New       uint64 `json:"new"`
+	// To is the new name of a renamed counter.
+	To   string `json:"to,omitempty"`
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of e, its fields other than Hash.
+func (e AuditEntry) hash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditLog appends entries to a hash chained file of JSON lines.
+type auditLog struct {
+	mu   sync.Mutex
+	file string
+	f    *os.File
+	seq  uint64
+	head string // hash of the last entry
+}
+
+// EnableAudit records changes to counters, other than increments, in
+// the audit log at DB_FILE + ".audit", continuing the chain of entries in it.
+// A partial last entry, left by a crash while it was written, is removed.
+func (d *DB) EnableAudit() error {
+	file := auditFile(d.file)
+	a := &auditLog{file: file}
+
+	if err := truncatePartialAuditEntry(file); err != nil {
+		return err
+	}
+
+	// continue from the last entry. Verify checks the whole chain.
+	err := readAuditLog(file, func(e AuditEntry) bool {
+		a.seq, a.head = e.Seq, e.Hash
+		return true
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	a.f, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "unable to open "+file)
+	}
+
+	d.audit = a
+	return nil
+}
+
+// truncatePartialAuditEntry removes the last line of file if it does not
+// end in a newline. Entries are written with their newline in one write,
+// so such a line is one the process crashed while writing.
+func truncatePartialAuditEntry(file string) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrap(err, "unable to open "+file)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "unable to stat "+file)
+	}
+
+	// find the end of the last complete line, reading back from the end.
+	size := fi.Size()
+	end, buf := size, make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return errors.Wrap(err, "unable to read "+file)
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == size {
+		return nil
+	}
+
+	logging.Warn("removing partial last entry of audit log", logging.F("file", file), logging.F("bytes", size-end))
+	if err := f.Truncate(end); err != nil {
+		return errors.Wrap(err, "unable to truncate "+file)
+	}
+	return errors.Wrap(f.Sync(), "unable to sync "+file)
+}
+
+// record appends e to the audit log, if enabled, with who and when from ctx.
+// The change is already made, so failing to record it is logged and counted.
+func (d *DB) record(ctx context.Context, e AuditEntry) {
+	a := d.audit
+	if a == nil {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	e.Who = whoFrom(ctx)
+	e.RequestID = requestid.FromContext(ctx)
+	e.Namespace, e.Counter = splitNamespace(e.Counter)
+	if e.To != "" {
+		_, e.To = splitNamespace(e.To)
+	}
+
+	if err := a.append(e); err != nil {
+		auditErrors.Inc()
+		logging.Ctx(ctx).Error("unable to record change in audit log",
+			logging.F("action", e.Action), logging.F("counter", e.Counter), logging.Err(err))
+	}
+}
+
+func (a *auditLog) append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return errors.New("audit log closed")
+	}
+
+	e.Seq = a.seq + 1
+	e.Prev = a.head
+	e.Hash = e.hash()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "unable to write "+a.file)
+	}
+	if err := a.f.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync "+a.file)
+	}
+
+	a.seq, a.head = e.Seq, e.Hash
+	return nil
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return errors.WithStack(err)
+}
+
+// readAuditLog calls f with each entry in file, until it returns false.
+func readAuditLog(file string, f func(e AuditEntry) bool) error {
+	fl, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "unable to open "+file)
+	}
+	defer fl.Close()
+
+	r := bufio.NewReader(fl)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "unable to read "+file)
+		}
+
+		var e AuditEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return errors.Wrap(err, file+": invalid entry on line "+strconv.Itoa(line))
+		}
+		if !f(e) {
+			return nil
+		}
+	}
+}
+
+// AuditQuery selects audit log entries. Zero fields match all entries.
+type AuditQuery struct {
+	Namespace    string
+	Counter      string
+	Who          string
+	Since, Until time.Time
+	// Limit is the maximum number of entries, the latest ones, returned.
+	Limit int
+}
+
+func (q AuditQuery) match(e AuditEntry) bool {
+	return (q.Namespace == "" || e.Namespace == q.Namespace) &&
+		(q.Counter == "" || e.Counter == q.Counter || e.To == q.Counter) &&
+		(q.Who == "" || e.Who == q.Who) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// QueryAudit returns the entries of the audit log matching q, oldest first.
+func (d *DB) QueryAudit(q AuditQuery) ([]AuditEntry, error) {
+	if d.audit == nil {
+		return nil, errors.New("audit log not enabled")
+	}
+
+	// not while an entry is half written.
+	d.audit.mu.Lock()
+	defer d.audit.mu.Unlock()
+
+	var entries []AuditEntry
+	err := readAuditLog(d.audit.file, func(e AuditEntry) bool {
+		if q.match(e) {
+			entries = append(entries, e)
+			if q.Limit > 0 && len(entries) > q.Limit {
+				entries = entries[1:]
+			}
+		}
+		return true
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return entries, err
+}
+
+// AuditStatus is the result of verifying an audit log.
+type AuditStatus struct {
+	OK      bool   `json:"ok"`
+	Entries uint64 `json:"entries"`
+	// Head is the hash of the last entry. Keep it elsewhere to
+	// also be able to tell if entries were removed from the end.
+	Head string `json:"head"`
+	// BadSeq is the first entry that does not follow from the one before it.
+	BadSeq uint64 `json:"bad_seq,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// VerifyAuditLog checks that the entries of the audit log file are unchanged,
+// by checking the hash chain from the first entry to the last.
+func VerifyAuditLog(file string) AuditStatus {
+	st := AuditStatus{OK: true}
+	fail := func(seq uint64, msg string) {
+		st.OK, st.BadSeq, st.Error = false, seq, msg
+	}
+
+	err := readAuditLog(file, func(e AuditEntry) bool {
+		switch {
+		case e.Seq != st.Entries+1:
+			fail(e.Seq, "expected entry "+strconv.FormatUint(st.Entries+1, 10)+", got "+strconv.FormatUint(e.Seq, 10))
+		case e.Prev != st.Head:
+			fail(e.Seq, "entry does not follow the one before it")
+		case e.Hash != e.hash():
+			fail(e.Seq, "entry was changed")
+		default:
+			st.Entries, st.Head = e.Seq, e.Hash
+			return true
+		}
+		return false
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fail(st.Entries+1, err.Error())
+	}
+	return st
+}
+
+// VerifyAudit verifies the audit log of the db.
+func (d *DB) VerifyAudit() AuditStatus {
+	if d.audit != nil {
+		d.audit.mu.Lock()
+		defer d.audit.mu.Unlock()
+	}
+	return VerifyAuditLog(auditFile(d.file))
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	os.Remove(auditFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+	defer os.Remove(auditFile("test.test"))
+
+	ctx := WithWho(context.Background(), "alice")
+	d := NewDB("test.test")
+	if err := d.EnableAudit(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Add("a", 5) // increments are not recorded
+	d.Set(ctx, "a", 7)
+	d.Rename(ctx, "a", "b")
+	d.Close()
+
+	// the chain continues after reopening.
+	d = NewDB("test.test")
+	if err := d.EnableAudit(); err != nil {
+		t.Fatal(err)
+	}
+	d.Reset(ctx, "b")
+	d.Delete(WithWho(context.Background(), "bob"), "b")
+
+	entries, err := d.QueryAudit(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	if strings.Join(actions, ",") != "set,rename,reset,delete" {
+		t.Fatalf("unexpected actions %v", actions)
+	}
+	if e := entries[0]; e.Who != "alice" || e.Counter != "a" || e.Old != 5 || e.New != 7 {
+		t.Fatalf("unexpected set entry %+v", e)
+	}
+	if e := entries[1]; e.Counter != "a" || e.To != "b" || e.Old != 7 {
+		t.Fatalf("unexpected rename entry %+v", e)
+	}
+
+	if entries, _ := d.QueryAudit(AuditQuery{Counter: "b", Limit: 2}); len(entries) != 2 || entries[1].Who != "bob" {
+		t.Fatalf("expected last 2 entries of b, got %+v", entries)
+	}
+
+	st := d.VerifyAudit()
+	if !st.OK || st.Entries != 4 || st.Head != entries[3].Hash {
+		t.Fatalf("expected audit log to verify, got %+v", st)
+	}
+	d.Close()
+
+	// change the old value of the set entry.
+	b, err := os.ReadFile(auditFile("test.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(b), `"old":5`, `"old":6`, 1)
+	if err := os.WriteFile(auditFile("test.test"), []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := VerifyAuditLog(auditFile("test.test")); st.OK || st.BadSeq != 1 {
+		t.Fatalf("expected tampering with entry 1 to be detected, got %+v", st)
+	}
+}
+
+func TestAuditPartialLastEntry(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	os.Remove(auditFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+	defer os.Remove(auditFile("test.test"))
+
+	ctx := WithWho(context.Background(), "alice")
+	d := NewDB("test.test")
+	if err := d.EnableAudit(); err != nil {
+		t.Fatal(err)
+	}
+	d.Set(ctx, "a", 7)
+	d.Close()
+
+	// crash while writing the next entry.
+	f, err := os.OpenFile(auditFile("test.test"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"time":"20`)
+	f.Close()
+
+	if st := VerifyAuditLog(auditFile("test.test")); st.OK {
+		t.Fatal("expected verifying a partial entry to fail")
+	}
+
+	d = NewDB("test.test")
+	if err := d.EnableAudit(); err != nil {
+		t.Fatalf("expected partial last entry to be removed, got %v", err)
+	}
+	d.Reset(ctx, "a")
+
+	st := d.VerifyAudit()
+	if !st.OK || st.Entries != 2 {
+		t.Fatalf("expected audit log to verify, got %+v", st)
+	}
+	d.Close()
+}
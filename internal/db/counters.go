@@ -0,0 +1,354 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// DefaultCounter is the name by which the count is also available
+// alongside named counters.
+const DefaultCounter = "requests"
+
+const maxCounterName = 1<<16 - 1
+
+// counters are named counters, persisted to their own file next to the count.
+type counters struct {
+	mu    sync.RWMutex
+	m     map[string]*uint64
+	dirty int32 // changed since last save
+}
+
+func countersFile(dbFilePath string) string {
+	return dbFilePath + ".counters"
+}
+
+// counter calls f with the counter called name, creating it if create is set.
+// f is not called if the counter does not exist.
+func (d *DB) counter(name string, create bool, f func(c *uint64)) bool {
+	if name == DefaultCounter {
+		f(&d.count)
+		d.changed()
+		return true
+	}
+
+	d.counters.mu.RLock()
+	c, ok := d.counters.m[name]
+	if ok {
+		// under read lock so it can't be deleted meanwhile.
+		f(c)
+		d.counters.mu.RUnlock()
+		d.countersChanged()
+		return true
+	}
+	d.counters.mu.RUnlock()
+
+	if !create {
+		return false
+	}
+
+	d.counters.mu.Lock()
+	if c, ok = d.counters.m[name]; !ok {
+		c = new(uint64)
+		d.counters.m[name] = c
+	}
+	f(c)
+	d.counters.mu.Unlock()
+	d.countersChanged()
+	return true
+}
+
+// Add adds delta to the counter called name, creating it if needed,
+// and returns its new value.
+func (d *DB) Add(name string, delta uint64) (uint64, error) {
+	if err := validName(name); err != nil {
+		return 0, err
+	}
+	return d.add(name, delta), nil
+}
+
+func (d *DB) add(name string, delta uint64) uint64 {
+	var v uint64
+	d.counter(name, true, func(c *uint64) {
+		v = atomic.AddUint64(c, delta)
+	})
+	return v
+}
+
+// AddWithin adds delta to the counter called name, creating it if needed,
+// unless that would take it above limit. It returns the counter's value
+// and whether delta was added.
+func (d *DB) AddWithin(name string, delta, limit uint64) (uint64, bool, error) {
+	if err := validName(name); err != nil {
+		return 0, false, err
+	}
+
+	v, added := d.addWithin(name, delta, limit)
+	return v, added, nil
+}
+
+func (d *DB) addWithin(name string, delta, limit uint64) (v uint64, added bool) {
+	d.counter(name, true, func(c *uint64) {
+		for {
+			v = atomic.LoadUint64(c)
+			if delta > limit || v > limit-delta {
+				return
+			}
+			if atomic.CompareAndSwapUint64(c, v, v+delta) {
+				v, added = v+delta, true
+				return
+			}
+		}
+	})
+	return v, added
+}
+
+// Get returns the value of the counter called name, and whether it exists.
+func (d *DB) Get(name string) (uint64, bool) {
+	if name == DefaultCounter {
+		return d.Count(), true
+	}
+	if inNamespace(name) {
+		return 0, false
+	}
+	return d.get(name)
+}
+
+func (d *DB) get(name string) (uint64, bool) {
+	d.counters.mu.RLock()
+	defer d.counters.mu.RUnlock()
+
+	c, ok := d.counters.m[name]
+	if !ok {
+		return 0, false
+	}
+	return atomic.LoadUint64(c), true
+}
+
+// Set sets the counter called name to v, creating it if needed.
+func (d *DB) Set(ctx context.Context, name string, v uint64) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	d.set(ctx, name, v)
+	return nil
+}
+
+func (d *DB) set(ctx context.Context, name string, v uint64) {
+	var old uint64
+	d.counter(name, true, func(c *uint64) {
+		old = atomic.SwapUint64(c, v)
+	})
+	d.record(ctx, AuditEntry{Action: "set", Counter: name, Old: old, New: v})
+}
+
+// Reset sets the existing counter called name to zero.
+func (d *DB) Reset(ctx context.Context, name string) error {
+	if inNamespace(name) {
+		return ErrNotFound
+	}
+	return d.reset(ctx, name, false)
+}
+
+// reset sets the counter called name to zero, creating it if create is set.
+func (d *DB) reset(ctx context.Context, name string, create bool) error {
+	var old uint64
+	if !d.counter(name, create, func(c *uint64) {
+		old = atomic.SwapUint64(c, 0)
+	}) {
+		return ErrNotFound
+	}
+	d.record(ctx, AuditEntry{Action: "reset", Counter: name, Old: old})
+	return nil
+}
+
+// Delete removes the counter called name and reports whether it existed.
+// The default counter can't be removed, so it is reset to zero instead.
+func (d *DB) Delete(ctx context.Context, name string) bool {
+	if name == DefaultCounter {
+		return d.Reset(ctx, name) == nil
+	}
+	if inNamespace(name) {
+		return false
+	}
+	return d.remove(ctx, name)
+}
+
+func (d *DB) remove(ctx context.Context, name string) bool {
+	d.counters.mu.Lock()
+	c, ok := d.counters.m[name]
+	delete(d.counters.m, name)
+	d.counters.mu.Unlock()
+
+	if ok {
+		d.countersChanged()
+		d.record(ctx, AuditEntry{Action: "delete", Counter: name, Old: atomic.LoadUint64(c)})
+	}
+	return ok
+}
+
+var (
+	ErrNotFound = errors.New("counter not found")
+	ErrExists   = errors.New("counter already exists")
+)
+
+// Rename renames the counter called from to to, keeping its value.
+// The default counter can't be renamed, or replaced by another.
+func (d *DB) Rename(ctx context.Context, from, to string) error {
+	if err := validName(to); err != nil {
+		return err
+	}
+	if from == DefaultCounter || to == DefaultCounter {
+		return errors.New("can't rename the " + DefaultCounter + " counter")
+	}
+	if inNamespace(from) {
+		return ErrNotFound
+	}
+	return d.rename(ctx, from, to)
+}
+
+func (d *DB) rename(ctx context.Context, from, to string) error {
+	d.counters.mu.Lock()
+	c, ok := d.counters.m[from]
+	_, exists := d.counters.m[to]
+	switch {
+	case !ok:
+		d.counters.mu.Unlock()
+		return ErrNotFound
+	case exists:
+		d.counters.mu.Unlock()
+		return ErrExists
+	}
+	delete(d.counters.m, from)
+	d.counters.m[to] = c
+	d.counters.mu.Unlock()
+
+	d.countersChanged()
+	v := atomic.LoadUint64(c)
+	d.record(ctx, AuditEntry{Action: "rename", Counter: from, To: to, Old: v, New: v})
+	return nil
+}
+
+// Names returns the names of all counters, including the default one, sorted.
+// Counters of namespaces are not included.
+func (d *DB) Names() []string {
+	d.counters.mu.RLock()
+	names := make([]string, 0, len(d.counters.m)+1)
+	for name := range d.counters.m {
+		if !inNamespace(name) {
+			names = append(names, name)
+		}
+	}
+	d.counters.mu.RUnlock()
+
+	names = append(names, DefaultCounter)
+	sort.Strings(names)
+	return names
+}
+
+// Len returns the number of named counters, including those of namespaces.
+func (d *DB) Len() int {
+	d.counters.mu.RLock()
+	defer d.counters.mu.RUnlock()
+	return len(d.counters.m)
+}
+
+func validName(name string) error {
+	if name == "" {
+		return errors.New("empty counter name")
+	}
+	if len(name) > maxCounterName {
+		return errors.New("counter name too long")
+	}
+	if inNamespace(name) {
+		return errors.New("counter name can't contain NUL")
+	}
+	return nil
+}
+
+func (d *DB) countersChanged() {
+	atomic.StoreInt32(&d.counters.dirty, 1)
+	d.changed()
+}
+
+// saveCounters writes all named counters to a temporary file
+// and renames it over the previous one, so a crash can't leave it half written.
+// Each counter is a 2 byte name length, the name and its 8 byte value.
+func (d *DB) saveCounters() error {
+	if !atomic.CompareAndSwapInt32(&d.counters.dirty, 1, 0) {
+		return nil
+	}
+
+	d.counters.mu.RLock()
+	size := 0
+	for name := range d.counters.m {
+		size += 2 + len(name) + 8
+	}
+
+	b := make([]byte, size)
+	i := 0
+	for name, c := range d.counters.m {
+		binary.LittleEndian.PutUint16(b[i:], uint16(len(name)))
+		i += 2
+		i += copy(b[i:], name)
+		binary.LittleEndian.PutUint64(b[i:], atomic.LoadUint64(c))
+		i += 8
+	}
+	d.counters.mu.RUnlock()
+
+	file := countersFile(d.file)
+	if err := writeFileAtomic(file, b); err != nil {
+		atomic.StoreInt32(&d.counters.dirty, 1) // retry next flush
+		return errors.Wrap(err, "unable to save "+file)
+	}
+
+	return nil
+}
+
+func (d *DB) loadCounters() error {
+	d.counters.m = make(map[string]*uint64)
+
+	file := countersFile(d.file)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrap(err, "unable to read "+file)
+	}
+
+	for len(b) > 0 {
+		if len(b) < 2 {
+			logging.Warn("counters file corrupted, ignoring rest", logging.F("file", file))
+			break
+		}
+
+		l := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+l+8 {
+			logging.Warn("counters file corrupted, ignoring rest", logging.F("file", file))
+			break
+		}
+
+		v := binary.LittleEndian.Uint64(b[2+l:])
+		d.counters.m[string(b[2:2+l])] = &v
+		b = b[2+l+8:]
+	}
+
+	return nil
+}
+
+func writeFileAtomic(file string, b []byte) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+
+	ctx := context.Background()
+	d := NewDB("test.test")
+
+	if v, _ := d.Add("a", 2); v != 2 {
+		t.Fatalf("expected 2, got %d", v)
+	}
+	if v, _ := d.Add("a", 3); v != 5 {
+		t.Fatalf("expected 5, got %d", v)
+	}
+	if err := d.Set(ctx, "b", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Add("", 1); err == nil {
+		t.Fatal("expected error for empty name")
+	}
+
+	d.IncCount()
+	if v, ok := d.Get(DefaultCounter); !ok || v != 1 {
+		t.Fatalf("expected default counter 1, got %d", v)
+	}
+
+	if names := d.Names(); !reflect.DeepEqual(names, []string{"a", "b", DefaultCounter}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	if !d.Delete(ctx, "b") || d.Delete(ctx, "b") {
+		t.Fatal("expected b to be deleted once")
+	}
+	if _, ok := d.Get("b"); ok {
+		t.Fatal("expected b to be gone")
+	}
+
+	if err := d.saveCounters(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = NewDB("test.test")
+	defer d.Close()
+
+	if v, ok := d.Get("a"); !ok || v != 5 {
+		t.Fatalf("expected a to be loaded as 5, got %d", v)
+	}
+	if _, ok := d.Get("b"); ok {
+		t.Fatal("expected b to stay deleted")
+	}
+}
+
+func TestRename(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+
+	ctx := context.Background()
+	d := NewDB("test.test")
+	defer d.Close()
+
+	d.Set(ctx, "a", 1)
+	d.Set(ctx, "b", 2)
+
+	if err := d.Rename(ctx, "a", "b"); err != ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if err := d.Rename(ctx, "x", "y"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := d.Rename(ctx, DefaultCounter, "y"); err == nil {
+		t.Fatal("expected default counter to not be renamed")
+	}
+	if err := d.Rename(ctx, "a", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.Get("a"); ok {
+		t.Fatal("expected a to be gone")
+	}
+	if v, _ := d.Get("c"); v != 1 {
+		t.Fatalf("expected c to have the value of a, got %d", v)
+	}
+}
+
+func TestAddWithin(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+
+	d := NewDB("test.test")
+	defer d.Close()
+
+	var wg sync.WaitGroup
+	var added uint64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok, _ := d.AddWithin("q", 1, 10); ok {
+				atomic.AddUint64(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := d.Get("q"); v != 10 || added != 10 {
+		t.Fatalf("expected 10 added up to the limit, got %d added and value %d", added, v)
+	}
+
+	if v, ok, _ := d.AddWithin("q", 1, 10); ok || v != 10 {
+		t.Fatalf("expected no more than the limit, got %d %v", v, ok)
+	}
+	if v, ok, _ := d.AddWithin("q", 5, 20); !ok || v != 15 {
+		t.Fatalf("expected 15, got %d %v", v, ok)
+	}
+	if _, ok, _ := d.AddWithin("r", 11, 10); ok {
+		t.Fatal("expected delta above limit to be refused")
+	}
+}
+
+func TestChangeAfterClose(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+
+	d := NewDB("test.test")
+	d.AddCount(2)
+	d.Close()
+
+	// e.g. quota or rules cleanup racing shutdown must not panic.
+	d.IncCount()
+	if err := d.Set(context.Background(), "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.FlushErr(); err != ErrClosed {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+
+	d = NewDB("test.test")
+	defer d.Close()
+	if c := d.Count(); c != 2 {
+		t.Fatalf("expected count 2 saved before close, got %d", c)
+	}
+}
@@ -1,54 +1,167 @@
 package db
 
 import (
+	"context"
 	"encoding/binary"
 	"io/fs"
-	"log"
 	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/tracing"
 	"github.com/pkg/errors"
 )
 
+var (
+	flushDuration = metrics.NewHistogramVec("db_flush_duration_seconds", "Latency of persisting a db to disk.", metrics.DefBuckets, "db")
+	flushErrors   = metrics.NewCounterVec("db_flush_errors_total", "Number of failed attempts to persist a db to disk.", "db")
+)
+
 type DB struct {
-	count uint64
-	flush chan struct{}
-	file  string
+	count    uint64
+	flush    chan struct{} // never closed, so changes after Close don't panic
+	stop     chan struct{} // closed by Close
+	flushed  chan struct{} // closed once the flusher is done
+	snapshot chan chan error
+	close    sync.Once
+	file     string
+	lastSave uint64
+	counters counters
+	watchers watchers
+	health   health
+	audit    *auditLog // nil unless enabled
+
+	flushStats flushStats
 }
 
 func NewDB(dbFilePath string) *DB {
 	d := &DB{
-		flush: make(chan struct{}, 1),
-		file:  dbFilePath,
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		flushed:  make(chan struct{}),
+		snapshot: make(chan chan error),
+		file:     dbFilePath,
 	}
 
 	// async db flusher
 	go func(d *DB) {
-		for range d.flush {
-			if err := d.saveCount(); err != nil {
-				log.Println("error persisting to disk:", err)
+		defer close(d.flushed)
+		for {
+			select {
+			case <-d.flush:
+				d.persist()
+			case done := <-d.snapshot:
+				done <- d.persist()
+			case <-d.stop:
+				select {
+				case <-d.flush:
+					d.persist()
+				default:
+				}
+				d.health.setFlushErr(ErrClosed)
+				return
 			}
 		}
 	}(d)
 
 	if err := d.loadCount(); err != nil {
-		log.Println("error loading saved value:", err)
+		logging.Error("error loading saved value", logging.Err(err))
+		d.health.setLoadErr(err)
+	}
+
+	if err := d.loadCounters(); err != nil {
+		logging.Error("error loading saved counters", logging.Err(err))
+		d.health.setLoadErr(err)
 	}
 
+	opened(d)
 	return d
 }
 
+// persist saves the count and counters if changed.
+func (d *DB) persist() error {
+	_, span := tracing.Start(context.Background(), "db.flush", tracing.KindInternal)
+	span.SetAttr("db", d.file)
+	start := time.Now()
+	err := d.saveCount()
+	if err != nil {
+		logging.Error("error persisting to disk", logging.Err(err))
+	}
+	if cErr := d.saveCounters(); cErr != nil {
+		logging.Error("error persisting to disk", logging.Err(cErr))
+		err = cErr
+	}
+	d.health.setFlushErr(err)
+	d.flushStats.flushed(start, err)
+	span.SetError(err)
+	span.End()
+
+	flushDuration.With(d.file).Observe(time.Since(start).Seconds())
+	if err != nil {
+		flushErrors.With(d.file).Inc()
+	}
+	return err
+}
+
+// Snapshot persists the db now, without waiting for the flusher
+// to get to it, and returns the error if it failed.
+func (d *DB) Snapshot() error {
+	done := make(chan error, 1)
+	select {
+	case d.snapshot <- done:
+		return <-done
+	case <-d.flushed:
+		return ErrClosed
+	}
+}
+
+// Close stops persisting the db, after waiting for pending changes to be saved.
+// It is safe to call more than once. Changes made after it are not persisted.
 func (d *DB) Close() error {
-	close(d.flush)
+	d.close.Do(func() {
+		close(d.stop)
+		closed(d)
+	})
+	<-d.flushed
+
+	if d.audit != nil {
+		return d.audit.close()
+	}
 	return nil
 }
 
 func (d *DB) IncCount() uint64 {
-	newCount := atomic.AddUint64(&d.count, 1)
-	d.notifyFlusher()
+	return d.AddCount(1)
+}
+
+// AddCount adds delta to the count and returns the new count.
+func (d *DB) AddCount(delta uint64) uint64 {
+	newCount := atomic.AddUint64(&d.count, delta)
+	d.changed()
+	return newCount
+}
+
+// SubCount subtracts delta from the count and returns the new count.
+// The caller must ensure delta is not more than the current count.
+func (d *DB) SubCount(delta uint64) uint64 {
+	newCount := atomic.AddUint64(&d.count, ^(delta - 1))
+	d.changed()
 	return newCount
 }
 
+func (d *DB) Count() uint64 {
+	return atomic.LoadUint64(&d.count)
+}
+
+// changed must be called after every change to the count.
+func (d *DB) changed() {
+	d.notifyFlusher()
+	d.notifyWatchers()
+}
+
 func (d *DB) notifyFlusher() {
 	if len(d.flush) == 0 {
 		select {
@@ -58,11 +171,9 @@ func (d *DB) notifyFlusher() {
 	}
 }
 
-var lastSave uint64
-
 func (d *DB) saveCount() error {
 	c := atomic.LoadUint64(&d.count)
-	if c == lastSave {
+	if c == d.lastSave {
 		return nil
 	}
 
@@ -74,7 +185,7 @@ func (d *DB) saveCount() error {
 		return errors.Wrap(err, "unable to save "+d.file)
 	}
 
-	lastSave = c
+	d.lastSave = c
 	return nil
 }
 
@@ -88,10 +199,11 @@ func (d *DB) loadCount() error {
 	}
 
 	if len(fb) != 8 {
-		log.Println(d.file, "corrupted. Ignoring")
+		logging.Warn("db file corrupted, ignoring", logging.F("file", d.file))
 		return nil
 	}
 
 	d.count = binary.LittleEndian.Uint64(fb)
+	d.lastSave = d.count
 	return nil
 }
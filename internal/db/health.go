@@ -0,0 +1,47 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is reported by FlushErr once the db is closed.
+var ErrClosed = errors.New("db closed")
+
+// health is what went wrong loading and persisting the db.
+type health struct {
+	mu       sync.Mutex
+	loadErr  error
+	flushErr error
+}
+
+func (h *health) setLoadErr(err error) {
+	h.mu.Lock()
+	if h.loadErr == nil {
+		h.loadErr = err
+	}
+	h.mu.Unlock()
+}
+
+func (h *health) setFlushErr(err error) {
+	h.mu.Lock()
+	h.flushErr = err
+	h.mu.Unlock()
+}
+
+// LoadErr returns the error, if any, loading the saved db at startup.
+// The db then started from zero and will overwrite what could not be loaded.
+func (d *DB) LoadErr() error {
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+	return d.health.loadErr
+}
+
+// FlushErr returns the error of the last attempt to persist the db,
+// or ErrClosed if it is closed and no longer persisted.
+func (d *DB) FlushErr() error {
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+	return d.health.flushErr
+}
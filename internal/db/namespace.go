@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nsSep separates the namespace of a counter from its name in the names of
+// stored counters. Counter names can't contain it, so a counter of the
+// default namespace can't be mistaken for one of another.
+const nsSep = "\x00"
+
+const maxNamespace = 255
+
+func inNamespace(name string) bool {
+	return strings.Contains(name, nsSep)
+}
+
+// splitNamespace returns the namespace and name of a stored counter.
+func splitNamespace(stored string) (ns, name string) {
+	if ns, name, ok := strings.Cut(stored, nsSep); ok {
+		return ns, name
+	}
+	return "", stored
+}
+
+// Namespace is a set of counters isolated from those of the DB's default
+// namespace and of other namespaces, such as the counters of a tenant.
+// It has its own default counter, which starts at zero.
+// Counters of namespaces are persisted and audited with the DB's own.
+type Namespace struct {
+	d      *DB
+	name   string
+	prefix string
+}
+
+// Namespace returns the namespace called name.
+// Its counters are created as they are first changed.
+func (d *DB) Namespace(name string) (*Namespace, error) {
+	if name == "" {
+		return nil, errors.New("empty namespace name")
+	}
+	if len(name) > maxNamespace {
+		return nil, errors.New("namespace name too long")
+	}
+	if inNamespace(name) {
+		return nil, errors.New("namespace name can't contain NUL")
+	}
+	return &Namespace{d: d, name: name, prefix: name + nsSep}, nil
+}
+
+// Namespaces returns the names of namespaces that have counters, sorted.
+func (d *DB) Namespaces() []string {
+	seen := make(map[string]bool)
+
+	d.counters.mu.RLock()
+	for name := range d.counters.m {
+		if ns, _ := splitNamespace(name); ns != "" {
+			seen[ns] = true
+		}
+	}
+	d.counters.mu.RUnlock()
+
+	namespaces := make([]string, 0, len(seen))
+	for ns := range seen {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Name returns the name of the namespace.
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+func (n *Namespace) validName(name string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if len(n.prefix)+len(name) > maxCounterName {
+		return errors.New("counter name too long")
+	}
+	return nil
+}
+
+// Add adds delta to the counter called name, creating it if needed,
+// and returns its new value.
+func (n *Namespace) Add(name string, delta uint64) (uint64, error) {
+	if err := n.validName(name); err != nil {
+		return 0, err
+	}
+	return n.d.add(n.prefix+name, delta), nil
+}
+
+// AddWithin adds delta to the counter called name, creating it if needed,
+// unless that would take it above limit. It returns the counter's value
+// and whether delta was added.
+func (n *Namespace) AddWithin(name string, delta, limit uint64) (uint64, bool, error) {
+	if err := n.validName(name); err != nil {
+		return 0, false, err
+	}
+
+	v, added := n.d.addWithin(n.prefix+name, delta, limit)
+	return v, added, nil
+}
+
+// Get returns the value of the counter called name, and whether it exists.
+// The default counter always exists.
+func (n *Namespace) Get(name string) (uint64, bool) {
+	if inNamespace(name) {
+		return 0, false
+	}
+
+	v, ok := n.d.get(n.prefix + name)
+	if !ok && name == DefaultCounter {
+		return 0, true
+	}
+	return v, ok
+}
+
+// Set sets the counter called name to v, creating it if needed.
+func (n *Namespace) Set(ctx context.Context, name string, v uint64) error {
+	if err := n.validName(name); err != nil {
+		return err
+	}
+
+	n.d.set(ctx, n.prefix+name, v)
+	return nil
+}
+
+// Reset sets the existing counter called name to zero.
+func (n *Namespace) Reset(ctx context.Context, name string) error {
+	if inNamespace(name) {
+		return ErrNotFound
+	}
+	return n.d.reset(ctx, n.prefix+name, name == DefaultCounter)
+}
+
+// Delete removes the counter called name and reports whether it existed.
+// The default counter can't be removed, so it is reset to zero instead.
+func (n *Namespace) Delete(ctx context.Context, name string) bool {
+	if name == DefaultCounter {
+		return n.Reset(ctx, name) == nil
+	}
+	if inNamespace(name) {
+		return false
+	}
+	return n.d.remove(ctx, n.prefix+name)
+}
+
+// Rename renames the counter called from to to, keeping its value.
+// The default counter can't be renamed, or replaced by another.
+func (n *Namespace) Rename(ctx context.Context, from, to string) error {
+	if err := n.validName(to); err != nil {
+		return err
+	}
+	if from == DefaultCounter || to == DefaultCounter {
+		return errors.New("can't rename the " + DefaultCounter + " counter")
+	}
+	if inNamespace(from) {
+		return ErrNotFound
+	}
+	return n.d.rename(ctx, n.prefix+from, n.prefix+to)
+}
+
+// Names returns the names of all counters of the namespace,
+// including the default one, sorted.
+func (n *Namespace) Names() []string {
+	names := []string{DefaultCounter}
+
+	n.d.counters.mu.RLock()
+	for name := range n.d.counters.m {
+		if strings.HasPrefix(name, n.prefix) && name[len(n.prefix):] != DefaultCounter {
+			names = append(names, name[len(n.prefix):])
+		}
+	}
+	n.d.counters.mu.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
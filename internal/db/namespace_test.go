@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	os.Remove(auditFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+	defer os.Remove(auditFile("test.test"))
+
+	ctx := context.Background()
+	d := NewDB("test.test")
+	if err := d.EnableAudit(); err != nil {
+		t.Fatal(err)
+	}
+
+	acme, err := d.Namespace("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := d.Namespace("other")
+
+	if v, ok := acme.Get(DefaultCounter); !ok || v != 0 {
+		t.Fatalf("expected new namespace to start at zero, got %d", v)
+	}
+	if v, _ := acme.Add(DefaultCounter, 3); v != 3 {
+		t.Fatalf("expected 3, got %d", v)
+	}
+	acme.Add("a", 1)
+	other.Add("a", 5)
+	d.Add("a", 7)
+
+	if v, _ := d.Get(DefaultCounter); v != 0 {
+		t.Fatalf("expected default counter of the db to be untouched, got %d", v)
+	}
+	if v, _ := acme.Get("a"); v != 1 {
+		t.Fatalf("expected a of acme to be 1, got %d", v)
+	}
+	if v, _ := d.Get("a"); v != 7 {
+		t.Fatalf("expected a of the db to be 7, got %d", v)
+	}
+
+	// counters of a namespace can't be reached from outside it.
+	if _, ok := d.Get("acme\x00a"); ok {
+		t.Fatal("expected namespaced counter to be hidden")
+	}
+	if _, err := d.Add("acme\x00a", 1); err == nil {
+		t.Fatal("expected name with NUL to be refused")
+	}
+	if d.Delete(ctx, "acme\x00a") {
+		t.Fatal("expected namespaced counter not to be deleted")
+	}
+
+	if names := d.Names(); !reflect.DeepEqual(names, []string{"a", DefaultCounter}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+	if names := acme.Names(); !reflect.DeepEqual(names, []string{"a", DefaultCounter}) {
+		t.Fatalf("unexpected names of acme %v", names)
+	}
+	if ns := d.Namespaces(); !reflect.DeepEqual(ns, []string{"acme", "other"}) {
+		t.Fatalf("unexpected namespaces %v", ns)
+	}
+
+	if err := acme.Rename(ctx, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if !acme.Delete(ctx, DefaultCounter) {
+		t.Fatal("expected default counter to be reset")
+	}
+	if v, _ := acme.Get(DefaultCounter); v != 0 {
+		t.Fatalf("expected default counter to be reset, got %d", v)
+	}
+
+	entries, err := d.QueryAudit(AuditQuery{Namespace: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Counter != "a" || entries[0].To != "b" || entries[1].Action != "reset" {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+
+	// namespaces are persisted with the other counters.
+	if err := d.saveCounters(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = NewDB("test.test")
+	defer d.Close()
+
+	other, _ = d.Namespace("other")
+	if v, _ := other.Get("a"); v != 5 {
+		t.Fatalf("expected a of other to be loaded as 5, got %d", v)
+	}
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	expvar.Publish("db", expvar.Func(func() interface{} {
+		return AllStats()
+	}))
+}
+
+// open are the dbs not yet closed, for AllStats.
+var open struct {
+	mu  sync.Mutex
+	dbs map[*DB]struct{}
+}
+
+func opened(d *DB) {
+	open.mu.Lock()
+	if open.dbs == nil {
+		open.dbs = make(map[*DB]struct{})
+	}
+	open.dbs[d] = struct{}{}
+	open.mu.Unlock()
+}
+
+func closed(d *DB) {
+	open.mu.Lock()
+	delete(open.dbs, d)
+	open.mu.Unlock()
+}
+
+// Stats describe a db and its flusher.
+type Stats struct {
+	File     string `json:"file"`
+	Count    uint64 `json:"count"`
+	Counters int    `json:"counters"`
+	Watchers int32  `json:"watchers"`
+
+	// FlushPending is set if changes are waiting for the flusher.
+	FlushPending      bool          `json:"flush_pending"`
+	Flushes           uint64        `json:"flushes"`
+	FlushErrors       uint64        `json:"flush_errors"`
+	LastFlush         time.Time     `json:"last_flush"`
+	LastFlushDuration time.Duration `json:"last_flush_duration_ns"`
+	LastFlushError    string        `json:"last_flush_error,omitempty"`
+	LoadError         string        `json:"load_error,omitempty"`
+}
+
+// flushStats are updated by the flusher after every flush.
+type flushStats struct {
+	mu           sync.Mutex
+	flushes      uint64
+	errors       uint64
+	lastFlush    time.Time
+	lastDuration time.Duration
+}
+
+func (f *flushStats) flushed(start time.Time, err error) {
+	f.mu.Lock()
+	f.flushes++
+	if err != nil {
+		f.errors++
+	}
+	f.lastFlush = start
+	f.lastDuration = time.Since(start)
+	f.mu.Unlock()
+}
+
+// Stats returns the current stats of the db.
+func (d *DB) Stats() Stats {
+	s := Stats{
+		File:         d.file,
+		Count:        d.Count(),
+		Watchers:     atomic.LoadInt32(&d.watchers.n),
+		FlushPending: len(d.flush) > 0,
+	}
+
+	s.Counters = d.Len()
+
+	d.flushStats.mu.Lock()
+	s.Flushes = d.flushStats.flushes
+	s.FlushErrors = d.flushStats.errors
+	s.LastFlush = d.flushStats.lastFlush
+	s.LastFlushDuration = d.flushStats.lastDuration
+	d.flushStats.mu.Unlock()
+
+	if err := d.FlushErr(); err != nil {
+		s.LastFlushError = err.Error()
+	}
+	if err := d.LoadErr(); err != nil {
+		s.LoadError = err.Error()
+	}
+	return s
+}
+
+// AllStats returns the stats of every open db, by file.
+func AllStats() map[string]Stats {
+	open.mu.Lock()
+	dbs := make([]*DB, 0, len(open.dbs))
+	for d := range open.dbs {
+		dbs = append(dbs, d)
+	}
+	open.mu.Unlock()
+
+	m := make(map[string]Stats, len(dbs))
+	for _, d := range dbs {
+		m[d.file] = d.Stats()
+	}
+	return m
+}
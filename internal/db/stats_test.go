@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove(countersFile("test.test"))
+	defer os.Remove("test.test")
+	defer os.Remove(countersFile("test.test"))
+
+	ctx := context.Background()
+	d := NewDB("test.test")
+	d.AddCount(3)
+	if err := d.Set(ctx, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	s, ok := AllStats()["test.test"]
+	if !ok {
+		t.Fatal("expected stats of open db")
+	}
+	if s.Count != 3 || s.Counters != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	d.Close()
+	if _, ok := AllStats()["test.test"]; ok {
+		t.Fatal("expected closed db to be left out")
+	}
+
+	s = d.Stats()
+	if s.Flushes == 0 || s.FlushErrors != 0 || s.LastFlush.IsZero() {
+		t.Fatalf("expected changes to be flushed on close, got %+v", s)
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type watchers struct {
+	n  int32 // number of watchers, read without lock on the hot path
+	mu sync.Mutex
+	cs map[chan struct{}]struct{}
+}
+
+// Watch returns a channel that receives a notification after the count
+// changes, and a func to stop watching. Notifications are coalesced,
+// so a single notification can stand for many changes.
+func (d *DB) Watch() (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+
+	d.watchers.mu.Lock()
+	if d.watchers.cs == nil {
+		d.watchers.cs = make(map[chan struct{}]struct{})
+	}
+	d.watchers.cs[c] = struct{}{}
+	atomic.AddInt32(&d.watchers.n, 1)
+	d.watchers.mu.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			d.watchers.mu.Lock()
+			delete(d.watchers.cs, c)
+			atomic.AddInt32(&d.watchers.n, -1)
+			d.watchers.mu.Unlock()
+		})
+	}
+}
+
+func (d *DB) notifyWatchers() {
+	if atomic.LoadInt32(&d.watchers.n) == 0 {
+		return
+	}
+
+	d.watchers.mu.Lock()
+	for c := range d.watchers.cs {
+		if len(c) == 0 {
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}
+	d.watchers.mu.Unlock()
+}
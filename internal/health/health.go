@@ -0,0 +1,97 @@
+// Package health serves health checks and probes them
+// from images without a shell or http client.
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// checkTimeout bounds the time all checks of a request can take.
+const checkTimeout = time.Second * 2
+
+// Check returns an error if what it checks is unhealthy.
+type Check func(ctx context.Context) error
+
+// Checks are named checks, all of which must pass to be healthy.
+type Checks map[string]Check
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// ServeHTTP runs the checks and responds with their results as JSON,
+// with status 200 if all passed and 503 otherwise.
+func (c Checks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	results := make(chan result, len(c))
+	for name, check := range c {
+		go func(name string, check Check) {
+			results <- result{name, check(ctx)}
+		}(name, check)
+	}
+
+	resp := response{Status: "ok", Checks: make(map[string]string, len(c))}
+	status := http.StatusOK
+	for range c {
+		res := <-results
+		if res.err != nil {
+			resp.Checks[res.name] = res.err.Error()
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		} else {
+			resp.Checks[res.name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Probe requests path from the server listening on listenAddr,
+// e.g. ":8083", over TLS if set, and returns an error unless it responds with 200.
+func Probe(listenAddr, path string, useTLS bool) error {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+
+	scheme := "http://"
+	client := http.Client{Timeout: checkTimeout + time.Second}
+	if useTLS {
+		// the server's certificate is for its service name,
+		// not localhost, and this only checks that it is up.
+		scheme = "https://"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	resp, err := client.Get(scheme + net.JoinHostPort(host, port) + path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(path + " returned " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RoanBrand/RequestCounter/internal/health"
+)
+
+func TestChecks(t *testing.T) {
+	var failing error
+	checks := health.Checks{
+		"ok":    func(context.Context) error { return nil },
+		"flaky": func(context.Context) error { return failing },
+	}
+
+	srv := httptest.NewServer(checks)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	if err := health.Probe(addr, "/", false); err != nil {
+		t.Fatal(err)
+	}
+
+	failing = errors.New("down")
+	if err := health.Probe(addr, "/", false); err == nil {
+		t.Fatal("expected probe to fail")
+	}
+
+	rec := httptest.NewRecorder()
+	checks.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatal(rec.Code)
+	}
+
+	var resp struct {
+		Status string
+		Checks map[string]string
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "unavailable" || resp.Checks["ok"] != "ok" || resp.Checks["flaky"] != "down" {
+		t.Fatal(resp)
+	}
+}
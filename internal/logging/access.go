@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/statuswriter"
+)
+
+// accessLogSample is the ratio of successful requests to sampled
+// handlers that are logged.
+var accessLogSample uint64 = math.Float64bits(1)
+
+// SetAccessLogSample sets the ratio of successful requests
+// to sampled handlers that are logged.
+func SetAccessLogSample(ratio float64) {
+	atomic.StoreUint64(&accessLogSample, math.Float64bits(ratio))
+}
+
+// AccessLog logs each request served by h with its method, path, status,
+// duration and remote address. For high volume handlers, set sampled to log
+// only a ratio of successful requests, with the ratio as "sample". Requests
+// that fail with a 5xx status are always logged, as warnings.
+func AccessLog(sampled bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := statuswriter.Wrap(w)
+		h.ServeHTTP(sw, r)
+
+		status := sw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		level := LevelInfo
+		fields := []Field{
+			{"method", r.Method},
+			{"path", r.URL.Path},
+			{"status", status},
+			{"duration_ms", time.Since(start)},
+			{"remote_addr", r.RemoteAddr},
+		}
+
+		if status >= http.StatusInternalServerError {
+			level = LevelWarn
+		} else if sampleRatio := math.Float64frombits(atomic.LoadUint64(&accessLogSample)); sampled && sampleRatio < 1 {
+			if rand.Float64() >= sampleRatio {
+				return
+			}
+			fields = append(fields, Field{"sample", sampleRatio})
+		}
+
+		l := Ctx(r.Context())
+		if l.Enabled(level) {
+			l.log(level, "request", fields)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/pkg/errors"
+)
+
+var (
+	defaultMu sync.RWMutex
+	std       = New(os.Stderr, LevelInfo, false)
+)
+
+// Default returns the logger used by the package level functions.
+func Default() *Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return std
+}
+
+// SetDefault replaces the default logger. Lines written with the standard
+// library log package, like those of dependencies, are also logged with it.
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	std = l
+	defaultMu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdlibWriter{})
+}
+
+func Debug(msg string, fields ...Field) { Default().log(LevelDebug, msg, fields) }
+func Info(msg string, fields ...Field)  { Default().log(LevelInfo, msg, fields) }
+func Warn(msg string, fields ...Field)  { Default().log(LevelWarn, msg, fields) }
+func Error(msg string, fields ...Field) { Default().log(LevelError, msg, fields) }
+
+// stdlibWriter logs lines written by the log package as info entries.
+type stdlibWriter struct{}
+
+func (stdlibWriter) Write(p []byte) (int, error) {
+	Default().log(LevelInfo, string(bytes.TrimRight(p, "\n")), []Field{{"logger", "stdlib"}})
+	return len(p), nil
+}
+
+// Settings configure the default logger, see SetupFrom.
+var Settings = []config.Setting{
+	{Name: "LOG_LEVEL", Default: "info", Usage: "debug, info, warn or error", Reloadable: true},
+	{Name: "LOG_FORMAT", Default: "json", Usage: "json or text", Reloadable: true},
+	{Name: "ACCESS_LOG_SAMPLE_RATIO", Kind: config.Float, Default: "1", Usage: "ratio of successful requests to sampled handlers to log", Reloadable: true},
+}
+
+// SetupFrom sets the default logger to write to stderr with
+// service and hostname fields, configured by Settings.
+func SetupFrom(service string, get config.Getter) error {
+	level, err := ParseLevel(get("LOG_LEVEL"))
+	if err != nil {
+		return errors.WithMessage(err, "LOG_LEVEL")
+	}
+
+	var text bool
+	switch f := get("LOG_FORMAT"); f {
+	case "", "json":
+	case "text":
+		text = true
+	default:
+		return errors.New("LOG_FORMAT: unknown format " + strconv.Quote(f))
+	}
+
+	if v := get("ACCESS_LOG_SAMPLE_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return errors.New("ACCESS_LOG_SAMPLE_RATIO: invalid ratio " + strconv.Quote(v))
+		}
+		SetAccessLogSample(ratio)
+	}
+
+	fields := []Field{{"service", service}}
+	if hostname, err := os.Hostname(); err == nil {
+		fields = append(fields, Field{"hostname", hostname})
+	}
+
+	SetDefault(New(os.Stderr, level, text).With(fields...))
+	return nil
+}
+
+// ConfigReload logs the outcome of a config reload, see config.Config.ReloadOnChange:
+// its error, or each setting changed, warning of those that need a restart.
+func ConfigReload(changes []config.Change, err error) {
+	if err != nil {
+		Error("config not reloaded", Err(err))
+		return
+	}
+
+	if len(changes) == 0 {
+		Info("config reloaded, nothing changed")
+	}
+	for _, ch := range changes {
+		from, to := ch.Values()
+		fields := []Field{F("setting", ch.Setting.Name), F("old", from), F("new", to)}
+		if ch.Setting.Reloadable {
+			Info("config changed", fields...)
+		} else {
+			Warn("config changed, but needs a restart to take effect", fields...)
+		}
+	}
+}
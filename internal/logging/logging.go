@@ -0,0 +1,246 @@
+// Package logging writes structured, leveled logs as JSON lines,
+// or as text for reading in a terminal.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, errors.New("unknown log level " + s)
+}
+
+// Field is a key and value added to a log entry.
+// Error values are logged as their message, with the
+// stack trace of github.com/pkg/errors errors as "stack".
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Err is the field for logging err under "error".
+func Err(err error) Field {
+	return Field{"error", err}
+}
+
+// output is where a logger and those derived from it write to.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	text  bool
+}
+
+// Logger writes entries with its fields, at or above its level.
+type Logger struct {
+	out    *output
+	fields []Field
+}
+
+// New returns a logger writing JSON lines to w, or text if text is set.
+func New(w io.Writer, level Level, text bool) *Logger {
+	return &Logger{out: &output{w: w, level: level, text: text}}
+}
+
+// With returns a logger that adds fields to every entry.
+func (l *Logger) With(fields ...Field) *Logger {
+	if len(fields) == 0 {
+		return l
+	}
+	return &Logger{
+		out:    l.out,
+		fields: append(append([]Field(nil), l.fields...), fields...),
+	}
+}
+
+// Enabled reports whether entries at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var b bytes.Buffer
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if l.out.text {
+		b.WriteString(now)
+		b.WriteByte(' ')
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteByte(' ')
+		b.WriteString(msg)
+	} else {
+		b.WriteString(`{"time":"`)
+		b.WriteString(now)
+		b.WriteString(`","level":"`)
+		b.WriteString(level.String())
+		b.WriteString(`","msg":`)
+		writeJSON(&b, msg)
+	}
+
+	var stack string
+	add := func(f Field) {
+		v := f.Value
+		if err, ok := v.(error); ok {
+			if stack == "" {
+				stack = stackOf(err)
+			}
+			v = err.Error()
+		}
+		l.writeField(&b, f.Key, v)
+	}
+	for _, f := range l.fields {
+		add(f)
+	}
+	for _, f := range fields {
+		add(f)
+	}
+	if stack != "" {
+		l.writeField(&b, "stack", stack)
+	}
+
+	if !l.out.text {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	l.out.mu.Lock()
+	l.out.w.Write(b.Bytes())
+	l.out.mu.Unlock()
+}
+
+func (l *Logger) writeField(b *bytes.Buffer, key string, v interface{}) {
+	if l.out.text {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		if s, ok := v.(string); ok {
+			if strings.ContainsAny(s, " \"=\n") {
+				s = strconv.Quote(s)
+			}
+			b.WriteString(s)
+		} else {
+			fmt.Fprint(b, v)
+		}
+		return
+	}
+
+	b.WriteByte(',')
+	writeJSON(b, key)
+	b.WriteByte(':')
+	writeJSON(b, v)
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case time.Duration:
+		// durations are logged in milliseconds.
+		b.WriteString(strconv.FormatFloat(float64(v)/float64(time.Millisecond), 'f', -1, 64))
+		return
+	case fmt.Stringer:
+		if _, ok := v.(json.Marshaler); !ok {
+			writeJSON(b, v.String())
+			return
+		}
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+// stackOf returns the stack trace recorded by the innermost
+// github.com/pkg/errors error that err wraps, if any.
+func stackOf(err error) string {
+	type stackTracer interface {
+		StackTrace() errors.StackTrace
+	}
+
+	var st errors.StackTrace
+	for err != nil {
+		if s, ok := err.(stackTracer); ok {
+			st = s.StackTrace()
+		}
+		if c, ok := err.(interface{ Cause() error }); ok {
+			err = c.Cause()
+		} else {
+			err = errors.Unwrap(err)
+		}
+	}
+
+	if st == nil {
+		return ""
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%+v", st), "\n")
+}
+
+type ctxKey struct{}
+
+// ContextWith returns ctx with fields added to those of
+// the logger returned by Ctx for it.
+func ContextWith(ctx context.Context, fields ...Field) context.Context {
+	prev, _ := ctx.Value(ctxKey{}).([]Field)
+	return context.WithValue(ctx, ctxKey{}, append(append([]Field(nil), prev...), fields...))
+}
+
+// Ctx returns the default logger with the fields added to ctx.
+func Ctx(ctx context.Context) *Logger {
+	fields, _ := ctx.Value(ctxKey{}).([]Field)
+	return Default().With(fields...)
+}
@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, LevelInfo, false).With(F("service", "test"))
+
+	l.Debug("hidden")
+	l.Error("failed", Err(errors.Wrap(errors.New("boom"), "doing it")), F("took", time.Millisecond*1500))
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %q", b.String())
+	}
+
+	var e map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e["level"] != "error" || e["msg"] != "failed" || e["service"] != "test" || e["error"] != "doing it: boom" || e["took"] != 1500.0 {
+		t.Fatal(e)
+	}
+	if stack, _ := e["stack"].(string); !strings.Contains(stack, "TestJSON") {
+		t.Fatalf("expected stack of error, got %q", stack)
+	}
+}
+
+func TestText(t *testing.T) {
+	var b bytes.Buffer
+	New(&b, LevelDebug, true).Debug("hello", F("who", "the world"), F("n", 2))
+
+	if !strings.HasSuffix(b.String(), ` DEBUG hello who="the world" n=2`+"\n") {
+		t.Fatal(b.String())
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var b bytes.Buffer
+	prev := Default()
+	SetDefault(New(&b, LevelInfo, false))
+	defer SetDefault(prev)
+
+	SetAccessLogSample(0)
+	defer SetAccessLogSample(1)
+
+	h := AccessLog(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	for _, path := range []string{"/", "/fail"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r = r.WithContext(ContextWith(context.Background(), F("request_id", "abc")))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	var e map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatalf("expected a single entry for the failed request: %v: %s", err, b.String())
+	}
+	if e["level"] != "warn" || e["path"] != "/fail" || e["status"] != 502.0 || e["request_id"] != "abc" {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/statuswriter"
+)
+
+var (
+	httpInFlight = NewGaugeVec("http_requests_in_flight", "Number of http requests being served.", "handler")
+	httpDuration = NewHistogramVec("http_request_duration_seconds", "Latency of served http requests.", DefBuckets, "handler", "code")
+)
+
+// InstrumentHandler records the latency, status code and
+// in-flight count of requests served by h under name.
+func InstrumentHandler(name string, h http.Handler) http.Handler {
+	inFlight := httpInFlight.With(name)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		sw := statuswriter.Wrap(w)
+		h.ServeHTTP(sw, r)
+
+		status := sw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpDuration.With(name, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,498 @@
+// Package metrics exposes metrics in the Prometheus text format,
+// without depending on the Prometheus client library.
+//
+// Like expvar, metrics are created as package level variables and
+// registered in a default registry, served by Handler. Metrics of
+// something that can be created more than once, like a server, go in
+// a Registry of its own instead, so that they are not registered twice.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are histogram buckets suited to request latencies in seconds.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// family is a named metric, written with its samples when scraped.
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics served in the Prometheus text format.
+type Registry struct {
+	mu       sync.RWMutex
+	families map[string]family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+// Default is the registry metrics created by this package's
+// New* functions are added to.
+var Default = NewRegistry()
+
+// Handler serves the Default registry, followed by rs.
+func Handler(rs ...*Registry) http.Handler {
+	if len(rs) == 0 {
+		return Default
+	}
+	return registries(append([]*Registry{Default}, rs...))
+}
+
+// registries are served together, their metric names must not overlap.
+type registries []*Registry
+
+func (rs registries) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	for _, r := range rs {
+		if _, err := r.WriteTo(w); err != nil {
+			return
+		}
+	}
+}
+
+// register adds f under name. Like expvar, it panics
+// if the name is already registered.
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.families[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.families[name] = f
+}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	r.WriteTo(w)
+}
+
+// WriteTo writes all metrics, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]family, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		families[i] = r.families[name]
+	}
+	r.mu.RUnlock()
+
+	cw := countingWriter{w: w}
+	bw := bufio.NewWriter(&cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	w.WriteString("# HELP ")
+	w.WriteString(name)
+	w.WriteByte(' ')
+	w.WriteString(strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	w.WriteString("\n# TYPE ")
+	w.WriteString(name)
+	w.WriteByte(' ')
+	w.WriteString(typ)
+	w.WriteByte('\n')
+}
+
+// writeSample writes a sample line. values are those of labels, in order,
+// and extra holds additional label name and value pairs, like a histogram's "le".
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra []string, v float64) {
+	w.WriteString(name)
+	if len(labels)+len(extra) > 0 {
+		w.WriteByte('{')
+		sep := false
+		write := func(l, v string) {
+			if sep {
+				w.WriteByte(',')
+			}
+			sep = true
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(labelReplacer.Replace(v))
+			w.WriteByte('"')
+		}
+		for i, l := range labels {
+			write(l, values[i])
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			write(extra[i], extra[i+1])
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(delta uint64) {
+	atomic.AddUint64(&c.v, delta)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 // per bucket, not cumulative; last is +Inf
+	sumBits     uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upperBounds: buckets,
+		counts:      make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, updated) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels, values []string) {
+	var cumulative uint64
+	for i, ub := range h.upperBounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, name+"_bucket", labels, values, []string{"le", formatFloat(ub)}, float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+	writeSample(w, name+"_bucket", labels, values, []string{"le", "+Inf"}, float64(cumulative))
+	writeSample(w, name+"_sum", labels, values, nil, math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+	writeSample(w, name+"_count", labels, values, nil, float64(cumulative))
+}
+
+// single is a family of one unlabeled metric.
+type single struct {
+	name, help, typ string
+	writeFn         func(w *bufio.Writer)
+}
+
+func (s *single) write(w *bufio.Writer) {
+	writeHeader(w, s.name, s.help, s.typ)
+	s.writeFn(w)
+}
+
+// NewCounter creates and registers a counter in Default.
+func NewCounter(name, help string) *Counter {
+	return Default.NewCounter(name, help)
+}
+
+// NewCounter creates and registers a counter in r.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, &single{name, help, "counter", func(w *bufio.Writer) {
+		writeSample(w, name, nil, nil, nil, float64(c.Value()))
+	}})
+	return c
+}
+
+// NewGauge creates and registers a gauge in Default.
+func NewGauge(name, help string) *Gauge {
+	return Default.NewGauge(name, help)
+}
+
+// NewGauge creates and registers a gauge in r.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, &single{name, help, "gauge", func(w *bufio.Writer) {
+		writeSample(w, name, nil, nil, nil, g.Value())
+	}})
+	return g
+}
+
+// NewHistogram creates and registers a histogram with the
+// given bucket upper bounds, in increasing order, in Default.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+// NewHistogram creates and registers a histogram with the
+// given bucket upper bounds, in increasing order, in r.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(name, &single{name, help, "histogram", func(w *bufio.Writer) {
+		h.write(w, name, nil, nil)
+	}})
+	return h
+}
+
+// NewCounterFunc registers a counter in Default whose value is returned by f.
+func NewCounterFunc(name, help string, f func() float64) {
+	Default.NewCounterFunc(name, help, f)
+}
+
+// NewCounterFunc registers a counter in r whose value is returned by f.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(name, &single{name, help, "counter", func(w *bufio.Writer) {
+		writeSample(w, name, nil, nil, nil, f())
+	}})
+}
+
+// NewGaugeFunc registers a gauge in Default whose value is returned by f.
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.NewGaugeFunc(name, help, f)
+}
+
+// NewGaugeFunc registers a gauge in r whose value is returned by f.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, &single{name, help, "gauge", func(w *bufio.Writer) {
+		writeSample(w, name, nil, nil, nil, f())
+	}})
+}
+
+// NewGaugeVecFunc registers a gauge in Default with a value per
+// value of label, returned by f.
+func NewGaugeVecFunc(name, help, label string, f func() map[string]float64) {
+	Default.NewGaugeVecFunc(name, help, label, f)
+}
+
+// NewGaugeVecFunc registers a gauge in r with a value per
+// value of label, returned by f.
+func (r *Registry) NewGaugeVecFunc(name, help, label string, f func() map[string]float64) {
+	r.register(name, &single{name, help, "gauge", func(w *bufio.Writer) {
+		m := f()
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		labels := []string{label}
+		for _, k := range keys {
+			writeSample(w, name, labels, []string{k}, nil, m[k])
+		}
+	}})
+}
+
+// vec is a family of metrics of the same type, one per combination of label values.
+type vec struct {
+	name, help, typ string
+	labels          []string
+	newMetric       func() interface{}
+	writeFn         func(w *bufio.Writer, m interface{}, values []string)
+
+	mu      sync.RWMutex
+	metrics map[string]interface{}
+	values  map[string][]string
+}
+
+func newVec(r *Registry, name, help, typ string, labels []string, newMetric func() interface{}, write func(*bufio.Writer, interface{}, []string)) *vec {
+	v := &vec{
+		name:      name,
+		help:      help,
+		typ:       typ,
+		labels:    labels,
+		newMetric: newMetric,
+		writeFn:   write,
+		metrics:   make(map[string]interface{}),
+		values:    make(map[string][]string),
+	}
+	r.register(name, v)
+	return v
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + " expects " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	m, ok := v.metrics[key]
+	v.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m, ok = v.metrics[key]; !ok {
+		m = v.newMetric()
+		v.metrics[key] = m
+		v.values[key] = append([]string(nil), values...)
+	}
+	return m
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.metrics))
+	for k := range v.metrics {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	writeHeader(w, v.name, v.help, v.typ)
+	for _, k := range keys {
+		v.mu.RLock()
+		m, values := v.metrics[k], v.values[k]
+		v.mu.RUnlock()
+		v.writeFn(w, m, values)
+	}
+}
+
+// CounterVec is a counter per combination of label values.
+type CounterVec struct {
+	v *vec
+}
+
+// NewCounterVec creates and registers a labeled counter in Default.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// NewCounterVec creates and registers a labeled counter in r.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(r, name, help, "counter", labels,
+		func() interface{} { return &Counter{} },
+		func(w *bufio.Writer, m interface{}, values []string) {
+			writeSample(w, name, labels, values, nil, float64(m.(*Counter).Value()))
+		},
+	)}
+}
+
+// With returns the counter for the label values, in the order of the labels.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.v.with(values).(*Counter)
+}
+
+// GaugeVec is a gauge per combination of label values.
+type GaugeVec struct {
+	v *vec
+}
+
+// NewGaugeVec creates and registers a labeled gauge in Default.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+// NewGaugeVec creates and registers a labeled gauge in r.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(r, name, help, "gauge", labels,
+		func() interface{} { return &Gauge{} },
+		func(w *bufio.Writer, m interface{}, values []string) {
+			writeSample(w, name, labels, values, nil, m.(*Gauge).Value())
+		},
+	)}
+}
+
+// With returns the gauge for the label values, in the order of the labels.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.v.with(values).(*Gauge)
+}
+
+// HistogramVec is a histogram per combination of label values.
+type HistogramVec struct {
+	v *vec
+}
+
+// NewHistogramVec creates and registers a labeled histogram in Default.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// NewHistogramVec creates and registers a labeled histogram in r.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{newVec(r, name, help, "histogram", labels,
+		func() interface{} { return newHistogram(buckets) },
+		func(w *bufio.Writer, m interface{}, values []string) {
+			m.(*Histogram).write(w, name, labels, values)
+		},
+	)}
+}
+
+// With returns the histogram for the label values, in the order of the labels.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.v.with(values).(*Histogram)
+}
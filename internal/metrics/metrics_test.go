@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_counter_total", "A test counter.")
+	c.Add(3)
+
+	g := r.NewGaugeVec("test_gauge", "A test gauge.", "name")
+	g.With(`a"b`).Set(1.5)
+
+	h := r.NewHistogram("test_duration_seconds", "A test histogram.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	r.NewGaugeVecFunc("test_values", "Test values.", "counter", func() map[string]float64 {
+		return map[string]float64{"y": 2, "x": 1}
+	})
+
+	rec := httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := rec.Body.String()
+
+	expected := []string{
+		"# HELP test_counter_total A test counter.\n# TYPE test_counter_total counter\ntest_counter_total 3\n",
+		"# TYPE test_gauge gauge\ntest_gauge{name=\"a\\\"b\"} 1.5\n",
+		"test_duration_seconds_bucket{le=\"0.1\"} 1\n" +
+			"test_duration_seconds_bucket{le=\"1\"} 2\n" +
+			"test_duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"test_duration_seconds_sum 5.55\n" +
+			"test_duration_seconds_count 3\n",
+		"test_values{counter=\"x\"} 1\ntest_values{counter=\"y\"} 2\n",
+		"# TYPE go_goroutines gauge\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected output to contain:\n%s\ngot:\n%s", e, out)
+		}
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	h := InstrumentHandler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("expected flusher")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := rec.Body.String()
+
+	for _, e := range []string{
+		`http_request_duration_seconds_count{handler="test",code="418"} `,
+		`http_requests_in_flight{handler="test"} 0`,
+	} {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected output to contain %s", e)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"runtime"
+	"strings"
+	"time"
+)
+
+func init() {
+	Default.register("go", runtimeFamily{})
+	Default.register("expvar", expvarFamily{})
+
+	start := float64(time.Now().UnixNano()) / 1e9
+	NewGaugeFunc("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", func() float64 {
+		return start
+	})
+}
+
+// runtimeFamily writes Go runtime stats, read once per scrape.
+type runtimeFamily struct{}
+
+func (runtimeFamily) write(w *bufio.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauge := func(name, help string, v float64) {
+		writeHeader(w, name, help, "gauge")
+		writeSample(w, name, nil, nil, nil, v)
+	}
+	counter := func(name, help string, v float64) {
+		writeHeader(w, name, help, "counter")
+		writeSample(w, name, nil, nil, nil, v)
+	}
+
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	writeHeader(w, "go_info", "Information about the Go environment.", "gauge")
+	writeSample(w, "go_info", []string{"version"}, []string{runtime.Version()}, nil, 1)
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc))
+	counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(ms.TotalAlloc))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects))
+	counter("go_memstats_mallocs_total", "Total number of mallocs.", float64(ms.Mallocs))
+	counter("go_memstats_frees_total", "Total number of frees.", float64(ms.Frees))
+	counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(ms.NumGC))
+	counter("go_gc_pause_seconds_total", "Total time GC has stopped the world.", float64(ms.PauseTotalNs)/1e9)
+	gauge("go_memstats_last_gc_time_seconds", "Time of the last GC since unix epoch in seconds.", float64(ms.LastGC)/1e9)
+}
+
+// expvarFamily writes the integer and float expvar vars,
+// so those already published there are scraped too.
+// Their type is not known, so they are untyped.
+type expvarFamily struct{}
+
+func (expvarFamily) write(w *bufio.Writer) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		var v float64
+		switch ev := kv.Value.(type) {
+		case *expvar.Int:
+			v = float64(ev.Value())
+		case *expvar.Float:
+			v = ev.Value()
+		default:
+			return
+		}
+
+		name := "expvar_" + strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+				return r
+			}
+			return '_'
+		}, kv.Key)
+
+		writeHeader(w, name, "expvar "+kv.Key+".", "untyped")
+		writeSample(w, name, nil, nil, nil, v)
+	})
+}
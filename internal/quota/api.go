@@ -0,0 +1,99 @@
+package quota
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+)
+
+const maxQuotaSize = 64 * 1024
+
+// ServeHTTP serves the quotas admin API, relative to where it is mounted:
+//
+//	GET    /      list quotas
+//	POST   /      add or replace a quota
+//	GET    /{id}  get a quota
+//	PUT    /{id}  add or replace a quota
+//	DELETE /{id}  delete a quota
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, m.Quotas())
+
+	case id == "" && r.Method == http.MethodPost, id != "" && r.Method == http.MethodPut:
+		var q Quota
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxQuotaSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&q); err != nil {
+			requestid.Error(w, r, "invalid quota: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if id != "" {
+			q.ID = id
+		}
+
+		if err := q.validate(); err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := m.Put(q); err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, q)
+
+	case id != "" && r.Method == http.MethodGet:
+		q, ok := m.get(id)
+		if !ok {
+			requestid.Error(w, r, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, q)
+
+	case id != "" && r.Method == http.MethodDelete:
+		ok, err := m.Delete(id)
+		if err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			requestid.Error(w, r, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		requestid.Error(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// SetHeaders sets the quota headers of a response for u,
+// and Retry-After if it is not allowed.
+func SetHeaders(h http.Header, u Usage) {
+	h.Set(LimitHeader, strconv.FormatUint(u.Limit, 10))
+	h.Set(RemainingHeader, strconv.FormatUint(u.Remaining, 10))
+	h.Set(ResetHeader, strconv.FormatInt(u.Reset.Unix(), 10))
+	if !u.Allowed {
+		secs := int64(math.Ceil(time.Until(u.Reset).Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		h.Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,354 @@
+// Package quota enforces quotas, such as 10,000 requests per day,
+// on windowed counters: named counters that start from zero every window.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// Headers describing a quota in responses.
+const (
+	LimitHeader     = "X-Quota-Limit"
+	RemainingHeader = "X-Quota-Remaining"
+	ResetHeader     = "X-Quota-Reset" // unix seconds
+)
+
+// Header names the quota an increment request is taken from.
+const Header = "X-Quota"
+
+const cleanupInterval = time.Minute
+
+var ErrNotFound = errors.New("quota not found")
+
+// Duration is a time.Duration that is a string like "24h" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string like \"24h\"")
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Quota allows up to Limit increments per Window of the windowed counters
+// named Counter. Windows are aligned to the unix epoch, so a window of 24h
+// starts at midnight UTC.
+type Quota struct {
+	ID      string   `json:"id"`
+	Counter string   `json:"counter"`
+	Limit   uint64   `json:"limit"`
+	Window  Duration `json:"window"`
+}
+
+func (q *Quota) validate() error {
+	if q.ID == "" {
+		return errors.New("quota id required")
+	}
+	if strings.Contains(q.ID, "/") {
+		return errors.New("quota id can't contain /")
+	}
+	if q.Counter == "" {
+		return errors.New("quota counter required")
+	}
+	if q.Counter == db.DefaultCounter {
+		return errors.New("quota counter can't be the " + db.DefaultCounter + " counter")
+	}
+	if q.Limit == 0 {
+		return errors.New("quota limit required")
+	}
+	if w := time.Duration(q.Window); w < time.Second || w%time.Second != 0 {
+		return errors.New("quota window must be whole seconds")
+	}
+	return nil
+}
+
+// window returns the start of the window at t.
+func (q *Quota) window(t time.Time) time.Time {
+	secs := int64(time.Duration(q.Window) / time.Second)
+	unix := t.Unix()
+	return time.Unix(unix-unix%secs, 0).UTC()
+}
+
+// CounterName returns the name of the counter of the window starting at start,
+// Counter@Window@start in RFC 3339, e.g. "acme@24h@2023-01-02T00:00:00Z".
+// Quotas on the same counter with different windows count in different counters.
+func (q *Quota) CounterName(start time.Time) string {
+	return q.counterPrefix() + start.UTC().Format(time.RFC3339)
+}
+
+// IsWindowCounter reports whether name is that of a window counter of a quota,
+// Counter@Window@start, which only quotas should change.
+func IsWindowCounter(name string) bool {
+	i := strings.LastIndexByte(name, '@')
+	if i < 0 {
+		return false
+	}
+	if _, err := time.Parse(time.RFC3339, name[i+1:]); err != nil {
+		return false
+	}
+
+	j := strings.LastIndexByte(name[:i], '@')
+	if j < 0 {
+		return false
+	}
+	_, err := time.ParseDuration(name[j+1 : i])
+	return err == nil
+}
+
+// counterPrefix is the start of the names of the quota's counters.
+func (q *Quota) counterPrefix() string {
+	w := time.Duration(q.Window).String()
+	if strings.HasSuffix(w, "m0s") {
+		w = w[:len(w)-2]
+	}
+	if strings.HasSuffix(w, "h0m") {
+		w = w[:len(w)-2]
+	}
+	return q.Counter + "@" + w + "@"
+}
+
+// Usage is the state of a quota in its current window.
+type Usage struct {
+	Quota     string    `json:"quota"`
+	Counter   string    `json:"counter"` // of the window
+	Limit     uint64    `json:"limit"`
+	Used      uint64    `json:"used"`
+	Remaining uint64    `json:"remaining"`
+	Reset     time.Time `json:"reset"` // when the next window starts
+	Allowed   bool      `json:"allowed"`
+}
+
+// Manager holds quotas and enforces them on db counters.
+type Manager struct {
+	db   *db.DB
+	file string
+	now  func() time.Time
+
+	mu     sync.Mutex
+	quotas map[string]Quota
+}
+
+// New loads quotas from file, which can be empty to not persist them.
+func New(d *db.DB, file string) (*Manager, error) {
+	m := Manager{db: d, file: file, now: time.Now, quotas: make(map[string]Quota)}
+	if file == "" {
+		return &m, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &m, nil
+		}
+		return nil, errors.Wrap(err, "unable to read "+file)
+	}
+
+	var quotas []Quota
+	if err := json.Unmarshal(b, &quotas); err != nil {
+		return nil, errors.Wrap(err, "unable to parse "+file)
+	}
+
+	for _, q := range quotas {
+		if err := q.validate(); err != nil {
+			return nil, errors.WithMessage(err, "quota "+q.ID)
+		}
+		m.quotas[q.ID] = q
+	}
+	return &m, nil
+}
+
+// Quotas returns all quotas, sorted by id.
+func (m *Manager) Quotas() []Quota {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	quotas := make([]Quota, 0, len(m.quotas))
+	for _, q := range m.quotas {
+		quotas = append(quotas, q)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].ID < quotas[j].ID })
+	return quotas
+}
+
+func (m *Manager) get(id string) (Quota, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.quotas[id]
+	return q, ok
+}
+
+// Put adds q, or replaces the quota with the same id.
+// A replaced quota keeps the usage of its counter's current window.
+func (m *Manager) Put(q Quota) error {
+	if err := q.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, ok := m.quotas[q.ID]
+	m.quotas[q.ID] = q
+	if err := m.save(); err != nil {
+		if ok {
+			m.quotas[q.ID] = prev
+		} else {
+			delete(m.quotas, q.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the quota with id and reports whether it existed.
+// The counters of its windows are left as they are.
+func (m *Manager) Delete(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, ok := m.quotas[id]
+	if !ok {
+		return false, nil
+	}
+
+	delete(m.quotas, id)
+	if err := m.save(); err != nil {
+		m.quotas[id] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *Manager) save() error {
+	if m.file == "" {
+		return nil
+	}
+
+	quotas := make([]Quota, 0, len(m.quotas))
+	for _, q := range m.quotas {
+		quotas = append(quotas, q)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].ID < quotas[j].ID })
+
+	b, err := json.MarshalIndent(quotas, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := m.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "unable to save "+m.file)
+	}
+	return errors.Wrap(os.Rename(tmp, m.file), "unable to save "+m.file)
+}
+
+// Take atomically adds n to the usage of quota id in its current window,
+// unless that would exceed its limit, in which case nothing is added
+// and the usage is not Allowed.
+func (m *Manager) Take(id string, n uint64) (Usage, error) {
+	q, ok := m.get(id)
+	if !ok {
+		return Usage{}, ErrNotFound
+	}
+
+	start := q.window(m.now())
+	name := q.CounterName(start)
+	used, allowed, err := m.db.AddWithin(name, n, q.Limit)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return q.usage(name, start, used, allowed), nil
+}
+
+// Usage returns the usage of quota id in its current window.
+func (m *Manager) Usage(id string) (Usage, error) {
+	q, ok := m.get(id)
+	if !ok {
+		return Usage{}, ErrNotFound
+	}
+
+	start := q.window(m.now())
+	name := q.CounterName(start)
+	used, _ := m.db.Get(name)
+	return q.usage(name, start, used, used < q.Limit), nil
+}
+
+func (q *Quota) usage(name string, start time.Time, used uint64, allowed bool) Usage {
+	u := Usage{
+		Quota:   q.ID,
+		Counter: name,
+		Limit:   q.Limit,
+		Used:    used,
+		Reset:   start.Add(time.Duration(q.Window)),
+		Allowed: allowed,
+	}
+	if used < q.Limit {
+		u.Remaining = q.Limit - used
+	}
+	return u
+}
+
+// Run removes the counters of quotas' windows before the previous one
+// until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	t := time.NewTicker(cleanupInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			m.cleanup(ctx)
+		}
+	}
+}
+
+func (m *Manager) cleanup(ctx context.Context) {
+	now := m.now()
+	names := m.db.Names()
+
+	for _, q := range m.Quotas() {
+		prev := q.window(now).Add(-time.Duration(q.Window))
+		prefix := q.counterPrefix()
+
+		for _, name := range names {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+
+			start, err := time.Parse(time.RFC3339, name[len(prefix):])
+			if err != nil || !start.Before(prev) {
+				continue
+			}
+
+			if m.db.Delete(db.WithWho(ctx, "quota:"+q.ID), name) {
+				logging.Debug("removed expired quota window", logging.F("quota", q.ID), logging.F("counter", name))
+			}
+		}
+	}
+}
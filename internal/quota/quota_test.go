@@ -0,0 +1,138 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+)
+
+func TestTake(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	os.Remove("test.test.counters")
+	os.Remove("test.quotas")
+	defer os.Remove("test.test")
+	defer os.Remove("test.test.counters")
+	defer os.Remove("test.quotas")
+
+	d := db.NewDB("test.test")
+	defer d.Close()
+
+	m, err := New(d, "test.quotas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 2, 15, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	if err := m.Put(Quota{ID: "acme", Counter: "acme", Limit: 3, Window: Duration(24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put(Quota{ID: "bad", Counter: "bad", Limit: 3, Window: Duration(time.Millisecond)}); err == nil {
+		t.Fatal("expected invalid window")
+	}
+
+	if _, err := m.Take("other", 1); err != ErrNotFound {
+		t.Fatalf("expected unknown quota, got %v", err)
+	}
+
+	u, err := m.Take("acme", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := time.Date(2023, 1, 3, 0, 0, 0, 0, time.UTC)
+	if !u.Allowed || u.Used != 2 || u.Remaining != 1 || !u.Reset.Equal(reset) || u.Counter != "acme@24h@2023-01-02T00:00:00Z" {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+
+	if u, _ := m.Take("acme", 2); u.Allowed || u.Used != 2 {
+		t.Fatalf("expected take over the limit to be refused, got %+v", u)
+	}
+	if u, _ := m.Take("acme", 1); !u.Allowed || u.Remaining != 0 {
+		t.Fatalf("expected the last one to be allowed, got %+v", u)
+	}
+	if u, _ := m.Usage("acme"); u.Allowed || u.Used != 3 {
+		t.Fatalf("expected quota to be exhausted, got %+v", u)
+	}
+
+	// a quota on the same counter with another window counts separately.
+	if err := m.Put(Quota{ID: "acme-hourly", Counter: "acme", Limit: 10, Window: Duration(90 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := m.Take("acme-hourly", 1); !u.Allowed || u.Used != 1 || u.Counter != "acme@1h30m@2023-01-02T15:00:00Z" {
+		t.Fatalf("expected its own window, got %+v", u)
+	}
+	for name, want := range map[string]bool{u.Counter: true, "acme@1h30m@2023-01-02T15:00:00Z": true, "a@b@c": false, "ops@example.com": false, "acme": false} {
+		if IsWindowCounter(name) != want {
+			t.Fatalf("expected %q to be a window counter: %v", name, want)
+		}
+	}
+
+	// a new window starts from zero, and old ones are cleaned up.
+	now = now.Add(24 * time.Hour)
+	if u, _ := m.Take("acme", 1); !u.Allowed || u.Used != 1 {
+		t.Fatalf("expected new window, got %+v", u)
+	}
+	now = now.Add(24 * time.Hour)
+	m.cleanup(context.Background())
+	if _, ok := d.Get("acme@24h@2023-01-02T00:00:00Z"); ok {
+		t.Fatal("expected window before the previous one to be removed")
+	}
+	if _, ok := d.Get("acme@24h@2023-01-03T00:00:00Z"); !ok {
+		t.Fatal("expected previous window to be kept")
+	}
+
+	// quotas are persisted
+	m, err = New(d, "test.quotas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotas := m.Quotas(); len(quotas) != 2 || quotas[0].Window != Duration(24*time.Hour) {
+		t.Fatalf("expected quota to be loaded, got %+v", quotas)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	os.Remove("test.test") // in case previous run failed
+	defer os.Remove("test.test")
+
+	d := db.NewDB("test.test")
+	defer d.Close()
+
+	m, err := New(d, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do(http.MethodPut, "/acme", `{"counter": "acme", "limit": 10000, "window": "24h"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected quota to be added, got %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/", `{"id": "x", "counter": "x", "limit": 1, "window": 60}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected numeric window to be refused, got %d", w.Code)
+	}
+
+	w := do(http.MethodGet, "/acme", "")
+	var q Quota
+	if err := json.NewDecoder(w.Body).Decode(&q); err != nil || q.Limit != 10000 || q.Window != Duration(24*time.Hour) {
+		t.Fatalf("unexpected quota %+v, %v", q, err)
+	}
+
+	if w := do(http.MethodDelete, "/acme", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected quota to be deleted, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/acme", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected quota to be gone, got %d", w.Code)
+	}
+}
@@ -0,0 +1,302 @@
+// Package ratelimit limits the rate of requests per client with token buckets,
+// identifying clients by API key or by IP address, taken from X-Forwarded-For
+// when the request comes from a trusted proxy.
+package ratelimit
+
+import (
+	"crypto/subtle"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/pkg/errors"
+)
+
+// APIKeyHeader carries the API key of a client.
+const APIKeyHeader = "X-API-Key"
+
+const (
+	// how often buckets that have filled up again are forgotten.
+	sweepInterval = time.Minute
+	maxBuckets    = 1 << 20
+)
+
+// Config configures rate limiting.
+type Config struct {
+	// Rate is the sustained number of requests per second per client,
+	// disabled if 0.
+	Rate float64
+	// Burst is the number of requests a client can make at once.
+	Burst int
+	// TrustedProxies are the networks of proxies whose X-Forwarded-For is trusted.
+	TrustedProxies []*net.IPNet
+	// APIKeys identify clients by the name of their key, rather than their IP.
+	APIKeys map[string]string
+
+	// ClusterLimit is the number of requests per client per ClusterWindow
+	// across all instances, disabled if 0.
+	ClusterLimit  uint64
+	ClusterWindow time.Duration
+}
+
+// Settings configure rate limits, see ConfigFrom.
+var Settings = []config.Setting{
+	{Name: "RATE_LIMIT", Kind: config.Float, Usage: "requests per second per client, disabled if not set", Reloadable: true},
+	{Name: "RATE_LIMIT_BURST", Kind: config.Int, Usage: "requests a client can make at once, default RATE_LIMIT rounded up", Reloadable: true},
+	{Name: "RATE_LIMIT_TRUSTED_PROXIES", Usage: "comma separated IPs or CIDRs of proxies setting X-Forwarded-For"},
+	{Name: "RATE_LIMIT_API_KEYS", Usage: "comma separated name:key pairs of X-API-Key values", Secret: true},
+	{Name: "RATE_LIMIT_CLUSTER", Kind: config.Int, Usage: "requests per client per window across all instances", Reloadable: true},
+	{Name: "RATE_LIMIT_CLUSTER_WINDOW", Kind: config.Duration, Default: "1m", Usage: "window of RATE_LIMIT_CLUSTER"},
+}
+
+// ConfigFrom returns the config of Settings.
+func ConfigFrom(get config.Getter) (Config, error) {
+	c := Config{ClusterWindow: time.Minute}
+
+	if v := get("RATE_LIMIT"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || math.IsInf(rate, 0) {
+			return c, errors.Errorf("RATE_LIMIT: invalid rate %q", v)
+		}
+		c.Rate = rate
+		c.Burst = int(math.Ceil(rate))
+	}
+
+	if v := get("RATE_LIMIT_BURST"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			return c, errors.Errorf("RATE_LIMIT_BURST: invalid burst %q", v)
+		}
+		c.Burst = burst
+	}
+
+	if v := get("RATE_LIMIT_TRUSTED_PROXIES"); v != "" {
+		nets, err := ParseNetworks(v)
+		if err != nil {
+			return c, errors.WithMessage(err, "RATE_LIMIT_TRUSTED_PROXIES")
+		}
+		c.TrustedProxies = nets
+	}
+
+	if v := get("RATE_LIMIT_API_KEYS"); v != "" {
+		c.APIKeys = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			name, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || name == "" || key == "" {
+				return c, errors.New("RATE_LIMIT_API_KEYS: expected name:key pairs")
+			}
+			c.APIKeys[name] = key
+		}
+	}
+
+	if v := get("RATE_LIMIT_CLUSTER"); v != "" {
+		limit, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c, errors.Wrap(err, "RATE_LIMIT_CLUSTER")
+		}
+		c.ClusterLimit = limit
+	}
+
+	if v := get("RATE_LIMIT_CLUSTER_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window < time.Second || window%time.Second != 0 || window > MaxWindow {
+			return c, errors.Errorf("RATE_LIMIT_CLUSTER_WINDOW: invalid window %q, must be whole seconds up to %s", v, MaxWindow)
+		}
+		c.ClusterWindow = window
+	}
+
+	return c, nil
+}
+
+// Enabled reports whether any limit is configured.
+func (c Config) Enabled() bool {
+	return c.Rate > 0 || c.ClusterLimit > 0
+}
+
+// ParseNetworks parses a comma separated list of IPs and CIDRs.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ClientKey returns the key to limit r by: "key:" and the name of its API key
+// if it has a known one, else "ip:" and the IP of the client.
+func (c Config) ClientKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		for name, k := range c.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+				return "key:" + name
+			}
+		}
+	}
+	return "ip:" + ClientIP(r, c.TrustedProxies)
+}
+
+// ClientIP returns the IP of the client that made r. If r comes from
+// a trusted proxy, it is the last address in X-Forwarded-For not of
+// a trusted proxy, as earlier ones can be set by the client.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrusted(net.ParseIP(host), trusted) {
+		return host
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break // can't trust anything before it
+		}
+
+		host = ip.String()
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Limiter is a token bucket per key.
+type Limiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing rate requests per second
+// per key, with bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// SetRate changes the rate and burst of the limiter.
+// Buckets keep their tokens, up to the new burst.
+func (l *Limiter) SetRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+	l.burst = float64(burst)
+}
+
+// Allow takes a token from the bucket of key, if it has one.
+// Otherwise it returns how long until it will.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			return false, sweepInterval
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have filled up again.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RetryAfter formats d as the whole seconds of a Retry-After header, at least 1.
+func RetryAfter(d time.Duration) string {
+	secs := int64(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("expected burst request %d to be allowed", i)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms for a token, got %v %v", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("expected other key to have its own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("expected a token after waiting")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("expected no more tokens")
+	}
+
+	now = now.Add(2 * sweepInterval)
+	l.Allow("c")
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected full buckets to be forgotten, have %d", len(l.buckets))
+	}
+
+	l.SetRate(10, 1)
+	if ok, _ := l.Allow("c"); !ok {
+		t.Fatal("expected bucket to keep its tokens up to the new burst")
+	}
+	if ok, wait := l.Allow("c"); ok || wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms for a token at the new rate, got %v %v", ok, wait)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseNetworks("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote, xff, exp string
+	}{
+		{"1.2.3.4:5000", "", "1.2.3.4"},
+		{"1.2.3.4:5000", "5.6.7.8", "1.2.3.4"},           // untrusted proxy
+		{"10.0.0.2:5000", "5.6.7.8", "5.6.7.8"},          // trusted proxy
+		{"10.0.0.2:5000", "9.9.9.9, 5.6.7.8", "5.6.7.8"}, // spoofed first hop
+		{"10.0.0.2:5000", "5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.0.0.2:5000", "nonsense, 5.6.7.8", "5.6.7.8"},
+		{"10.0.0.2:5000", "5.6.7.8, nonsense", "10.0.0.2"},
+		{"10.0.0.2:5000", "10.0.0.3", "10.0.0.3"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+
+		if ip := ClientIP(r, trusted); ip != test.exp {
+			t.Fatalf("%s with X-Forwarded-For %q: expected %s, got %s", test.remote, test.xff, test.exp, ip)
+		}
+	}
+
+	if _, err := ParseNetworks("10.0.0.0/33"); err == nil {
+		t.Fatal("expected invalid network")
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	c := Config{APIKeys: map[string]string{"acme": "secret"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "1.2.3.4:5000"
+	if k := c.ClientKey(r); k != "ip:1.2.3.4" {
+		t.Fatalf("expected ip key, got %s", k)
+	}
+
+	r.Header.Set(APIKeyHeader, "guess")
+	if k := c.ClientKey(r); k != "ip:1.2.3.4" {
+		t.Fatalf("expected unknown api key to be limited by ip, got %s", k)
+	}
+
+	r.Header.Set(APIKeyHeader, "secret")
+	if k := c.ClientKey(r); k != "key:acme" {
+		t.Fatalf("expected api key, got %s", k)
+	}
+}
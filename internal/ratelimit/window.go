@@ -0,0 +1,192 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SyncPath is the cluster endpoint that instances sync their window counts with.
+const SyncPath = "/ratelimit"
+
+const (
+	// MaxWindow is the longest window counted across instances.
+	MaxWindow = 24 * time.Hour
+	// most windows counted at once, enough for instances
+	// with different windows, or changing them.
+	maxWindows = 64
+)
+
+// WindowCounts are counts of requests per client in a fixed window.
+type WindowCounts struct {
+	Start  int64             `json:"start"`  // unix seconds
+	Length int64             `json:"length"` // seconds
+	Counts map[string]uint64 `json:"counts"`
+}
+
+type windowID struct {
+	start, length int64
+}
+
+// Windows holds the counts per client of recent fixed windows,
+// which every instance adds its own counts to. They are only kept in
+// memory, so they start from zero again if the process restarts.
+type Windows struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	windows map[windowID]map[string]uint64
+}
+
+func NewWindows() *Windows {
+	return &Windows{now: time.Now, windows: make(map[windowID]map[string]uint64)}
+}
+
+// Add adds the counts of wc to its window and returns
+// the totals of the same clients in it.
+// Windows longer than MaxWindow, or that start in the future, are refused.
+func (w *Windows) Add(wc WindowCounts) (WindowCounts, error) {
+	totals := WindowCounts{Start: wc.Start, Length: wc.Length, Counts: make(map[string]uint64, len(wc.Counts))}
+	if wc.Length <= 0 || wc.Length > int64(MaxWindow/time.Second) {
+		return totals, errors.Errorf("window length must be 1 to %d seconds", int64(MaxWindow/time.Second))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now().Unix()
+	for id := range w.windows {
+		if id.start+2*id.length < now {
+			delete(w.windows, id)
+		}
+	}
+
+	if wc.Start > now+wc.Length {
+		return totals, errors.New("window starts in the future")
+	}
+	if wc.Start+2*wc.Length < now {
+		return totals, nil // expired, nothing to add to
+	}
+
+	id := windowID{wc.Start, wc.Length}
+	counts := w.windows[id]
+	if counts == nil {
+		if len(w.windows) >= maxWindows {
+			return totals, errors.New("too many windows")
+		}
+		counts = make(map[string]uint64)
+		w.windows[id] = counts
+	}
+
+	for client, n := range wc.Counts {
+		if _, ok := counts[client]; ok || len(counts) < maxBuckets {
+			counts[client] += n
+		}
+		totals.Counts[client] = counts[client]
+	}
+	return totals, nil
+}
+
+// WindowLimiter limits requests per client in fixed windows, counting them
+// across instances by syncing with a cluster's Windows.
+// Between syncs, it only knows of other instances' requests as of the last one.
+type WindowLimiter struct {
+	limit  uint64
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	start   time.Time
+	totals  map[string]uint64 // of all instances, as of the last sync
+	pending map[string]uint64 // allowed here since the last sync
+}
+
+// NewWindowLimiter returns a limiter allowing limit requests per client per window.
+func NewWindowLimiter(limit uint64, window time.Duration) *WindowLimiter {
+	return &WindowLimiter{
+		limit:   limit,
+		window:  window,
+		now:     time.Now,
+		totals:  make(map[string]uint64),
+		pending: make(map[string]uint64),
+	}
+}
+
+// roll starts the window of now, if not already in it.
+func (l *WindowLimiter) roll(now time.Time) {
+	if start := now.Truncate(l.window); !start.Equal(l.start) {
+		l.start = start
+		l.totals = make(map[string]uint64)
+		l.pending = make(map[string]uint64)
+	}
+}
+
+// SetLimit changes the limit, from the current window on.
+func (l *WindowLimiter) SetLimit(limit uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+}
+
+// Allow counts a request by key if it is within the limit of the window.
+// Otherwise it returns how long until the next window.
+func (l *WindowLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.roll(now)
+
+	if l.totals[key]+l.pending[key] >= l.limit {
+		return false, l.start.Add(l.window).Sub(now)
+	}
+
+	if _, ok := l.pending[key]; ok || len(l.pending) < maxBuckets {
+		l.pending[key]++
+	}
+	return true, 0
+}
+
+// Sync sends the requests allowed since the last sync with send, which
+// returns the totals across instances. Clients seen in the window without
+// new requests are sent with a count of 0 to get their latest totals.
+func (l *WindowLimiter) Sync(send func(WindowCounts) (WindowCounts, error)) error {
+	l.mu.Lock()
+	l.roll(l.now())
+	start := l.start
+	wc := WindowCounts{Start: start.Unix(), Length: int64(l.window / time.Second), Counts: l.pending}
+	for key := range l.totals {
+		if _, ok := wc.Counts[key]; !ok {
+			wc.Counts[key] = 0
+		}
+	}
+	l.pending = make(map[string]uint64)
+	l.mu.Unlock()
+
+	totals, err := send(wc)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.start.Equal(start) {
+		return err // window has passed
+	}
+
+	if err != nil {
+		for key, n := range wc.Counts {
+			if n > 0 {
+				l.pending[key] += n
+			}
+		}
+		return err
+	}
+
+	for key, n := range totals.Counts {
+		if n > 0 {
+			l.totals[key] = n
+		}
+	}
+	return nil
+}
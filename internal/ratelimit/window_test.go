@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWindowLimiter(t *testing.T) {
+	now := time.Unix(1000*60, 0)
+	clock := func() time.Time { return now }
+
+	windows := NewWindows()
+	windows.now = clock
+
+	a, b := NewWindowLimiter(5, time.Minute), NewWindowLimiter(5, time.Minute)
+	a.now, b.now = clock, clock
+
+	allow := func(l *WindowLimiter, n int) int {
+		allowed := 0
+		for i := 0; i < n; i++ {
+			if ok, _ := l.Allow("c"); ok {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	if n := allow(a, 3); n != 3 {
+		t.Fatalf("expected 3 allowed, got %d", n)
+	}
+	if err := a.Sync(func(wc WindowCounts) (WindowCounts, error) { return windows.Add(wc) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// b only knows about a's requests of a client once it has synced after seeing it.
+	if n := allow(b, 1); n != 1 {
+		t.Fatalf("expected 1 allowed, got %d", n)
+	}
+	if err := b.Sync(func(wc WindowCounts) (WindowCounts, error) { return windows.Add(wc) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := allow(b, 5); n != 1 {
+		t.Fatalf("expected 1 more allowed across instances, got %d", n)
+	}
+
+	now = now.Add(10 * time.Second)
+	ok, wait := b.Allow("c")
+	if ok || wait != 50*time.Second {
+		t.Fatalf("expected to wait 50s for next window, got %v %v", ok, wait)
+	}
+
+	// counts of a failed sync are sent again with the next one.
+	failed := errors.New("down")
+	if err := b.Sync(func(WindowCounts) (WindowCounts, error) { return WindowCounts{}, failed }); err != failed {
+		t.Fatalf("expected sync error, got %v", err)
+	}
+	var sent WindowCounts
+	b.Sync(func(wc WindowCounts) (WindowCounts, error) {
+		sent = wc
+		return windows.Add(wc)
+	})
+	if sent.Counts["c"] != 1 {
+		t.Fatalf("expected unsynced counts to be resent, got %v", sent.Counts)
+	}
+	if totals, _ := windows.Add(WindowCounts{Start: sent.Start, Length: sent.Length, Counts: map[string]uint64{"c": 0}}); totals.Counts["c"] != 5 {
+		t.Fatalf("expected cluster total of 5, got %v", totals.Counts)
+	}
+
+	now = now.Add(time.Minute)
+	if n := allow(a, 1); n != 1 {
+		t.Fatal("expected new window to allow requests")
+	}
+
+	now = now.Add(3 * time.Minute)
+	windows.Add(WindowCounts{Start: now.Unix(), Length: 60})
+	if len(windows.windows) != 1 {
+		t.Fatalf("expected old windows to be forgotten, have %d", len(windows.windows))
+	}
+
+	for _, wc := range []WindowCounts{
+		{Start: now.Unix(), Length: 0},
+		{Start: now.Unix(), Length: int64(MaxWindow/time.Second) + 1},
+		{Start: now.Unix() + 120, Length: 60},
+	} {
+		if _, err := windows.Add(wc); err == nil {
+			t.Fatalf("expected window %+v to be refused", wc)
+		}
+	}
+	for i := int64(1); i < maxWindows; i++ {
+		if _, err := windows.Add(WindowCounts{Start: now.Unix(), Length: 60 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := windows.Add(WindowCounts{Start: now.Unix(), Length: 30}); err == nil {
+		t.Fatal("expected too many windows to be refused")
+	}
+}
@@ -0,0 +1,82 @@
+// Package requestid gives every request an id, accepted from or generated
+// for its X-Request-ID header, to correlate logs across services.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+)
+
+// Header carries the request id, in requests and responses.
+const Header = "X-Request-ID"
+
+const maxLen = 128
+
+type ctxKey struct{}
+
+// FromContext returns the request id of ctx, or "".
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// NewContext returns ctx with request id, which is also logged.
+func NewContext(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, ctxKey{}, id)
+	return logging.ContextWith(ctx, logging.F("request_id", id))
+}
+
+// Handler serves requests with h, with the id from their X-Request-ID header,
+// or a new one if it is missing or invalid, in their context and response header.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !Valid(id) {
+			id = New()
+		}
+
+		w.Header().Set(Header, id)
+		h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// Inject sets the X-Request-ID header of an outgoing request to the request id of ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if id := FromContext(ctx); id != "" {
+		h.Set(Header, id)
+	}
+}
+
+// Error replies like http.Error, with the request id in the message
+// so that it can be reported.
+func Error(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id := FromContext(r.Context()); id != "" {
+		msg += " (request id " + id + ")"
+	}
+	http.Error(w, msg, code)
+}
+
+// New returns a random request id.
+func New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether id can be accepted from a client:
+// it is not too long and only has printable ascii characters.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
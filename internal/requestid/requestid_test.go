@@ -0,0 +1,39 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	var got string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+		Error(w, r, "failed", http.StatusBadGateway)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(Header, "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got != "abc-123" || w.Header().Get(Header) != "abc-123" {
+		t.Fatalf("expected incoming id to be used, got %q and %q", got, w.Header().Get(Header))
+	}
+	if !strings.Contains(w.Body.String(), "failed (request id abc-123)") {
+		t.Fatalf("expected id in error body, got %q", w.Body.String())
+	}
+
+	for _, incoming := range []string{"", "has space", strings.Repeat("a", maxLen+1)} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(Header, incoming)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if got == incoming || len(got) != 32 || w.Header().Get(Header) != got {
+			t.Fatalf("expected new id for %q, got %q", incoming, got)
+		}
+	}
+}
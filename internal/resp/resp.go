@@ -0,0 +1,229 @@
+// Package resp implements the Redis serialization protocol (RESP2),
+// enough to serve commands to redis-cli and Redis client libraries.
+package resp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxArgs    = 1024
+	maxBulkLen = 512 * 1024
+)
+
+// Error is an error reply.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Buffered returns the number of bytes that can be read without blocking.
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadCommand reads a command, sent either as an array of bulk strings
+// or inline as space separated words.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] != '*' {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 || n > maxArgs {
+			return nil, errors.New("invalid multibulk length")
+		}
+
+		args := make([]string, n)
+		for i := range args {
+			v, err := r.ReadValue()
+			if err != nil {
+				return nil, err
+			}
+
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("expected bulk string")
+			}
+			args[i] = s
+		}
+
+		if n > 0 {
+			return args, nil
+		}
+	}
+}
+
+// ReadValue reads a reply. It returns a string for simple and bulk strings,
+// an int64 for integers, an Error for errors, a []interface{} for arrays
+// and nil for null bulk strings and arrays.
+func (r *Reader) ReadValue() (interface{}, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, errors.New("empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid integer")
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 || n > maxBulkLen {
+			return nil, errors.New("invalid bulk length")
+		}
+		if n == -1 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r.r, b); err != nil {
+			return nil, err
+		}
+		if b[n] != '\r' || b[n+1] != '\n' {
+			return nil, errors.New("bulk string not terminated")
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 || n > maxArgs {
+			return nil, errors.New("invalid array length")
+		}
+		if n == -1 {
+			return nil, nil
+		}
+
+		vs := make([]interface{}, n)
+		for i := range vs {
+			if vs[i], err = r.ReadValue(); err != nil {
+				return nil, err
+			}
+		}
+		return vs, nil
+	}
+
+	return nil, errors.Errorf("unknown type %q", line[0])
+}
+
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+type Writer struct {
+	w      *bufio.Writer
+	remote net.Addr
+	user   string
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// RemoteAddr returns the address of the client, if served by a Server.
+func (w *Writer) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+// User returns who the client authenticated as on this connection,
+// or "" if it did not. See SetUser.
+func (w *Writer) User() string {
+	return w.user
+}
+
+// SetUser records that the client authenticated as user,
+// for the rest of the connection.
+func (w *Writer) SetUser(user string) {
+	w.user = user
+}
+
+func (w *Writer) WriteSimple(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) WriteError(s string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(s))
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) WriteInt(n int64) {
+	w.w.WriteByte(':')
+	w.w.WriteString(strconv.FormatInt(n, 10))
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) WriteBulk(s string) {
+	w.w.WriteByte('$')
+	w.w.WriteString(strconv.Itoa(len(s)))
+	w.w.WriteString("\r\n")
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) WriteNil() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// WriteArrayLen starts an array of n elements, which must be written next.
+func (w *Writer) WriteArrayLen(n int) {
+	w.w.WriteByte('*')
+	w.w.WriteString(strconv.Itoa(n))
+	w.w.WriteString("\r\n")
+}
+
+// WriteCommand writes a command as an array of bulk strings.
+func (w *Writer) WriteCommand(args ...string) {
+	w.WriteArrayLen(len(args))
+	for _, a := range args {
+		w.WriteBulk(a)
+	}
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
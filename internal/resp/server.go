@@ -0,0 +1,66 @@
+package resp
+
+import (
+	"io"
+	"net"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/connserver"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// Handler serves a command by writing exactly one reply to w.
+type Handler interface {
+	ServeRESP(w *Writer, args []string)
+}
+
+type HandlerFunc func(w *Writer, args []string)
+
+func (f HandlerFunc) ServeRESP(w *Writer, args []string) {
+	f(w, args)
+}
+
+type Server struct {
+	*connserver.Server
+	h Handler
+}
+
+func NewServer(h Handler) *Server {
+	s := &Server{h: h}
+	s.Server = connserver.New(s.serveConn)
+	return s
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	r := NewReader(c)
+	w := NewWriter(c)
+	w.remote = c.RemoteAddr()
+
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				w.WriteError("ERR Protocol error: " + err.Error())
+				w.Flush()
+				logging.Warn("resp connection error", logging.Err(err))
+			}
+			return
+		}
+
+		if strings.EqualFold(args[0], "QUIT") {
+			w.WriteSimple("OK")
+			w.Flush()
+			return
+		}
+
+		s.h.ServeRESP(w, args)
+
+		// flush once all pipelined commands read so far are answered.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package rules
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+)
+
+const maxRuleSize = 64 * 1024
+
+// ServeHTTP serves the rules admin API, relative to where it is mounted:
+//
+//	GET    /      list rules
+//	POST   /      add or replace a rule
+//	GET    /{id}  get a rule
+//	PUT    /{id}  add or replace a rule
+//	DELETE /{id}  delete a rule
+func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		rules := e.Rules()
+		for i := range rules {
+			rules[i].redact()
+		}
+		writeJSON(w, http.StatusOK, rules)
+
+	case id == "" && r.Method == http.MethodPost, id != "" && r.Method == http.MethodPut:
+		var rule Rule
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxRuleSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rule); err != nil {
+			requestid.Error(w, r, "invalid rule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if id != "" {
+			rule.ID = id
+		}
+
+		if err := rule.validate(); err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := e.Put(rule); err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rule.redact()
+		writeJSON(w, http.StatusOK, rule)
+
+	case id != "" && r.Method == http.MethodGet:
+		for _, rule := range e.Rules() {
+			if rule.ID == id {
+				rule.redact()
+				writeJSON(w, http.StatusOK, rule)
+				return
+			}
+		}
+		requestid.Error(w, r, "rule not found", http.StatusNotFound)
+
+	case id != "" && r.Method == http.MethodDelete:
+		ok, err := e.Delete(id)
+		if err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			requestid.Error(w, r, "rule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		requestid.Error(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// redact hides the secret of a rule served by the API.
+func (r *Rule) redact() {
+	if r.Secret != "" {
+		r.Secret = "redacted"
+	}
+}
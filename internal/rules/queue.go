@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// delivery is an event waiting to be delivered to a webhook.
+type delivery struct {
+	Event       Event     `json:"event"`
+	Webhook     string    `json:"webhook"`
+	Secret      string    `json:"secret,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// queue is the durable queue of deliveries. It is saved to its file
+// on every change, so deliveries survive restarts until they succeed
+// or are given up on.
+type queue struct {
+	file string
+
+	mu         sync.Mutex
+	deliveries []*delivery
+}
+
+func loadQueue(file string) (*queue, error) {
+	q := queue{file: file}
+	if file == "" {
+		return &q, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &q, nil
+		}
+		return nil, errors.Wrap(err, "unable to read "+file)
+	}
+
+	if err := json.Unmarshal(b, &q.deliveries); err != nil {
+		return nil, errors.Wrap(err, "unable to parse "+file)
+	}
+	return &q, nil
+}
+
+func (q *queue) push(d *delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.deliveries = append(q.deliveries, d)
+	return q.save()
+}
+
+// due returns the deliveries due for an attempt at now.
+func (q *queue) due(now time.Time) []*delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*delivery
+	for _, d := range q.deliveries {
+		if !now.Before(d.NextAttempt) {
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+// done removes d from the queue.
+func (q *queue) done(d *delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, qd := range q.deliveries {
+		if qd == d {
+			q.deliveries = append(q.deliveries[:i], q.deliveries[i+1:]...)
+			break
+		}
+	}
+	return q.save()
+}
+
+// retry schedules d for another attempt at next.
+func (q *queue) retry(d *delivery, next time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d.Attempts++
+	d.NextAttempt = next
+	return q.save()
+}
+
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.deliveries)
+}
+
+func (q *queue) save() error {
+	if q.file == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(q.deliveries)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := q.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "unable to save "+q.file)
+	}
+	return errors.Wrap(os.Rename(tmp, q.file), "unable to save "+q.file)
+}
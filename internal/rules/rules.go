@@ -0,0 +1,451 @@
+// Package rules triggers webhooks when counters reach milestones
+// or their rate exceeds a threshold.
+package rules
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	rateWindow       = time.Minute
+	sampleInterval   = time.Second
+	deliveryInterval = time.Second
+	deliveryTimeout  = time.Second * 10
+	maxAttempts      = 10
+	maxBackoff       = time.Hour
+)
+
+// Rule triggers a webhook for a counter. Exactly one of Milestone,
+// Every and RatePerMinute must be set.
+type Rule struct {
+	ID      string `json:"id"`
+	Counter string `json:"counter"`
+
+	// Milestone fires once the counter reaches this value.
+	Milestone uint64 `json:"milestone,omitempty"`
+	// Every fires every time the counter reaches a multiple of this value.
+	Every uint64 `json:"every,omitempty"`
+	// RatePerMinute fires when the counter's increase over the last minute
+	// goes above this value. It fires again only after dropping back to or below it.
+	RatePerMinute uint64 `json:"rate_per_minute,omitempty"`
+
+	Webhook string `json:"webhook"`
+	// Secret, if set, is used to sign deliveries with HMAC-SHA256.
+	Secret string `json:"secret,omitempty"`
+}
+
+func (r *Rule) validate() error {
+	if r.ID == "" {
+		return errors.New("rule id required")
+	}
+	if r.Counter == "" {
+		return errors.New("rule counter required")
+	}
+	if r.Webhook == "" {
+		return errors.New("rule webhook required")
+	}
+
+	set := 0
+	for _, v := range []uint64{r.Milestone, r.Every, r.RatePerMinute} {
+		if v != 0 {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of milestone, every and rate_per_minute required")
+	}
+	return nil
+}
+
+// Event is delivered to a rule's webhook as JSON when it fires.
+type Event struct {
+	ID      string    `json:"id"`
+	Rule    string    `json:"rule"`
+	Kind    string    `json:"kind"` // "milestone" or "rate"
+	Counter string    `json:"counter"`
+	Value   uint64    `json:"value"`
+	Rate    uint64    `json:"rate_per_minute,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// ruleState is a rule with what has been observed of its counter.
+type ruleState struct {
+	Rule
+	last    uint64   // counter value last evaluated
+	samples []uint64 // counter value every sampleInterval over rateWindow
+	above   bool     // rate currently above threshold
+}
+
+// Engine evaluates rules against db counters and delivers their events.
+type Engine struct {
+	db     *db.DB
+	file   string
+	client *http.Client
+
+	mu    sync.Mutex
+	rules map[string]*ruleState
+
+	queue *queue
+	wake  chan struct{}
+}
+
+// New loads rules from rulesFile and pending deliveries from queueFile.
+// Either can be empty to not persist them.
+func New(d *db.DB, rulesFile, queueFile string) (*Engine, error) {
+	q, err := loadQueue(queueFile)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Engine{
+		db:     d,
+		file:   rulesFile,
+		client: &http.Client{Timeout: deliveryTimeout},
+		rules:  make(map[string]*ruleState),
+		queue:  q,
+		wake:   make(chan struct{}, 1),
+	}
+
+	if rulesFile == "" {
+		return &e, nil
+	}
+
+	b, err := os.ReadFile(rulesFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &e, nil
+		}
+		return nil, errors.Wrap(err, "unable to read "+rulesFile)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, errors.Wrap(err, "unable to parse "+rulesFile)
+	}
+
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, errors.WithMessage(err, "rule "+r.ID)
+		}
+		e.rules[r.ID] = e.newState(r)
+	}
+
+	return &e, nil
+}
+
+func (e *Engine) newState(r Rule) *ruleState {
+	v, _ := e.db.Get(r.Counter)
+	return &ruleState{Rule: r, last: v}
+}
+
+// Rules returns all rules, sorted by id.
+func (e *Engine) Rules() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules := make([]Rule, 0, len(e.rules))
+	for _, rs := range e.rules {
+		rules = append(rules, rs.Rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// Put adds r, or replaces the rule with the same id.
+func (e *Engine) Put(r Rule) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	prev := e.rules[r.ID]
+	e.rules[r.ID] = e.newState(r)
+	if err := e.save(); err != nil {
+		if prev != nil {
+			e.rules[r.ID] = prev
+		} else {
+			delete(e.rules, r.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the rule with id and reports whether it existed.
+func (e *Engine) Delete(id string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	prev, ok := e.rules[id]
+	if !ok {
+		return false, nil
+	}
+
+	delete(e.rules, id)
+	if err := e.save(); err != nil {
+		e.rules[id] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+func (e *Engine) save() error {
+	if e.file == "" {
+		return nil
+	}
+
+	rules := make([]Rule, 0, len(e.rules))
+	for _, rs := range e.rules {
+		rules = append(rules, rs.Rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+
+	b, err := json.MarshalIndent(rules, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := e.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "unable to save "+e.file)
+	}
+	return errors.Wrap(os.Rename(tmp, e.file), "unable to save "+e.file)
+}
+
+// Run evaluates rules on counter changes and delivers events until ctx is done.
+// Events are delivered by a goroutine of their own, so slow webhooks
+// don't hold up sampling counters.
+func (e *Engine) Run(ctx context.Context) {
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		e.runDeliveries(ctx)
+	}()
+	defer func() { <-delivered }()
+
+	changed, stop := e.db.Watch()
+	defer stop()
+
+	sample := time.NewTicker(sampleInterval)
+	defer sample.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			e.checkMilestones()
+		case <-sample.C:
+			e.checkRates()
+		}
+	}
+}
+
+// runDeliveries delivers queued events when they are due or fired, until ctx is done.
+func (e *Engine) runDeliveries(ctx context.Context) {
+	deliver := time.NewTicker(deliveryInterval)
+	defer deliver.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deliver.C:
+			e.deliver(ctx)
+		case <-e.wake:
+			e.deliver(ctx)
+		}
+	}
+}
+
+func (e *Engine) checkMilestones() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, rs := range e.rules {
+		v, _ := e.db.Get(rs.Counter)
+		last := rs.last
+		rs.last = v
+		if v <= last {
+			continue
+		}
+
+		switch {
+		case rs.Milestone != 0:
+			if last < rs.Milestone && v >= rs.Milestone {
+				e.fire(rs, "milestone", rs.Milestone, 0)
+			}
+		case rs.Every != 0:
+			if v/rs.Every > last/rs.Every {
+				e.fire(rs, "milestone", v/rs.Every*rs.Every, 0)
+			}
+		}
+	}
+}
+
+func (e *Engine) checkRates() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	window := int(rateWindow / sampleInterval)
+	for _, rs := range e.rules {
+		if rs.RatePerMinute == 0 {
+			continue
+		}
+
+		v, _ := e.db.Get(rs.Counter)
+		rs.samples = append(rs.samples, v)
+		if len(rs.samples) > window+1 {
+			rs.samples = rs.samples[1:]
+		}
+
+		var rate uint64
+		if oldest := rs.samples[0]; v > oldest {
+			rate = v - oldest
+		}
+
+		if rate > rs.RatePerMinute {
+			if !rs.above {
+				rs.above = true
+				e.fire(rs, "rate", v, rate)
+			}
+		} else {
+			rs.above = false
+		}
+	}
+}
+
+// fire queues an event of rs for delivery.
+func (e *Engine) fire(rs *ruleState, kind string, value, rate uint64) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		logging.Error("error generating webhook event id, dropping event", logging.F("rule", rs.ID), logging.F("kind", kind), logging.F("value", value), logging.Err(err))
+		return
+	}
+
+	d := delivery{
+		Event: Event{
+			ID:      hex.EncodeToString(id),
+			Rule:    rs.ID,
+			Kind:    kind,
+			Counter: rs.Counter,
+			Value:   value,
+			Rate:    rate,
+			Time:    time.Now().UTC(),
+		},
+		Webhook: rs.Webhook,
+		Secret:  rs.Secret,
+	}
+
+	logging.Info("rule fired", logging.F("rule", rs.ID), logging.F("kind", kind), logging.F("counter", rs.Counter), logging.F("value", value))
+	if err := e.queue.push(&d); err != nil {
+		logging.Error("error queueing webhook delivery", logging.Err(err))
+	}
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *Engine) deliver(ctx context.Context) {
+	for _, d := range e.queue.due(time.Now()) {
+		err := e.post(ctx, d)
+		if err == nil {
+			if err := e.queue.done(d); err != nil {
+				logging.Error("error updating webhook queue", logging.Err(err))
+			}
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if d.Attempts+1 >= maxAttempts {
+			logging.Error("giving up on webhook delivery", logging.F("event", d.Event.ID), logging.F("rule", d.Event.Rule), logging.Err(err))
+			if err := e.queue.done(d); err != nil {
+				logging.Error("error updating webhook queue", logging.Err(err))
+			}
+			continue
+		}
+
+		backoff := time.Second << d.Attempts
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		logging.Warn("webhook delivery failed", logging.F("event", d.Event.ID), logging.F("rule", d.Event.Rule), logging.F("retry_in", backoff.String()), logging.Err(err))
+		if err := e.queue.retry(d, time.Now().Add(backoff)); err != nil {
+			logging.Error("error updating webhook queue", logging.Err(err))
+		}
+	}
+}
+
+// post sends the event of d to its webhook. If it has a secret, the request
+// has an X-Signature header of "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the X-Timestamp header value, a '.' and the body.
+func (e *Engine) post(ctx context.Context, d *delivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", d.Event.ID)
+	req.Header.Set("X-Timestamp", ts)
+	if d.Secret != "" {
+		req.Header.Set("X-Signature", "sha256="+Sign(d.Secret, ts, body))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook returned " + resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a delivery.
+func Sign(secret, timestamp string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(timestamp))
+	m.Write([]byte{'.'})
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Pending returns the number of deliveries waiting to be delivered.
+func (e *Engine) Pending() int {
+	return e.queue.len()
+}
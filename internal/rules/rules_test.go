@@ -0,0 +1,181 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/db"
+)
+
+func newTestEngine(t *testing.T) (*Engine, *db.DB) {
+	for _, f := range []string{"test.test", "test.test.counters", "test.rules", "test.queue"} {
+		f := f
+		os.Remove(f) // in case previous run failed
+		t.Cleanup(func() { os.Remove(f) })
+	}
+
+	d := db.NewDB("test.test")
+	t.Cleanup(func() { d.Close() })
+
+	e, err := New(d, "test.rules", "test.queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, d
+}
+
+func TestMilestoneWebhook(t *testing.T) {
+	events := make(chan Event, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Signature"); sig != "sha256="+Sign("s3cret", r.Header.Get("X-Timestamp"), body) {
+			t.Errorf("bad signature %q", sig)
+		}
+
+		var ev Event
+		json.Unmarshal(body, &ev)
+		events <- ev
+	}))
+	defer hook.Close()
+
+	e, d := newTestEngine(t)
+	if err := e.Put(Rule{ID: "million", Counter: "a", Milestone: 1000000, Webhook: hook.URL, Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put(Rule{ID: "tens", Counter: "a", Every: 10, Webhook: hook.URL, Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Add("a", 999995)
+	e.checkMilestones()
+	d.Add("a", 4)
+	e.checkMilestones() // no milestone between
+	d.Add("a", 10)
+	e.checkMilestones()
+
+	if e.Pending() != 3 {
+		t.Fatalf("expected 3 pending deliveries, got %d", e.Pending())
+	}
+
+	e.deliver(context.Background())
+	if e.Pending() != 0 {
+		t.Fatalf("expected all delivered, got %d pending", e.Pending())
+	}
+
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		ev := <-events
+		got[fmt.Sprintf("%s@%d", ev.Rule, ev.Value)] = true
+	}
+
+	for _, exp := range []string{"tens@999990", "million@1000000", "tens@1000000"} {
+		if !got[exp] {
+			t.Fatalf("missing event %s in %v", exp, got)
+		}
+	}
+}
+
+func TestRateAndRetry(t *testing.T) {
+	fail := true
+	hits := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+
+	e, d := newTestEngine(t)
+	if err := e.Put(Rule{ID: "busy", Counter: "a", RatePerMinute: 5, Webhook: hook.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	e.checkRates()
+	d.Add("a", 6)
+	e.checkRates()
+	d.Add("a", 6)
+	e.checkRates() // still above, must not fire again
+
+	if e.Pending() != 1 {
+		t.Fatalf("expected 1 pending delivery, got %d", e.Pending())
+	}
+
+	e.deliver(context.Background())
+	if hits != 1 || e.Pending() != 1 {
+		t.Fatalf("expected failed delivery to stay queued, hits %d pending %d", hits, e.Pending())
+	}
+
+	// queue must survive a restart.
+	e2, err := New(d, "test.rules", "test.queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e2.Rules()) != 1 || e2.Pending() != 1 {
+		t.Fatalf("expected rule and delivery to be loaded, got %d and %d", len(e2.Rules()), e2.Pending())
+	}
+
+	fail = false
+	e2.queue.deliveries[0].NextAttempt = time.Time{}
+	e2.deliver(context.Background())
+	if hits != 2 || e2.Pending() != 0 {
+		t.Fatalf("expected retry to succeed, hits %d pending %d", hits, e2.Pending())
+	}
+}
+
+func TestSlowWebhookDoesNotBlockRules(t *testing.T) {
+	posted, release := make(chan struct{}, 10), make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- struct{}{}
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release)
+
+	e, d := newTestEngine(t)
+	if err := e.Put(Rule{ID: "one", Counter: "a", Milestone: 1, Webhook: hook.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put(Rule{ID: "two", Counter: "a", Milestone: 2, Webhook: hook.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// change another counter until Run is watching the db and evaluates a.
+	d.Add("a", 1)
+	deadline := time.Now().Add(time.Second * 5)
+	for e.Pending() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected first milestone to fire")
+		}
+		d.Add("b", 1)
+		time.Sleep(time.Millisecond * 10)
+	}
+	<-posted
+
+	// the first delivery is stuck, the second milestone must still fire.
+	d.Add("a", 1)
+	for e.Pending() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected second milestone to fire during a slow delivery, got %d pending", e.Pending())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
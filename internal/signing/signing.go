@@ -0,0 +1,301 @@
+// Package signing authenticates requests between services with a shared
+// secret: an HMAC-SHA256 over the method, path, timestamp, nonce,
+// idempotency key, tenant headers and body of a request, carried in its headers.
+// Old requests are rejected by the age of their timestamp,
+// and replayed ones by their nonce.
+package signing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/metrics"
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+	"github.com/RoanBrand/RequestCounter/internal/tenant"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// Headers carrying the signature of a request.
+// The same names, lowercased, are used for gRPC metadata.
+const (
+	KeyIDHeader     = "X-Signature-Key-Id"
+	TimestampHeader = "X-Signature-Timestamp"
+	NonceHeader     = "X-Signature-Nonce"
+	SignatureHeader = "X-Signature"
+)
+
+// DefaultMaxSkew is how far the timestamp of a request may be
+// from the time it is verified, if not configured.
+const DefaultMaxSkew = time.Minute
+
+const (
+	maxBody   = 1 << 20
+	maxNonces = 1 << 20
+)
+
+var verifyFailures = metrics.NewCounterVec("signature_failures_total", "Number of requests rejected for their signature.", "reason")
+
+var (
+	ErrMissing      = errors.New("request not signed")
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrExpired      = errors.New("signature timestamp outside allowed skew")
+	ErrReplayed     = errors.New("signature nonce already used")
+	ErrBadSignature = errors.New("signature mismatch")
+	ErrBusy         = errors.New("too many recent signatures to track")
+)
+
+// Key is a shared secret, identified by ID so that several can be active
+// while rotating them.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseKey parses a key in the form id:secret.
+func ParseKey(s string) (Key, error) {
+	id, secret, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || id == "" || secret == "" {
+		return Key{}, errors.New("signing key must be id:secret")
+	}
+	return Key{ID: id, Secret: []byte(secret)}, nil
+}
+
+// ParseKeys parses a comma separated list of keys in the form id:secret.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, k := range strings.Split(s, ",") {
+		if strings.TrimSpace(k) == "" {
+			continue
+		}
+
+		key, err := ParseKey(k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+// Message is the signed content of a request.
+type Message struct {
+	Method         string
+	Path           string // including the query, if any
+	IdempotencyKey string
+	// TenantKey and Tenant are the tenant.KeyHeader and tenant.Header
+	// values selecting the tenant of the request.
+	TenantKey, Tenant string
+	Body              []byte
+}
+
+// requestMessage returns the signed content of r, whose body is body.
+func requestMessage(r *http.Request, body []byte) Message {
+	return Message{
+		Method:         r.Method,
+		Path:           r.URL.RequestURI(),
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		TenantKey:      r.Header.Get(tenant.KeyHeader),
+		Tenant:         r.Header.Get(tenant.Header),
+		Body:           body,
+	}
+}
+
+// Sign signs m with k, at the current time and with a new nonce,
+// setting the signature headers with set.
+func (k Key) Sign(m Message, set func(key, value string)) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return errors.WithStack(err)
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(b)
+
+	set(KeyIDHeader, k.ID)
+	set(TimestampHeader, ts)
+	set(NonceHeader, nonce)
+	set(SignatureHeader, hex.EncodeToString(k.mac(m, ts, nonce)))
+	return nil
+}
+
+// SignRequest signs req, whose body is body, with k.
+func (k Key) SignRequest(req *http.Request, body []byte) error {
+	return k.Sign(requestMessage(req, body), req.Header.Set)
+}
+
+// GRPCMessage returns the signed content of a gRPC call to fullMethod with req,
+// whose idempotency key, if any, is part of the body.
+func GRPCMessage(fullMethod string, req proto.Message) (Message, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return Message{}, errors.WithStack(err)
+	}
+	return Message{Method: http.MethodPost, Path: fullMethod, Body: b}, nil
+}
+
+func (k Key) mac(m Message, ts, nonce string) []byte {
+	bodyHash := sha256.Sum256(m.Body)
+
+	h := hmac.New(sha256.New, k.Secret)
+	for _, s := range []string{"v2", m.Method, m.Path, ts, nonce, m.IdempotencyKey, m.TenantKey, m.Tenant, hex.EncodeToString(bodyHash[:])} {
+		io.WriteString(h, s)
+		h.Write([]byte{'\n'})
+	}
+	return h.Sum(nil)
+}
+
+// Verifier verifies signed requests with any of its keys.
+type Verifier struct {
+	keys    map[string]Key
+	maxSkew time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time // nonce to when its timestamp expires
+	lastSweep time.Time
+}
+
+// NewVerifier returns a verifier accepting signatures by any of keys
+// with a timestamp at most maxSkew from now.
+func NewVerifier(keys []Key, maxSkew time.Duration) *Verifier {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+
+	v := Verifier{
+		keys:    make(map[string]Key, len(keys)),
+		maxSkew: maxSkew,
+		now:     time.Now,
+		nonces:  make(map[string]time.Time),
+	}
+	for _, k := range keys {
+		v.keys[k.ID] = k
+	}
+	return &v
+}
+
+// Verify checks the signature of m, read from its headers with get.
+func (v *Verifier) Verify(m Message, get func(key string) string) error {
+	keyID, ts, nonce, sig := get(KeyIDHeader), get(TimestampHeader), get(NonceHeader), get(SignatureHeader)
+	if keyID == "" || ts == "" || nonce == "" || sig == "" {
+		return ErrMissing
+	}
+
+	k, ok := v.keys[keyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrExpired
+	}
+	signed, now := time.Unix(unix, 0), v.now()
+	if signed.Before(now.Add(-v.maxSkew)) || signed.After(now.Add(v.maxSkew)) {
+		return ErrExpired
+	}
+
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, k.mac(m, ts, nonce)) {
+		return ErrBadSignature
+	}
+
+	// only remember nonces of valid signatures, so that
+	// they can not be used up by unauthenticated requests.
+	return v.useNonce(nonce, signed.Add(v.maxSkew), now)
+}
+
+// useNonce records nonce until expires, by when a request
+// reusing it would be rejected for its timestamp anyway.
+func (v *Verifier) useNonce(nonce string, expires, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.lastSweep) > v.maxSkew {
+		for n, exp := range v.nonces {
+			if now.After(exp) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastSweep = now
+	}
+
+	if exp, ok := v.nonces[nonce]; ok && !now.After(exp) {
+		return ErrReplayed
+	}
+
+	if len(v.nonces) >= maxNonces {
+		return ErrBusy
+	}
+	v.nonces[nonce] = expires
+	return nil
+}
+
+// Handler serves requests with h only if they are signed by one of the keys of v.
+func (v *Verifier) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody+1))
+		if err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxBody {
+			requestid.Error(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if err := v.Verify(requestMessage(r, body), r.Header.Get); err != nil {
+			Reject(r.Context(), err)
+			code := http.StatusUnauthorized
+			if err == ErrBusy {
+				code = http.StatusServiceUnavailable
+			}
+			requestid.Error(w, r, err.Error(), code)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Reject logs and counts a request rejected for its signature.
+func Reject(ctx context.Context, err error) {
+	logging.Ctx(ctx).Warn("rejected request signature", logging.F("reason", err.Error()))
+	verifyFailures.With(reason(err)).Inc()
+}
+
+func reason(err error) string {
+	switch err {
+	case ErrMissing:
+		return "missing"
+	case ErrUnknownKey:
+		return "unknown_key"
+	case ErrExpired:
+		return "expired"
+	case ErrReplayed:
+		return "replayed"
+	case ErrBadSignature:
+		return "mismatch"
+	case ErrBusy:
+		return "busy"
+	}
+	return "other"
+}
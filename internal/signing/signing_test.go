@@ -0,0 +1,141 @@
+package signing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/tenant"
+)
+
+func TestVerify(t *testing.T) {
+	old, current := Key{"old", []byte("s1")}, Key{"new", []byte("s2")}
+	v := NewVerifier([]Key{old, current}, time.Minute)
+
+	m := Message{Method: http.MethodPost, Path: "/?a=b", IdempotencyKey: "k", TenantKey: "api-key", Body: []byte("body")}
+	sign := func(k Key, m Message) http.Header {
+		h := make(http.Header)
+		if err := k.Sign(m, h.Set); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	// both keys are active while rotating
+	for _, k := range []Key{old, current} {
+		if err := v.Verify(m, sign(k, m).Get); err != nil {
+			t.Fatalf("key %s: %v", k.ID, err)
+		}
+	}
+
+	h := sign(current, m)
+	if err := v.Verify(m, h.Get); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(m, h.Get); err != ErrReplayed {
+		t.Fatalf("expected replay to be rejected, got %v", err)
+	}
+
+	tampered := []Message{
+		{Method: http.MethodGet, Path: m.Path, IdempotencyKey: m.IdempotencyKey, Body: m.Body},
+		{Method: m.Method, Path: "/?a=c", IdempotencyKey: m.IdempotencyKey, Body: m.Body},
+		{Method: m.Method, Path: m.Path, IdempotencyKey: "other", Body: m.Body},
+		{Method: m.Method, Path: m.Path, IdempotencyKey: m.IdempotencyKey, TenantKey: "other-key", Body: m.Body},
+		{Method: m.Method, Path: m.Path, IdempotencyKey: m.IdempotencyKey, TenantKey: m.TenantKey, Tenant: "other", Body: m.Body},
+		{Method: m.Method, Path: m.Path, IdempotencyKey: m.IdempotencyKey, TenantKey: m.TenantKey, Body: []byte("bodz")},
+	}
+	for i, tm := range tampered {
+		if err := v.Verify(tm, sign(current, m).Get); err != ErrBadSignature {
+			t.Fatalf("tampered message %d: expected mismatch, got %v", i, err)
+		}
+	}
+
+	if err := v.Verify(m, sign(Key{"retired", []byte("s0")}, m).Get); err != ErrUnknownKey {
+		t.Fatalf("expected unknown key, got %v", err)
+	}
+	if err := v.Verify(m, sign(Key{"new", []byte("wrong")}, m).Get); err != ErrBadSignature {
+		t.Fatalf("expected mismatch for wrong secret, got %v", err)
+	}
+	if err := v.Verify(m, make(http.Header).Get); err != ErrMissing {
+		t.Fatalf("expected missing signature, got %v", err)
+	}
+
+	h = sign(current, m)
+	v.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := v.Verify(m, h.Get); err != ErrExpired {
+		t.Fatalf("expected old signature to be rejected, got %v", err)
+	}
+	v.now = func() time.Time { return time.Now().Add(-2 * time.Minute) }
+	if err := v.Verify(m, h.Get); err != ErrExpired {
+		t.Fatalf("expected future signature to be rejected, got %v", err)
+	}
+
+	// nonces are forgotten once their timestamp expires
+	later := time.Now().Add(3 * time.Minute)
+	if err := v.useNonce("fresh", later.Add(time.Minute), later); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.nonces) != 1 {
+		t.Fatalf("expected expired nonces to be swept, have %d", len(v.nonces))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	k := Key{"k1", []byte("secret")}
+	v := NewVerifier([]Key{k}, 0)
+
+	var got string
+	h := v.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 16)
+		n, _ := r.Body.Read(b)
+		got = string(b[:n])
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/x?y=z", strings.NewReader("delta"))
+	r.Header.Set("Idempotency-Key", "abc")
+	r.Header.Set(tenant.Header, "acme")
+	if err := k.SignRequest(r, []byte("delta")); err != nil {
+		t.Fatal(err)
+	}
+	signed := r.Header.Clone()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || got != "delta" {
+		t.Fatalf("expected signed request to be served with its body, got %d %q", w.Code, got)
+	}
+
+	// the signature does not let another tenant be selected.
+	r = httptest.NewRequest(http.MethodPost, "/x?y=z", strings.NewReader("delta"))
+	r.Header = signed
+	r.Header.Set(tenant.Header, "other")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected request with changed tenant to be rejected, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/x", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unsigned request to be rejected, got %d", w.Code)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("a:1, b:2:3,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != "a" || string(keys[1].Secret) != "2:3" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+
+	for _, s := range []string{"", "a", ":1", "a:"} {
+		if _, err := ParseKeys(s); err == nil {
+			t.Fatalf("expected %q to be invalid", s)
+		}
+	}
+}
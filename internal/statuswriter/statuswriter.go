@@ -0,0 +1,62 @@
+// Package statuswriter records the status code of http responses
+// for middleware, without hiding the flushing and hijacking
+// that streaming handlers and websockets need.
+package statuswriter
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Writer is a http.ResponseWriter that records the status code written.
+type Writer struct {
+	http.ResponseWriter
+	status int
+}
+
+func Wrap(w http.ResponseWriter) *Writer {
+	return &Writer{ResponseWriter: w}
+}
+
+// Status returns the status code written, 200 if only a body was,
+// or 0 if nothing was written yet.
+func (w *Writer) Status() int {
+	return w.status
+}
+
+func (w *Writer) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *Writer) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
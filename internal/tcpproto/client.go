@@ -0,0 +1,271 @@
+package tcpproto
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrClientClosed = errors.New("tcpproto: client closed")
+
+// Client is a pool of connections to a server.
+// Requests are spread over the pool and pipelined on each connection.
+type Client struct {
+	addr        string
+	dialTimeout time.Duration
+	tls         *tls.Config
+
+	next uint32
+
+	mu     sync.Mutex
+	conns  []*clientConn
+	closed bool
+}
+
+// NewClient returns a client with poolSize connections to addr,
+// over TLS if tlsConfig is set.
+// Connections are made when first needed and remade if they break.
+func NewClient(addr string, poolSize int, dialTimeout time.Duration, tlsConfig *tls.Config) *Client {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	return &Client{
+		addr:        addr,
+		dialTimeout: dialTimeout,
+		tls:         tlsConfig,
+		conns:       make([]*clientConn, poolSize),
+	}
+}
+
+// Increment adds delta to the count and returns the new count.
+func (c *Client) Increment(ctx context.Context, delta uint64, idempotencyKey string) (uint64, error) {
+	counts, err := c.do(ctx, OpIncrement, encodeIncrement(delta, idempotencyKey), 1)
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+// Get returns the current count.
+func (c *Client) Get(ctx context.Context) (uint64, error) {
+	counts, err := c.do(ctx, OpGet, nil, 1)
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+// Batch applies increments in order and returns the new count after each one.
+func (c *Client) Batch(ctx context.Context, incs []Increment) ([]uint64, error) {
+	body, err := encodeBatch(incs)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, OpBatch, body, len(incs))
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for i, cc := range c.conns {
+		if cc != nil {
+			cc.close(ErrClientClosed)
+			c.conns[i] = nil
+		}
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, op byte, body []byte, counts int) ([]uint64, error) {
+	cc, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cc.do(ctx, op, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) != counts*8 {
+		return nil, errors.Errorf("expected %d counts, got %d bytes", counts, len(resp))
+	}
+
+	res := make([]uint64, counts)
+	for i := range res {
+		res[i] = binary.LittleEndian.Uint64(resp[i*8:])
+	}
+	return res, nil
+}
+
+// conn returns the next connection of the pool, dialing it if needed.
+// Dialing doesn't hold c.mu, so callers of other connections go ahead.
+func (c *Client) conn(ctx context.Context) (*clientConn, error) {
+	i := int(atomic.AddUint32(&c.next, 1) % uint32(len(c.conns)))
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	if cc := c.conns[i]; cc != nil && !cc.broken() {
+		c.mu.Unlock()
+		return cc, nil
+	}
+	c.mu.Unlock()
+
+	d := &net.Dialer{Timeout: c.dialTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		conn.Close()
+		return nil, ErrClientClosed
+	}
+	if cc := c.conns[i]; cc != nil && !cc.broken() {
+		// another caller dialed it meanwhile.
+		conn.Close()
+		return cc, nil
+	}
+
+	cc := newClientConn(conn)
+	c.conns[i] = cc
+	return cc, nil
+}
+
+type result struct {
+	body []byte
+	err  error
+}
+
+type clientConn struct {
+	c net.Conn
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan result
+	err     error // set once broken
+}
+
+func newClientConn(c net.Conn) *clientConn {
+	cc := &clientConn{
+		c:       c,
+		w:       bufio.NewWriter(c),
+		pending: make(map[uint64]chan result),
+	}
+
+	go cc.readLoop()
+	return cc
+}
+
+func (cc *clientConn) broken() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err != nil
+}
+
+func (cc *clientConn) do(ctx context.Context, op byte, body []byte) ([]byte, error) {
+	ch := make(chan result, 1)
+
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, cc.err
+	}
+	cc.nextID++
+	id := cc.nextID
+	cc.pending[id] = ch
+	cc.mu.Unlock()
+
+	cc.wmu.Lock()
+	err := writeFrame(cc.w, id, op, body)
+	if err == nil {
+		err = cc.w.Flush()
+	}
+	cc.wmu.Unlock()
+
+	if err != nil {
+		cc.close(errors.WithStack(err))
+		return nil, errors.WithStack(err)
+	}
+
+	select {
+	case r := <-ch:
+		return r.body, r.err
+	case <-ctx.Done():
+		cc.mu.Lock()
+		delete(cc.pending, id)
+		cc.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (cc *clientConn) readLoop() {
+	r := bufio.NewReader(cc.c)
+	var buf []byte
+
+	for {
+		id, status, body, err := readFrame(r, &buf)
+		if err != nil {
+			cc.close(errors.WithStack(err))
+			return
+		}
+
+		var res result
+		if status == statusOK {
+			res.body = append([]byte(nil), body...)
+		} else {
+			res.err = RemoteError(body)
+		}
+
+		cc.mu.Lock()
+		ch, ok := cc.pending[id]
+		delete(cc.pending, id)
+		cc.mu.Unlock()
+
+		if ok {
+			ch <- res
+		}
+	}
+}
+
+// close fails all pending requests with err.
+func (cc *clientConn) close(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.err != nil {
+		return
+	}
+
+	cc.err = err
+	cc.c.Close()
+	for id, ch := range cc.pending {
+		ch <- result{err: err}
+		delete(cc.pending, id)
+	}
+}
@@ -0,0 +1,165 @@
+// Package tcpproto implements a pipelined, length prefixed binary protocol
+// for cluster counts over raw TCP, avoiding the overhead of http.
+//
+// Every frame is a 4 byte length, followed by that many bytes:
+// an 8 byte request id and a 1 byte op (requests) or status (responses),
+// followed by the body. All integers are little endian.
+//
+// Request bodies:
+//
+//	OpIncrement: 8 byte delta, not 0, followed by an optional idempotency key.
+//	OpGet:       empty.
+//	OpBatch:     2 byte n, followed by n times:
+//	             8 byte delta, 2 byte key length, key.
+//
+// A successful response body holds an 8 byte count for every increment,
+// or the current count for OpGet. An error response body holds the error message.
+// Requests can be pipelined. Responses carry the id of their request.
+package tcpproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	OpIncrement byte = 1
+	OpGet       byte = 2
+	OpBatch     byte = 3
+)
+
+const (
+	statusOK    byte = 0
+	statusError byte = 1
+)
+
+const (
+	headerSize   = 9 // request id + op/status
+	maxFrameSize = 1 << 20
+	maxBatchSize = 1<<16 - 1
+)
+
+// Increment is a single increment of a batch.
+type Increment struct {
+	Delta          uint64
+	IdempotencyKey string
+}
+
+// ErrZeroDelta is returned for an increment of 0.
+var ErrZeroDelta = errors.New("delta must not be 0")
+
+// RemoteError is an error returned by the server.
+type RemoteError string
+
+func (e RemoteError) Error() string {
+	return "cluster error: " + string(e)
+}
+
+func writeFrame(w *bufio.Writer, id uint64, op byte, body []byte) error {
+	var hdr [4 + headerSize]byte
+	binary.LittleEndian.PutUint32(hdr[:4], uint32(headerSize+len(body)))
+	binary.LittleEndian.PutUint64(hdr[4:12], id)
+	hdr[12] = op
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// readFrame reads the next frame. The returned body is only valid until the next call.
+func readFrame(r *bufio.Reader, buf *[]byte) (id uint64, op byte, body []byte, err error) {
+	var l [4]byte
+	if _, err = io.ReadFull(r, l[:]); err != nil {
+		return
+	}
+
+	n := binary.LittleEndian.Uint32(l[:])
+	if n < headerSize || n > maxFrameSize {
+		err = errors.Errorf("invalid frame size %d", n)
+		return
+	}
+
+	if cap(*buf) < int(n) {
+		*buf = make([]byte, n)
+	}
+	b := (*buf)[:n]
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+
+	return binary.LittleEndian.Uint64(b[:8]), b[8], b[headerSize:], nil
+}
+
+func encodeIncrement(delta uint64, idempotencyKey string) []byte {
+	b := make([]byte, 8+len(idempotencyKey))
+	binary.LittleEndian.PutUint64(b, delta)
+	copy(b[8:], idempotencyKey)
+	return b
+}
+
+func encodeBatch(incs []Increment) ([]byte, error) {
+	if len(incs) == 0 || len(incs) > maxBatchSize {
+		return nil, errors.Errorf("invalid batch size %d", len(incs))
+	}
+
+	size := 2
+	for _, inc := range incs {
+		if len(inc.IdempotencyKey) > maxBatchSize {
+			return nil, errors.New("idempotency key too long")
+		}
+		size += 10 + len(inc.IdempotencyKey)
+	}
+
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint16(b, uint16(len(incs)))
+	i := 2
+	for _, inc := range incs {
+		binary.LittleEndian.PutUint64(b[i:], inc.Delta)
+		binary.LittleEndian.PutUint16(b[i+8:], uint16(len(inc.IdempotencyKey)))
+		i += 10
+		i += copy(b[i:], inc.IdempotencyKey)
+	}
+	return b, nil
+}
+
+func decodeBatch(b []byte) ([]Increment, error) {
+	if len(b) < 2 {
+		return nil, errors.New("batch too short")
+	}
+
+	n := int(binary.LittleEndian.Uint16(b))
+	if n == 0 {
+		return nil, errors.New("empty batch")
+	}
+
+	b = b[2:]
+	incs := make([]Increment, n)
+	for i := range incs {
+		if len(b) < 10 {
+			return nil, errors.New("batch too short")
+		}
+
+		incs[i].Delta = binary.LittleEndian.Uint64(b)
+		if incs[i].Delta == 0 {
+			return nil, ErrZeroDelta
+		}
+		kl := int(binary.LittleEndian.Uint16(b[8:]))
+		b = b[10:]
+		if len(b) < kl {
+			return nil, errors.New("batch too short")
+		}
+
+		incs[i].IdempotencyKey = string(b[:kl])
+		b = b[kl:]
+	}
+
+	if len(b) != 0 {
+		return nil, errors.New("trailing bytes after batch")
+	}
+	return incs, nil
+}
@@ -0,0 +1,106 @@
+package tcpproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/RoanBrand/RequestCounter/internal/connserver"
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// Handler applies requests to the count.
+type Handler interface {
+	// Increment adds delta to the count, unless idempotencyKey
+	// was recently seen, and returns the new count.
+	Increment(delta uint64, idempotencyKey string) uint64
+	Count() uint64
+}
+
+type Server struct {
+	*connserver.Server
+	h Handler
+}
+
+func NewServer(h Handler) *Server {
+	s := &Server{h: h}
+	s.Server = connserver.New(s.serveConn)
+	return s
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	var buf, resp []byte
+
+	for {
+		id, op, body, err := readFrame(r, &buf)
+		if err != nil {
+			if !isClosedErr(err) {
+				logging.Warn("tcp connection error", logging.Err(err))
+			}
+			return
+		}
+
+		resp = resp[:0]
+		status := statusOK
+		resp, err = s.handle(resp, op, body)
+		if err != nil {
+			status = statusError
+			resp = append(resp[:0], err.Error()...)
+		}
+
+		if err := writeFrame(w, id, status, resp); err != nil {
+			return
+		}
+
+		// flush once all pipelined requests read so far are answered.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handle(resp []byte, op byte, body []byte) ([]byte, error) {
+	switch op {
+	case OpIncrement:
+		if len(body) < 8 {
+			return nil, errors.New("increment too short")
+		}
+		delta := binary.LittleEndian.Uint64(body)
+		if delta == 0 {
+			return nil, ErrZeroDelta
+		}
+		return appendCount(resp, s.h.Increment(delta, string(body[8:]))), nil
+
+	case OpGet:
+		return appendCount(resp, s.h.Count()), nil
+
+	case OpBatch:
+		incs, err := decodeBatch(body)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, inc := range incs {
+			resp = appendCount(resp, s.h.Increment(inc.Delta, inc.IdempotencyKey))
+		}
+		return resp, nil
+	}
+
+	return nil, errors.New("unknown op")
+}
+
+func appendCount(b []byte, count uint64) []byte {
+	var c [8]byte
+	binary.LittleEndian.PutUint64(c[:], count)
+	return append(b, c[:]...)
+}
+
+func isClosedErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
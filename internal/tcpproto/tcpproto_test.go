@@ -0,0 +1,167 @@
+package tcpproto
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type counter struct {
+	count uint64
+	keys  sync.Map
+}
+
+func (c *counter) Increment(delta uint64, idempotencyKey string) uint64 {
+	if idempotencyKey != "" {
+		if n, ok := c.keys.Load(idempotencyKey); ok {
+			return n.(uint64)
+		}
+	}
+
+	n := atomic.AddUint64(&c.count, delta)
+	if idempotencyKey != "" {
+		c.keys.Store(idempotencyKey, n)
+	}
+	return n
+}
+
+func (c *counter) Count() uint64 {
+	return atomic.LoadUint64(&c.count)
+}
+
+func startServer(t *testing.T) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(&counter{})
+	go s.Serve(ln)
+	return s, ln.Addr().String()
+}
+
+func TestPipelinedIncrements(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Close()
+
+	c := NewClient(addr, 2, time.Second, nil)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	num := 1000
+	seen := make([]uint32, num+1)
+	var wg sync.WaitGroup
+	wg.Add(num)
+	for i := 0; i < num; i++ {
+		go func() {
+			defer wg.Done()
+
+			n, err := c.Increment(ctx, 1, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n == 0 || n > uint64(num) {
+				t.Errorf("unexpected count %d", n)
+				return
+			}
+			atomic.AddUint32(&seen[n], 1)
+		}()
+	}
+	wg.Wait()
+
+	for i := 1; i <= num; i++ {
+		if seen[i] != 1 {
+			t.Fatalf("count %d seen %d times", i, seen[i])
+		}
+	}
+
+	if n, err := c.Get(ctx); err != nil {
+		t.Fatal(err)
+	} else if n != uint64(num) {
+		t.Fatalf("expected %d, got %d", num, n)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Close()
+
+	c := NewClient(addr, 1, time.Second, nil)
+	defer c.Close()
+
+	counts, err := c.Batch(context.Background(), []Increment{
+		{Delta: 5, IdempotencyKey: "a"},
+		{Delta: 5, IdempotencyKey: "a"},
+		{Delta: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, exp := range []uint64{5, 5, 7} {
+		if counts[i] != exp {
+			t.Fatalf("expected %v, got %v", []uint64{5, 5, 7}, counts)
+		}
+	}
+
+	if _, err := c.Batch(context.Background(), nil); err == nil {
+		t.Fatal("expected error for empty batch")
+	}
+	if _, err := c.Batch(context.Background(), []Increment{{Delta: 1}, {Delta: 0}}); err == nil {
+		t.Fatal("expected error for delta 0")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s, addr := startServer(t)
+
+	c := NewClient(addr, 1, time.Second, nil)
+	defer c.Close()
+
+	if _, err := c.Increment(context.Background(), 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+	if _, err := c.Increment(context.Background(), 1, ""); err == nil {
+		t.Fatal("expected error with server closed")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("could not listen on same address again:", err)
+	}
+
+	s = NewServer(&counter{})
+	go s.Serve(ln)
+	defer s.Close()
+
+	if n, err := c.Increment(context.Background(), 1, ""); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 1, got %d", n)
+	}
+}
+
+func TestConnIndexWraps(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Close()
+
+	c := NewClient(addr, 3, time.Second, nil)
+	defer c.Close()
+
+	// the next connection index wraps around, and stays in the pool.
+	c.next = math.MaxUint32 - 1
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
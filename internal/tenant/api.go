@@ -0,0 +1,104 @@
+package tenant
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/RoanBrand/RequestCounter/internal/requestid"
+)
+
+const maxTenantSize = 64 * 1024
+
+// ServeHTTP serves the tenants admin API, relative to where it is mounted:
+//
+//	GET    /      list tenants
+//	POST   /      add or replace a tenant
+//	GET    /{id}  get a tenant
+//	PUT    /{id}  add or replace a tenant
+//	DELETE /{id}  delete a tenant
+//
+// API keys are redacted in responses.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		tenants := reg.Tenants()
+		for i := range tenants {
+			tenants[i].redact()
+		}
+		writeJSON(w, http.StatusOK, tenants)
+
+	case id == "" && r.Method == http.MethodPost, id != "" && r.Method == http.MethodPut:
+		var t Tenant
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxTenantSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&t); err != nil {
+			requestid.Error(w, r, "invalid tenant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if id != "" {
+			t.ID = id
+		}
+
+		if err := t.validate(); err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := reg.Put(t); err != nil {
+			status := http.StatusInternalServerError
+			if err == ErrKeyInUse {
+				status = http.StatusConflict
+			}
+			requestid.Error(w, r, err.Error(), status)
+			return
+		}
+		t.redact()
+		writeJSON(w, http.StatusOK, t)
+
+	case id != "" && r.Method == http.MethodGet:
+		t, ok := reg.Get(id)
+		if !ok {
+			requestid.Error(w, r, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		t.redact()
+		writeJSON(w, http.StatusOK, t)
+
+	case id != "" && r.Method == http.MethodDelete:
+		ok, err := reg.Delete(id)
+		if err != nil {
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			requestid.Error(w, r, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		requestid.Error(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// redact hides the API keys of a tenant served by the API.
+func (t *Tenant) redact() {
+	keys := make([]string, len(t.Keys))
+	for i := range keys {
+		keys[i] = "redacted"
+	}
+	if len(keys) > 0 {
+		t.Keys = keys
+	}
+}
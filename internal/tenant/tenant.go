@@ -0,0 +1,278 @@
+// Package tenant holds the tenants of a deployment, each with its own
+// namespace of counters, and resolves which one a request belongs to.
+package tenant
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Headers selecting the tenant of a request.
+const (
+	KeyHeader = "X-API-Key" // an API key of the tenant
+	Header    = "X-Tenant"  // the id of a tenant without API keys
+)
+
+const maxID = 63
+
+var (
+	ErrNotFound    = errors.New("tenant not found")
+	ErrUnknownKey  = errors.New("unknown API key")
+	ErrKeyRequired = errors.New("tenant requires an API key")
+	ErrKeyInUse    = errors.New("API key already used by another tenant")
+)
+
+// Tenant has its own namespace of counters, named after its id.
+// A tenant with API keys can only be selected with one of them, others
+// can be selected by id, e.g. derived by RequestCounter from the hostname.
+type Tenant struct {
+	ID   string   `json:"id"`
+	Keys []string `json:"keys,omitempty"`
+	// Quota is the id of the quota the tenant's requests are held to, if any.
+	Quota string `json:"quota,omitempty"`
+}
+
+// validID reports whether id is a valid tenant id, a DNS label
+// of lowercase letters, digits and hyphens.
+func validID(id string) bool {
+	if id == "" || len(id) > maxID || id[0] == '-' || id[len(id)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Tenant) validate() error {
+	if t.ID == "" {
+		return errors.New("tenant id required")
+	}
+	if !validID(t.ID) {
+		return errors.New("tenant id must be lowercase letters, digits and hyphens, up to 63")
+	}
+
+	seen := make(map[string]bool, len(t.Keys))
+	for _, k := range t.Keys {
+		if k == "" {
+			return errors.New("empty API key")
+		}
+		if seen[k] {
+			return errors.New("duplicate API key")
+		}
+		seen[k] = true
+	}
+	return nil
+}
+
+// Registry holds tenants, persisted to a file.
+type Registry struct {
+	file string
+
+	mu      sync.RWMutex
+	tenants map[string]Tenant
+}
+
+// New loads tenants from file, which can be empty to not persist them.
+func New(file string) (*Registry, error) {
+	reg := Registry{file: file, tenants: make(map[string]Tenant)}
+	if file == "" {
+		return &reg, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &reg, nil
+		}
+		return nil, errors.Wrap(err, "unable to read "+file)
+	}
+
+	var tenants []Tenant
+	if err := json.Unmarshal(b, &tenants); err != nil {
+		return nil, errors.Wrap(err, "unable to parse "+file)
+	}
+
+	for _, t := range tenants {
+		if err := t.validate(); err != nil {
+			return nil, errors.WithMessage(err, "tenant "+t.ID)
+		}
+		if reg.keyInUse(t) {
+			return nil, errors.WithMessage(ErrKeyInUse, "tenant "+t.ID)
+		}
+		reg.tenants[t.ID] = t
+	}
+	return &reg, nil
+}
+
+// Tenants returns all tenants, sorted by id.
+func (reg *Registry) Tenants() []Tenant {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return reg.sorted()
+}
+
+func (reg *Registry) sorted() []Tenant {
+	tenants := make([]Tenant, 0, len(reg.tenants))
+	for _, t := range reg.tenants {
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants
+}
+
+// Get returns the tenant with id.
+func (reg *Registry) Get(id string) (Tenant, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	t, ok := reg.tenants[id]
+	return t, ok
+}
+
+// Put adds t, or replaces the tenant with the same id.
+// Its API keys can't be used by another tenant.
+func (reg *Registry) Put(t Tenant) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.keyInUse(t) {
+		return ErrKeyInUse
+	}
+
+	prev, ok := reg.tenants[t.ID]
+	reg.tenants[t.ID] = t
+	if err := reg.save(); err != nil {
+		if ok {
+			reg.tenants[t.ID] = prev
+		} else {
+			delete(reg.tenants, t.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// keyInUse reports whether another tenant has one of the keys of t.
+func (reg *Registry) keyInUse(t Tenant) bool {
+	for _, other := range reg.tenants {
+		if other.ID == t.ID {
+			continue
+		}
+		for _, k := range t.Keys {
+			for _, ok := range other.Keys {
+				if k == ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Delete removes the tenant with id and reports whether it existed.
+// The counters of its namespace are left as they are.
+func (reg *Registry) Delete(id string) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	prev, ok := reg.tenants[id]
+	if !ok {
+		return false, nil
+	}
+
+	delete(reg.tenants, id)
+	if err := reg.save(); err != nil {
+		reg.tenants[id] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+func (reg *Registry) save() error {
+	if reg.file == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(reg.sorted(), "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := reg.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "unable to save "+reg.file)
+	}
+	return errors.Wrap(os.Rename(tmp, reg.file), "unable to save "+reg.file)
+}
+
+// Resolve returns the tenant of a request: the one with the API key in its
+// KeyHeader, otherwise the one with the id in its Header, which must not
+// have API keys. Requests with neither header belong to no tenant.
+func (reg *Registry) Resolve(r *http.Request) (*Tenant, error) {
+	if key := r.Header.Get(KeyHeader); key != "" {
+		return reg.byKey(key)
+	}
+
+	id := r.Header.Get(Header)
+	if id == "" {
+		return nil, nil
+	}
+
+	t, ok := reg.Get(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if len(t.Keys) > 0 {
+		return nil, ErrKeyRequired
+	}
+	return &t, nil
+}
+
+// byKey returns the tenant with key, comparing it to every key
+// in constant time so that its timing gives nothing away.
+func (reg *Registry) byKey(key string) (*Tenant, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	var found *Tenant
+	for _, t := range reg.tenants {
+		for _, k := range t.Keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+				t := t
+				found = &t
+			}
+		}
+	}
+	if found == nil {
+		return nil, ErrUnknownKey
+	}
+	return found, nil
+}
+
+// StatusCode returns the http status code of an error of Resolve.
+func StatusCode(err error) int {
+	switch err {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrUnknownKey, ErrKeyRequired:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
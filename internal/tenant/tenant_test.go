@@ -0,0 +1,108 @@
+package tenant
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	os.Remove("test.tenants") // in case previous run failed
+	defer os.Remove("test.tenants")
+
+	reg, err := New("test.tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Put(Tenant{ID: "acme", Keys: []string{"k1", "k2"}, Quota: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Put(Tenant{ID: "beta"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Put(Tenant{ID: "gamma", Keys: []string{"k2"}}); err != ErrKeyInUse {
+		t.Fatalf("expected key in use, got %v", err)
+	}
+	if err := reg.Put(Tenant{ID: "Bad_Id"}); err == nil {
+		t.Fatal("expected invalid id")
+	}
+
+	resolve := func(key, id string) (*Tenant, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if key != "" {
+			r.Header.Set(KeyHeader, key)
+		}
+		if id != "" {
+			r.Header.Set(Header, id)
+		}
+		return reg.Resolve(r)
+	}
+
+	if ten, err := resolve("k2", ""); err != nil || ten.ID != "acme" {
+		t.Fatalf("expected acme by key, got %v %v", ten, err)
+	}
+	if ten, err := resolve("k2", "beta"); err != nil || ten.ID != "acme" {
+		t.Fatalf("expected key to take precedence, got %v %v", ten, err)
+	}
+	if _, err := resolve("nope", ""); err != ErrUnknownKey {
+		t.Fatalf("expected unknown key, got %v", err)
+	}
+	if ten, err := resolve("", "beta"); err != nil || ten.ID != "beta" {
+		t.Fatalf("expected beta by id, got %v %v", ten, err)
+	}
+	if _, err := resolve("", "acme"); err != ErrKeyRequired {
+		t.Fatalf("expected tenant with keys to require one, got %v", err)
+	}
+	if _, err := resolve("", "other"); err != ErrNotFound {
+		t.Fatalf("expected unknown tenant, got %v", err)
+	}
+	if ten, err := resolve("", ""); ten != nil || err != nil {
+		t.Fatalf("expected no tenant, got %v %v", ten, err)
+	}
+
+	// tenants are persisted
+	reg, err = New("test.tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenants := reg.Tenants(); len(tenants) != 2 || tenants[0].Quota != "acme" {
+		t.Fatalf("expected tenants to be loaded, got %+v", tenants)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	reg, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do(http.MethodPut, "/acme", `{"keys": ["s3cret"]}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "s3cret") {
+		t.Fatalf("expected tenant to be added with key redacted, got %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/", `{"id": "beta", "keys": ["s3cret"]}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected key in use to conflict, got %d", w.Code)
+	}
+
+	w := do(http.MethodGet, "/", "")
+	var tenants []Tenant
+	if err := json.NewDecoder(w.Body).Decode(&tenants); err != nil || len(tenants) != 1 || tenants[0].Keys[0] != "redacted" {
+		t.Fatalf("unexpected tenants %+v, %v", tenants, err)
+	}
+
+	if w := do(http.MethodDelete, "/acme", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected tenant to be deleted, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/acme", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected tenant to be gone, got %d", w.Code)
+	}
+}
@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/RoanBrand/RequestCounter/internal/config"
+	"github.com/pkg/errors"
+)
+
+// Settings configure tracing, see SetupFrom.
+var Settings = []config.Setting{
+	{Name: "OTEL_EXPORTER_OTLP_ENDPOINT", Usage: `OTLP/HTTP collector to export traces to, e.g. "http://collector:4318"`},
+	{Name: "TRACE_FILE", Usage: "file to append OTLP/JSON lines of traces to instead"},
+	{Name: "OTEL_SERVICE_NAME", Usage: "service name of traces, the command's if not set"},
+	{Name: "TRACE_SAMPLE_RATIO", Kind: config.Float, Default: "1", Usage: "ratio of new traces to sample"},
+}
+
+// ConfigFrom returns the Config of Settings without its Exporter,
+// so they can be checked before SetupFrom sets it up.
+func ConfigFrom(defaultServiceName string, get config.Getter) (Config, error) {
+	cfg := Config{ServiceName: defaultServiceName}
+	if v := get("OTEL_SERVICE_NAME"); v != "" {
+		cfg.ServiceName = v
+	}
+
+	if v := get("TRACE_SAMPLE_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return cfg, errors.New("invalid TRACE_SAMPLE_RATIO: " + v)
+		}
+		cfg.SampleRatio = ratio
+	}
+	return cfg, nil
+}
+
+// SetupFrom sets up tracing if Settings configure an exporter.
+// The returned shutdown function exports spans still queued.
+func SetupFrom(defaultServiceName string, get config.Getter) (shutdown func(ctx context.Context) error, err error) {
+	cfg, err := ConfigFrom(defaultServiceName, get)
+	if err != nil {
+		return nil, err
+	}
+
+	var closeExporter func() error
+	if endpoint := get("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		cfg.Exporter = NewOTLPExporter(endpoint)
+	} else if file := get("TRACE_FILE"); file != "" {
+		e, err := NewFileExporter(file)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Exporter, closeExporter = e, e.Close
+	} else {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	stop := Setup(cfg)
+	return func(ctx context.Context) error {
+		err := stop(ctx)
+		if closeExporter != nil {
+			if cErr := closeExporter(); err == nil {
+				err = cErr
+			}
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,339 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxQueuedSpans = 2048
+	maxBatchSize   = 512
+	batchInterval  = time.Second
+	exportTimeout  = time.Second * 10
+)
+
+var spansDropped = expvar.NewInt("tracing_spans_dropped")
+
+// Exporter sends a batch of spans, encoded as an OTLP/JSON
+// ExportTraceServiceRequest, to a collector or elsewhere.
+type Exporter interface {
+	Export(ctx context.Context, body []byte) error
+}
+
+// Config sets up tracing.
+type Config struct {
+	// ServiceName identifies the service in exported spans.
+	ServiceName string
+	Exporter    Exporter
+	// SampleRatio is the ratio of new traces that are sampled and exported,
+	// 1 if 0. Traces continued from other services keep their sampling decision.
+	SampleRatio float64
+}
+
+var (
+	globalMu sync.RWMutex
+	global   *processor
+)
+
+func current() *processor {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return global
+}
+
+// Setup starts exporting spans in batches with cfg.
+// The returned shutdown function stops tracing and exports spans still queued.
+func Setup(cfg Config) (shutdown func(ctx context.Context) error) {
+	if cfg.SampleRatio <= 0 || cfg.SampleRatio > 1 {
+		cfg.SampleRatio = 1
+	}
+
+	p := &processor{
+		cfg:   cfg,
+		queue: make(chan *Span, maxQueuedSpans),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+
+	globalMu.Lock()
+	global = p
+	globalMu.Unlock()
+
+	return func(ctx context.Context) error {
+		globalMu.Lock()
+		if global == p {
+			global = nil
+		}
+		globalMu.Unlock()
+
+		p.close()
+		select {
+		case <-p.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// processor batches finished spans for its exporter.
+type processor struct {
+	cfg Config
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *Span
+	done   chan struct{}
+}
+
+func (p *processor) sample() bool {
+	if p.cfg.SampleRatio >= 1 {
+		return true
+	}
+	randMu.Lock()
+	defer randMu.Unlock()
+	return rnd.Float64() < p.cfg.SampleRatio
+}
+
+// enqueue queues s for export, dropping it if the queue is full.
+func (p *processor) enqueue(s *Span) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return
+	}
+
+	select {
+	case p.queue <- s:
+	default:
+		spansDropped.Add(1)
+	}
+}
+
+func (p *processor) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+}
+
+func (p *processor) run() {
+	defer close(p.done)
+
+	t := time.NewTicker(batchInterval)
+	defer t.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	for {
+		select {
+		case s, ok := <-p.queue:
+			if !ok {
+				p.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < maxBatchSize {
+				continue
+			}
+		case <-t.C:
+		}
+
+		p.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (p *processor) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(encode(p.cfg.ServiceName, batch))
+	if err != nil {
+		logging.Error("error encoding spans", logging.Err(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	if err := p.cfg.Exporter.Export(ctx, body); err != nil {
+		spansDropped.Add(int64(len(batch)))
+		logging.Warn("error exporting spans", logging.F("spans", len(batch)), logging.Err(err))
+	}
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector over OTLP/HTTP with JSON encoding.
+type OTLPExporter struct {
+	url    string
+	client http.Client
+}
+
+// NewOTLPExporter exports to the collector at endpoint, e.g. "http://collector:4318".
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: http.Client{Timeout: exportTimeout},
+	}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("collector returned " + resp.Status)
+	}
+	return nil
+}
+
+// FileExporter appends each batch of spans to a file as a line of OTLP/JSON,
+// like the OpenTelemetry collector's file exporter.
+type FileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open "+path)
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (e *FileExporter) Export(_ context.Context, body []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err := e.f.Write(append(body, '\n'))
+	return errors.WithStack(err)
+}
+
+func (e *FileExporter) Close() error {
+	return e.f.Close()
+}
+
+// OTLP/JSON ExportTraceServiceRequest.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              Kind           `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 2 is error
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"` // int64 as a string
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+func encode(service string, spans []*Span) otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		out[i] = otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != (SpanID{}) {
+			out[i].ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attrs {
+			out[i].Attributes = append(out[i].Attributes, keyValue(a.Key, a.Value))
+		}
+		if s.err != "" {
+			out[i].Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{keyValue("service.name", service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/RoanBrand/RequestCounter"}, Spans: out}},
+	}}}
+}
+
+func keyValue(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	intValue := func(s string) { kv.Value.IntValue = &s }
+
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		intValue(strconv.Itoa(v))
+	case int64:
+		intValue(strconv.FormatInt(v, 10))
+	case uint64:
+		intValue(strconv.FormatUint(v, 10))
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := "unsupported attribute type"
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
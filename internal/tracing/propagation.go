@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/RoanBrand/RequestCounter/internal/logging"
+	"github.com/RoanBrand/RequestCounter/internal/statuswriter"
+)
+
+// TraceparentHeader is the W3C Trace Context header propagating a span.
+const TraceparentHeader = "traceparent"
+
+// ParseTraceparent parses a traceparent header value,
+// "version-traceid-spanid-flags", e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return sc, false
+	}
+
+	version, err := hex.DecodeString(v[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(v) != 55) {
+		return sc, false
+	}
+	if len(v) > 55 && v[55] != '-' {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(v[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(v[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(v[53:55])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+// Traceparent formats sc as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// Inject sets the traceparent header of an outgoing request to the current span of ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := spanContext(ctx); sc.IsValid() {
+		h.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// Extract returns ctx continuing the trace of an incoming request's traceparent header, if any.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := ParseTraceparent(h.Get(TraceparentHeader)); ok {
+		return ContextWithRemote(ctx, sc)
+	}
+	return ctx
+}
+
+// Handler serves requests with h in a server span called name,
+// continuing the trace of the request's traceparent header.
+func Handler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := Start(Extract(r.Context(), r.Header), name, KindServer)
+		if span == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		ctx = logging.ContextWith(ctx, logging.F("trace_id", span.SpanContext().TraceID.String()))
+
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.target", r.URL.RequestURI())
+
+		sw := statuswriter.Wrap(w)
+		h.ServeHTTP(sw, r.WithContext(ctx))
+
+		status := sw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttr("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.SetError(errorStatus(status))
+		}
+	})
+}
+
+type errorStatus int
+
+func (e errorStatus) Error() string {
+	return strconv.Itoa(int(e)) + " " + http.StatusText(int(e))
+}
@@ -0,0 +1,194 @@
+// Package tracing records spans of work, propagates them to other
+// services with W3C traceparent headers and exports them over OTLP/HTTP.
+//
+// Spans are only created once an exporter is set up with Setup,
+// or to continue a trace started by another service.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Kind is the role of a span, as defined by OpenTelemetry.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span and the trace it is part of.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Attr is a span attribute. Value is a string, bool, int, int64, uint64 or float64.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a timed operation. A nil Span is valid and does nothing,
+// so callers need not check whether tracing is enabled.
+type Span struct {
+	name   string
+	kind   Kind
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []Attr
+	err   string
+	ended bool
+}
+
+// SetAttr adds an attribute to the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, Attr{key, value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed with err, if not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// SpanContext returns the identity of the span, to propagate it.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// End ends the span and queues it for export if sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		if p := current(); p != nil {
+			p.enqueue(s)
+		}
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// SpanFromContext returns the current span of ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemote returns ctx with sc, received from another service,
+// as the parent of spans started from it.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// spanContext returns the span context of the current span of ctx,
+// or the remote one it continues.
+func spanContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Start starts a span as a child of the current or remote span of ctx
+// and returns a context with it as the current span.
+// If tracing is not set up and there is no trace to continue,
+// it returns ctx and a nil span.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := spanContext(ctx)
+	p := current()
+	if p == nil && !parent.IsValid() {
+		return ctx, nil
+	}
+
+	s := &Span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+	}
+
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		s.sc.TraceID = newTraceID()
+		s.sc.Sampled = p.sample()
+	}
+	s.sc.SpanID = newSpanID()
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+var (
+	randMu sync.Mutex
+	rnd    = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func newTraceID() (t TraceID) {
+	randMu.Lock()
+	defer randMu.Unlock()
+	for t == (TraceID{}) {
+		binary.LittleEndian.PutUint64(t[:8], rnd.Uint64())
+		binary.LittleEndian.PutUint64(t[8:], rnd.Uint64())
+	}
+	return t
+}
+
+func newSpanID() (s SpanID) {
+	randMu.Lock()
+	defer randMu.Unlock()
+	for s == (SpanID{}) {
+		binary.LittleEndian.PutUint64(s[:], rnd.Uint64())
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(valid)
+	if !ok || !sc.Sampled || sc.Traceparent() != valid {
+		t.Fatal(sc, ok)
+	}
+
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(v); ok {
+			t.Error("expected invalid:", v)
+		}
+	}
+
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future"); !ok {
+		t.Error("expected future versions to be parsed")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	os.Remove("test.traces") // in case previous run failed
+	defer os.Remove("test.traces")
+
+	exp, err := NewFileExporter("test.traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exp.Close()
+	shutdown := Setup(Config{ServiceName: "test", Exporter: exp})
+
+	downstream := httptest.NewServer(Handler("downstream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})))
+	defer downstream.Close()
+
+	upstream := httptest.NewServer(Handler("upstream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := Start(r.Context(), "call", KindClient)
+		defer span.End()
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, downstream.URL, nil)
+		Inject(ctx, req.Header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})))
+	defer upstream.Close()
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set(TraceparentHeader, incoming)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("test.traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	spans := make(map[string]otlpSpan)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var req otlpRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans[s.Name] = s
+		}
+	}
+
+	up, call, down := spans["upstream"], spans["call"], spans["downstream"]
+	if len(spans) != 3 {
+		t.Fatal("expected 3 spans, got", spans)
+	}
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Error("span", s.Name, "not in incoming trace:", s.TraceID)
+		}
+	}
+	if up.ParentSpanID != "00f067aa0ba902b7" || call.ParentSpanID != up.SpanID || down.ParentSpanID != call.SpanID {
+		t.Error("unexpected span parents:", spans)
+	}
+	if down.Status.Code != 2 || up.Status.Code != 0 {
+		t.Error("expected only downstream span to have failed:", spans)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop", KindInternal)
+	if span != nil || ctx != context.Background() {
+		t.Fatal("expected no span without tracing set up")
+	}
+	span.SetAttr("k", "v")
+	span.End()
+}
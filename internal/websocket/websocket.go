@@ -0,0 +1,252 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455), enough to push text messages to browsers.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+
+	maxMessageSize = 64 * 1024
+	writeTimeout   = time.Second * 10
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var ErrClosed = errors.New("websocket: connection closed")
+
+// IsUpgrade reports whether r asks to be upgraded to a WebSocket connection.
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Upgrade takes over the connection of r and completes the WebSocket handshake.
+// On error, an http error response has already been sent.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsUpgrade(r) {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response does not support hijacking")
+	}
+
+	c, brw, err := h.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, errors.WithStack(err)
+	}
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	brw.WriteString(base64.StdEncoding.EncodeToString(sum[:]))
+	brw.WriteString("\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		c.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	// deadlines set by the http server no longer apply.
+	c.SetDeadline(time.Time{})
+
+	return &Conn{c: c, r: brw.Reader, w: brw.Writer, done: make(chan struct{})}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conn is a server side WebSocket connection.
+// Writes are safe for concurrent use. ReadLoop must be running
+// for control frames from the client to be handled.
+type Conn struct {
+	c net.Conn
+	r *bufio.Reader
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Done is closed once the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Conn) WriteText(msg []byte) error {
+	return c.writeFrame(opText, msg)
+}
+
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// Close sends a close frame and closes the connection.
+func (c *Conn) Close() error {
+	c.writeFrame(opClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	return c.close()
+}
+
+func (c *Conn) close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.c.Close()
+	})
+	return err
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	var hdr [10]byte
+	hdr[0] = 0x80 | op // FIN
+	n := 2
+	switch l := len(payload); {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n = 10
+	}
+
+	c.c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	c.w.Write(hdr[:n])
+	c.w.Write(payload)
+	if err := c.w.Flush(); err != nil {
+		c.close()
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// ReadLoop reads frames from the client until the connection is closed,
+// answering pings and close frames. Data messages are discarded.
+func (c *Conn) ReadLoop() error {
+	defer c.close()
+
+	for {
+		op, payload, err := c.readFrame()
+		if err != nil {
+			select {
+			case <-c.done:
+				return nil
+			default:
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return err
+			}
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	op := hdr[0] & 0x0f
+	if hdr[1]&0x80 == 0 {
+		return 0, nil, errors.New("websocket: client frame not masked")
+	}
+
+	l := uint64(hdr[1] & 0x7f)
+	switch l {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		l = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		l = binary.BigEndian.Uint64(b[:])
+	}
+
+	if l > maxMessageSize {
+		return 0, nil, errors.New("websocket: frame too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return op, payload, nil
+}